@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"os"
 	"os/signal"
@@ -31,26 +32,99 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	agent := &http.Client{}
-	metrics := services.NewMetricsService(cfg.ReportInterval, cfg.PollInterval, cfg.RateLimit)
+	metrics, err := services.NewMetricsService(cfg)
+	if err != nil {
+		log.Panic().Err(err).Msg("metrics service creation error")
+	}
+	agent := &http.Client{Transport: metrics.RemoteConfigTransport(http.DefaultTransport)}
+
+	// the config from the server is applied before the collectors start
+	configCtx, cancelConfig := context.WithTimeout(ctx, 5*time.Second)
+	metrics.LoadConfig(configCtx)
+	cancelConfig()
+	go metrics.WatchConfig(ctx)
 
 	go metrics.CollectRuntime(ctx)
 	go metrics.CollectAdvanced(ctx)
+	go metrics.CollectExec(ctx)
+	go metrics.CollectLogs(ctx)
+	go metrics.CollectCgroup(ctx)
+	go metrics.CollectProbes(ctx)
 
-	time.Sleep(100 * time.Millisecond)
-	go metrics.MergeAndPushToQueue(ctx, cfg.Key)
+	sink, err := services.NewSink(cfg, agent)
+	if err != nil {
+		log.Panic().Err(err).Msg("output creation error")
+	}
+
+	// the senders get their own context, so that the final flush can be sent after a signal
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
 
 	wg := &sync.WaitGroup{}
 	for i := 0; i < cfg.RateLimit; i++ {
 		wg.Add(1)
-		go metrics.Send(ctx, wg, *agent, cfg.Address)
+		go metrics.Send(sendCtx, wg, sink)
+	}
+	metrics.RestoreSpool()
+
+	time.Sleep(100 * time.Millisecond)
+	go metrics.MergeAndPushToQueue(ctx, cfg.Key)
+
+	if len(cfg.StatusAddress) > 0 {
+		startStatusServer(ctx, cfg.StatusAddress, metrics)
 	}
 
 	<-ctx.Done()
-	wg.Wait()
-	shutdownContext, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	code := shutdown(cfg, wg, cancelSend, metrics, sink)
+	log.Info().Msgf("agent shutdown with code %d", code)
+	os.Exit(code)
+}
+
+// shutdown waits for the senders to deliver the final flush. When the shutdown timeout expires,
+// the requests are cancelled and the undelivered batches go to the spool file. The sink is closed last,
+// so that the batches it still holds are counted in the exit code too.
+func shutdown(cfg *configs.AgentCfg, wg *sync.WaitGroup, cancelSend context.CancelFunc,
+	metrics *services.MetricsService, sink services.Sink) int {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(cfg.ShutdownTimeout):
+		log.Warn().Msgf("the final flush did not finish in %s, saving the rest", cfg.ShutdownTimeout)
+		cancelSend()
+		<-done
+	}
+	metrics.CloseSink(sink)
+	return metrics.ExitCode()
+}
+
+// startStatusServer serves the agent telemetry on the local status endpoint until the context is done.
+func startStatusServer(ctx context.Context, address string, metrics *services.MetricsService) {
+	mux := http.NewServeMux()
+	mux.Handle("/status", metrics.StatusHandler())
+	srv := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		log.Info().Msgf("the status endpoint starts at %s", address)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("status server error")
+		}
+	}()
 
-	<-shutdownContext.Done()
-	log.Info().Msg("agent shutdown")
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("status server stop error")
+		}
+	}()
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"net"
 
 	"github.com/dbulyk/metrics-alerting-service/internal/configs"
 	"github.com/dbulyk/metrics-alerting-service/internal/fileio"
@@ -59,11 +60,24 @@ func main() {
 		metrics = services.NewFileRepository(cfg.StoreFile, cfg.StoreInterval, cfg.Key)
 	}
 
+	var trustedSubnet *net.IPNet
+	if len(cfg.TrustedSubnet) > 0 {
+		var err error
+		_, trustedSubnet, err = net.ParseCIDR(cfg.TrustedSubnet)
+		if err != nil {
+			log.Panic().Err(err).Msgf("trusted subnet %s parsing error", cfg.TrustedSubnet)
+		}
+		log.Info().Msgf("metric updates are accepted only from %s", trustedSubnet)
+	} else {
+		log.Warn().Msg("no trusted subnet is set, changes of the agent configs and deletes are refused")
+	}
+
 	router := chi.NewRouter()
 	router.Use(middleware.Logger)
 	router.Use(middleware.RequestID)
 	router.Use(middleware.RealIP)
 	router.Use(middleware.Recoverer)
+	router.Use(middlewares.TrustedSubnet(trustedSubnet))
 	router.Use(middlewares.GzipMiddleware)
 	metricHandler := handlers.NewRouter(router, &metrics)
 	metricHandler.Register(router)
@@ -112,6 +126,8 @@ func shutdown(ctx context.Context, cfg *configs.ServerCfg, srv *http.Server, mem
 		}
 	}
 
+	// the streams wait for updates until the hub is closed, which would hold back the shutdown
+	mem.Hub().Close()
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Error().Timestamp().Err(err).Msg("server stop error")
 	}
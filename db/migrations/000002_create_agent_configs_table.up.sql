@@ -0,0 +1,7 @@
+create table if not exists agent_configs
+(
+    id     text primary key,
+    agent  text  not null default '',
+    labels jsonb not null default '{}',
+    config jsonb not null
+);
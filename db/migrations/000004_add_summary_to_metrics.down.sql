@@ -0,0 +1 @@
+alter table metrics drop column if exists summary;
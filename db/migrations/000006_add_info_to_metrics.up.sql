@@ -0,0 +1 @@
+alter table metrics add column if not exists info jsonb;
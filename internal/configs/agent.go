@@ -8,20 +8,73 @@ import (
 )
 
 type AgentCfg struct {
-	Address        string        `env:"ADDRESS" envDescription:"server address"`
-	ReportInterval time.Duration `env:"REPORT_INTERVAL" envDescription:"interval for sending metrics to the server"`
-	PollInterval   time.Duration `env:"POLL_INTERVAL" envDescription:"interval for polling metrics"`
-	Key            string        `env:"KEY" envDescription:"signature key"`
-	RateLimit      int           `env:"RATE_LIMIT" envDescription:"rate limit for requests to the server"`
+	Address              string        `env:"ADDRESS" envDescription:"comma-separated server addresses"`
+	ReportInterval       time.Duration `env:"REPORT_INTERVAL" envDescription:"interval for sending metrics to the server"`
+	PollInterval         time.Duration `env:"POLL_INTERVAL" envDescription:"interval for polling metrics"`
+	ReportJitter         time.Duration `env:"REPORT_JITTER" envDescription:"maximum random delay added to every report"`
+	ReportAlign          bool          `env:"REPORT_ALIGN" envDescription:"send reports at multiples of the report interval of the wall clock"`
+	Key                  string        `env:"KEY" envDescription:"signature key"`
+	RateLimit            int           `env:"RATE_LIMIT" envDescription:"rate limit for requests to the server"`
+	BatchSize            int           `env:"BATCH_SIZE" envDescription:"maximum number of metrics in one request, 0 means no limit"`
+	BatchBytes           int           `env:"BATCH_BYTES" envDescription:"maximum size of one request body in bytes, 0 means no limit"`
+	Aggregations         string        `env:"AGGREGATIONS" envDescription:"gauge aggregation rules over the report interval"`
+	StatusAddress        string        `env:"STATUS_ADDRESS" envDescription:"address of the local status endpoint, empty disables it"`
+	ExecPlugins          string        `env:"EXEC_PLUGINS" envDescription:"JSON file with the executables run as collectors"`
+	LogTail              string        `env:"LOG_TAIL" envDescription:"JSON file with the log files and the patterns of counted lines"`
+	LogTailState         string        `env:"LOG_TAIL_STATE" envDescription:"file for saving the read offsets of the log files"`
+	CgroupRoot           string        `env:"CGROUP_ROOT" envDescription:"cgroup v2 mount point or auto, empty disables the cgroup metrics"`
+	RelabelRules         string        `env:"RELABEL_RULES" envDescription:"JSON file with the rules filtering and renaming metrics before sending"`
+	DestinationMode      string        `env:"DESTINATION_MODE" envDescription:"how several servers are used: failover or fanout"`
+	QueueSize            int           `env:"QUEUE_SIZE" envDescription:"number of batches waiting to be sent, 0 means the rate limit"`
+	QueuePolicy          string        `env:"QUEUE_POLICY" envDescription:"what to do when the queue is full: block, drop-oldest, drop-newest or merge"`
+	ShutdownTimeout      time.Duration `env:"SHUTDOWN_TIMEOUT" envDescription:"time given to the final flush on shutdown"`
+	SpoolFile            string        `env:"SPOOL_FILE" envDescription:"file for the metrics that could not be sent before shutdown"`
+	Output               string        `env:"OUTPUT" envDescription:"where metrics are sent: http, stdout or file"`
+	OutputFormat         string        `env:"OUTPUT_FORMAT" envDescription:"format of the stdout output: ndjson or pretty"`
+	OutputFile           string        `env:"OUTPUT_FILE" envDescription:"file the metrics are appended to by the file output"`
+	OutputFileMaxBytes   int           `env:"OUTPUT_FILE_MAX_BYTES" envDescription:"size of the output file that causes rotation, 0 disables rotation"`
+	AgentID              string        `env:"AGENT_ID" envDescription:"agent identity used to choose its config on the server, the hostname by default"`
+	AgentLabels          string        `env:"AGENT_LABELS" envDescription:"agent labels as key=value,key=value used to choose its config on the server"`
+	RemoteConfigInterval time.Duration `env:"REMOTE_CONFIG_INTERVAL" envDescription:"interval for fetching the agent config from the server, 0 disables the remote config"`
+	RemoteConfigCache    string        `env:"REMOTE_CONFIG_CACHE" envDescription:"file for the last config fetched from the server"`
+	Probes               string        `env:"PROBES" envDescription:"JSON file with the HTTP, TCP and DNS checks run from the agent host"`
+	ProbeWorkers         int           `env:"PROBE_WORKERS" envDescription:"maximum number of probes running at the same time"`
 }
 
 // Get parses the config from the command line and environment variables. Environment variables have a higher priority.
 func (a *AgentCfg) Get() (*AgentCfg, error) {
-	flag.StringVar(&a.Address, "a", "localhost:8080", "server address")
+	flag.StringVar(&a.Address, "a", "localhost:8080", "comma-separated server addresses")
 	flag.DurationVar(&a.ReportInterval, "r", 10*time.Second, "interval for sending metrics to the server")
 	flag.DurationVar(&a.PollInterval, "p", 2*time.Second, "interval for polling metrics")
+	flag.DurationVar(&a.ReportJitter, "j", 0, "maximum random delay added to every report")
+	flag.BoolVar(&a.ReportAlign, "A", false, "send reports at multiples of the report interval of the wall clock")
 	flag.StringVar(&a.Key, "k", "", "signature key")
 	flag.IntVar(&a.RateLimit, "l", 3, "rate limit for requests to the server")
+	flag.IntVar(&a.BatchSize, "b", 0, "maximum number of metrics in one request, 0 means no limit")
+	flag.IntVar(&a.BatchBytes, "B", 1<<20, "maximum size of one request body in bytes, 0 means no limit")
+	flag.StringVar(&a.Aggregations, "g", "",
+		`gauge aggregation rules over the report interval, e.g. "CPUutilization\d+=min,max,avg;Alloc=p50,p99,last"`)
+	flag.StringVar(&a.StatusAddress, "s", "", "address of the local status endpoint, empty disables it")
+	flag.StringVar(&a.ExecPlugins, "e", "", "JSON file with the executables run as collectors")
+	flag.StringVar(&a.LogTail, "t", "", "JSON file with the log files and the patterns of counted lines")
+	flag.StringVar(&a.LogTailState, "T", "tmp/logtail-state.json", "file for saving the read offsets of the log files")
+	flag.StringVar(&a.CgroupRoot, "c", "", "cgroup v2 mount point or auto, empty disables the cgroup metrics")
+	flag.StringVar(&a.RelabelRules, "R", "", "JSON file with the rules filtering and renaming metrics before sending")
+	flag.StringVar(&a.DestinationMode, "d", "failover", "how several servers are used: failover or fanout")
+	flag.IntVar(&a.QueueSize, "q", 0, "number of batches waiting to be sent, 0 means the rate limit")
+	flag.StringVar(&a.QueuePolicy, "Q", "block", "what to do when the queue is full: block, drop-oldest, drop-newest or merge")
+	flag.DurationVar(&a.ShutdownTimeout, "w", 5*time.Second, "time given to the final flush on shutdown")
+	flag.StringVar(&a.SpoolFile, "S", "tmp/agent-spool.ndjson", "file for the metrics that could not be sent before shutdown")
+	flag.StringVar(&a.Output, "o", "http", "where metrics are sent: http, stdout or file")
+	flag.StringVar(&a.OutputFormat, "f", "ndjson", "format of the stdout output: ndjson or pretty")
+	flag.StringVar(&a.OutputFile, "O", "tmp/metrics.ndjson", "file the metrics are appended to by the file output")
+	flag.IntVar(&a.OutputFileMaxBytes, "m", 10<<20, "size of the output file that causes rotation, 0 disables rotation")
+	flag.StringVar(&a.AgentID, "i", "", "agent identity used to choose its config on the server, the hostname by default")
+	flag.StringVar(&a.AgentLabels, "L", "", "agent labels as key=value,key=value used to choose its config on the server")
+	flag.DurationVar(&a.RemoteConfigInterval, "C", 0, "interval for fetching the agent config from the server, 0 disables the remote config")
+	flag.StringVar(&a.RemoteConfigCache, "P", "tmp/agent-remote-config.json", "file for the last config fetched from the server")
+	flag.StringVar(&a.Probes, "x", "", "JSON file with the HTTP, TCP and DNS checks run from the agent host")
+	flag.IntVar(&a.ProbeWorkers, "W", 4, "maximum number of probes running at the same time")
 	flag.Parse()
 
 	err := env.Parse(a)
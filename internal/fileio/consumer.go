@@ -13,6 +13,9 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// maxLineSize is the longest metric line read from the file.
+const maxLineSize = 16 << 20
+
 type Consumer struct {
 	file    *os.File
 	reader  *bufio.Scanner
@@ -25,9 +28,12 @@ func NewConsumer(filename string) (*Consumer, error) {
 	if err != nil {
 		return nil, err
 	}
+	reader := bufio.NewScanner(file)
+	// a line holds one metric, the sketches can be longer than the default limit of the scanner
+	reader.Buffer(make([]byte, 0, 64*1024), maxLineSize)
 	return &Consumer{
 		file:    file,
-		reader:  bufio.NewScanner(file),
+		reader:  reader,
 		decoder: json.NewDecoder(file),
 	}, nil
 }
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// GetAgentConfig returns the config chosen for the agent by its ID and labels.
+// They are taken from the agent and labels query parameters or from the X-Agent-ID and X-Agent-Labels headers.
+//
+//	@Description	Returns the config chosen for the agent by its ID and labels.
+//	@Produce		json
+//	@Param			agent	query		string	false	"agent ID"
+//	@Param			labels	query		string	false	"agent labels as key=value,key=value"
+//	@Success		200		{object}	models.AgentConfig
+//	@Failure		400		{string}	string
+//	@Failure		404		{string}	string
+//	@Router			/agent/config [get]
+func (h *handler) GetAgentConfig(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("request body closing error")
+		}
+	}(r.Body)
+
+	agentID, labels, err := agentIdentity(r)
+	if err != nil {
+		log.Error().Err(err).Msg("agent labels parsing error")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	config, err := h.repository.GetAgentConfig(ctx, agentID, labels)
+	if err != nil {
+		if errors.Is(err, services.ErrNoAgentConfig) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Error().Err(err).Msgf("config retrieval error for agent %s", agentID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(models.AgentConfigVersionHeader, config.Version())
+	if err = json.NewEncoder(w).Encode(config); err != nil {
+		log.Error().Err(err).Msg("JSON encoding error")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+// SetAgentConfig adds an agent config rule or replaces the rule with the same ID.
+//
+//	@Description	Adds an agent config rule or replaces the rule with the same ID.
+//	@Accept			json
+//	@Param			id		path		string					true	"rule ID"
+//	@Param			rule	body		models.AgentConfigRule	true	"rule"
+//	@Success		200		{string}	string
+//	@Failure		400		{string}	string
+//	@Failure		500		{string}	string
+//	@Router			/agent/config/{id} [put]
+func (h *handler) SetAgentConfig(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("request body closing error")
+		}
+	}(r.Body)
+
+	var rule models.AgentConfigRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		log.Error().Err(err).Msg("JSON decoding error")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rule.ID = chi.URLParam(r, "id")
+
+	if err := services.ValidateAgentConfigRule(rule); err != nil {
+		log.Error().Err(err).Msgf("agent config rule %s is rejected", rule.ID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := h.repository.SetAgentConfig(ctx, rule); err != nil {
+		log.Error().Err(err).Msgf("agent config rule %s saving error", rule.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.agentConfigs.clear()
+	log.Info().Msgf("agent config rule %s is saved", rule.ID)
+}
+
+// agentConfigTTL is how long an announced config version is cached. The cache of a server is cleared by
+// the changes it receives itself, the changes made through another server reach the agents after the TTL.
+var agentConfigTTL = 10 * time.Second
+
+type cachedVersion struct {
+	version string
+	expires time.Time
+}
+
+// agentConfigCache keeps the config versions announced to the agents by their ID and labels,
+// so that the metric updates do not query the repository every time.
+type agentConfigCache struct {
+	sync.Mutex
+	versions map[string]cachedVersion
+}
+
+func newAgentConfigCache() *agentConfigCache {
+	return &agentConfigCache{versions: make(map[string]cachedVersion)}
+}
+
+func (c *agentConfigCache) get(key string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	cached, ok := c.versions[key]
+	if !ok || time.Now().After(cached.expires) {
+		return "", false
+	}
+	return cached.version, true
+}
+
+func (c *agentConfigCache) set(key string, version string) {
+	c.Lock()
+	defer c.Unlock()
+	c.versions[key] = cachedVersion{version: version, expires: time.Now().Add(agentConfigTTL)}
+}
+
+func (c *agentConfigCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.versions = make(map[string]cachedVersion)
+}
+
+// announceAgentConfig tells the agent the version of its config, so it can fetch the config when it changes.
+// An agent without a config gets no version.
+func (h *handler) announceAgentConfig(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if len(r.Header.Get(models.AgentIDHeader)) == 0 {
+		return
+	}
+
+	key := r.Header.Get(models.AgentIDHeader) + "\n" + r.Header.Get(models.AgentLabelsHeader)
+	version, ok := h.agentConfigs.get(key)
+	if !ok {
+		agentID, labels, err := agentIdentity(r)
+		if err != nil {
+			return
+		}
+		config, err := h.repository.GetAgentConfig(ctx, agentID, labels)
+		switch {
+		case err == nil:
+			version = config.Version()
+		case !errors.Is(err, services.ErrNoAgentConfig):
+			return
+		}
+		h.agentConfigs.set(key, version)
+	}
+
+	if len(version) > 0 {
+		w.Header().Set(models.AgentConfigVersionHeader, version)
+	}
+}
+
+func agentIdentity(r *http.Request) (string, map[string]string, error) {
+	agentID := r.URL.Query().Get("agent")
+	if len(agentID) == 0 {
+		agentID = r.Header.Get(models.AgentIDHeader)
+	}
+	labels := r.URL.Query().Get("labels")
+	if len(labels) == 0 {
+		labels = r.Header.Get(models.AgentLabelsHeader)
+	}
+
+	parsed, err := services.ParseLabels(labels)
+	return agentID, parsed, err
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+	"github.com/dbulyk/metrics-alerting-service/internal/storages"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_AgentConfig(t *testing.T) {
+	mem := services.NewFileRepository(filepath.Join(t.TempDir(), "metrics.json"), time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "GET", "/agent/config?agent=web-01", nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "PUT", "/agent/config/web",
+		[]byte(`{"labels":{"role":"web"},"config":{"poll_interval":"1s","collectors":["runtime"]}}`))
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "PUT", "/agent/config/broken", []byte(`{"config":{"poll_interval":"fast"}}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, body := testRequest(t, ts, "GET", "/agent/config?agent=web-01&labels=role%3Dweb", nil)
+	require.Equal(t, http.StatusOK, statusCode)
+	var config models.AgentConfig
+	require.NoError(t, json.Unmarshal([]byte(body), &config))
+	assert.Equal(t, models.AgentConfig{PollInterval: "1s", Collectors: []string{"runtime"}}, config)
+
+	statusCode, _ = testRequest(t, ts, "GET", "/agent/config?agent=db-01&labels=role%3Ddb", nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	// the agent learns the version of its config from the response to its metrics
+	req, err := http.NewRequest("POST", ts.URL+"/updates/", bytes.NewBufferString(`[]`))
+	require.NoError(t, err)
+	req.Header.Set(models.AgentIDHeader, "web-01")
+	req.Header.Set(models.AgentLabelsHeader, "role=web")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, config.Version(), resp.Header.Get(models.AgentConfigVersionHeader))
+}
+
+// countingRepository counts the agent config queries.
+type countingRepository struct {
+	storages.IRepository
+	queries atomic.Int64
+}
+
+func (r *countingRepository) GetAgentConfig(ctx context.Context, agentID string, labels map[string]string) (*models.AgentConfig, error) {
+	r.queries.Add(1)
+	return r.IRepository.GetAgentConfig(ctx, agentID, labels)
+}
+
+func TestHandler_AnnounceAgentConfigCached(t *testing.T) {
+	counting := &countingRepository{
+		IRepository: services.NewFileRepository(filepath.Join(t.TempDir(), "metrics.json"), time.Second, ""),
+	}
+	var repository storages.IRepository = counting
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &repository)
+	h.Register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	announced := func() string {
+		req, err := http.NewRequest("POST", ts.URL+"/updates/", bytes.NewBufferString(`[]`))
+		require.NoError(t, err)
+		req.Header.Set(models.AgentIDHeader, "web-01")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.Header.Get(models.AgentConfigVersionHeader)
+	}
+
+	assert.Empty(t, announced())
+	assert.Empty(t, announced())
+	assert.Equal(t, int64(1), counting.queries.Load(), "the missing config was expected to be cached")
+
+	statusCode, _ := testRequest(t, ts, "PUT", "/agent/config/all", []byte(`{"config":{"poll_interval":"1s"}}`))
+	require.Equal(t, http.StatusOK, statusCode)
+	version := announced()
+	assert.NotEmpty(t, version, "the change was expected to clear the cache")
+	assert.Equal(t, version, announced())
+	assert.Equal(t, int64(2), counting.queries.Load(), "the config version was expected to be cached")
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"html/template"
+	"io/fs"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+	"github.com/dbulyk/metrics-alerting-service/internal/templates"
+)
+
+// Units of the metric values, chosen by the metric names.
+const (
+	unitBytes   = "bytes"
+	unitNanos   = "ns"
+	unitSeconds = "s"
+	unitPercent = "percent"
+	unitRatio   = "ratio"
+)
+
+const (
+	sparklineWidth  = 120
+	sparklineHeight = 24
+)
+
+var indexTemplate = template.Must(template.ParseFS(templates.FS, "index.gohtml"))
+
+// staticHandler serves the embedded scripts and styles of the dashboard.
+func staticHandler() http.Handler {
+	static, err := fs.Sub(templates.FS, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+}
+
+// dashboardPage is the data of the dashboard template.
+type dashboardPage struct {
+	Rows  []dashboardRow
+	Types []string
+}
+
+// dashboardRow is a metric with its value formatted for people and the sparkline of its recent values.
+type dashboardRow struct {
+	ID    string
+	MType string
+	// Value is formatted with the units, Exact is the value as it is stored.
+	Value string
+	Exact string
+	// SortValue is empty for the metrics without a value.
+	SortValue string
+	UpdatedAt *time.Time
+	Sparkline template.HTML
+}
+
+// newDashboardPage makes the rows of the metrics sorted by name and type.
+func newDashboardPage(metrics []*models.Metric, history *services.History) dashboardPage {
+	page := dashboardPage{
+		Rows:  make([]dashboardRow, 0, len(metrics)),
+		Types: []string{services.Gauge, services.Counter, services.Histogram, services.Summary, services.Set, services.Info},
+	}
+	for _, m := range metrics {
+		m = services.WithEstimates(m)
+		row := dashboardRow{ID: m.ID, MType: m.MType, UpdatedAt: m.UpdatedAt}
+		row.Value, row.Exact = formatMetric(m)
+		if v, ok := services.MetricValue(m); ok {
+			row.SortValue = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		row.Sparkline = sparkline(history.Get(m.ID, m.MType))
+		page.Rows = append(page.Rows, row)
+	}
+	sort.Slice(page.Rows, func(i, j int) bool {
+		if page.Rows[i].ID != page.Rows[j].ID {
+			return page.Rows[i].ID < page.Rows[j].ID
+		}
+		return page.Rows[i].MType < page.Rows[j].MType
+	})
+	return page
+}
+
+// formatMetric returns the value of the metric formatted with its units and as it is stored.
+func formatMetric(m *models.Metric) (string, string) {
+	unit := metricUnit(m.ID)
+	switch {
+	case m.MType == services.Gauge && m.Value != nil:
+		return formatValue(*m.Value, unit), strconv.FormatFloat(*m.Value, 'f', -1, 64)
+	case m.MType == services.Counter && m.Delta != nil:
+		return formatValue(float64(*m.Delta), unit), strconv.FormatInt(*m.Delta, 10)
+	case m.MType == services.Histogram && m.Histogram != nil:
+		s := distribution(m.Histogram.Count, m.Histogram.Sum, m.Histogram.Quantiles, unit)
+		return s, s
+	case m.MType == services.Summary && m.Summary != nil:
+		s := distribution(m.Summary.Count, m.Summary.Sum, m.Summary.Quantiles, unit)
+		return s, s
+	case m.MType == services.Set && m.Set != nil && m.Set.Cardinality != nil:
+		return "≈ " + formatValue(float64(*m.Set.Cardinality), ""), strconv.FormatUint(*m.Set.Cardinality, 10)
+	case m.MType == services.Info && m.Info != nil:
+		s := services.InfoString(m.Info)
+		return s, s
+	}
+	return "", ""
+}
+
+// distribution formats the count, the sum and the quantile estimates of a histogram or a summary.
+func distribution(count uint64, sum float64, quantiles map[string]float64, unit string) string {
+	parts := []string{"count " + formatValue(float64(count), ""), "sum " + formatValue(sum, unit)}
+	for _, q := range services.ReadQuantiles {
+		name := services.QuantileName(q)
+		if v, ok := quantiles[name]; ok {
+			parts = append(parts, name+" "+formatValue(v, unit))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// metricUnit guesses the unit by the metric name: the runtime memory statistics and the names ending
+// with bytes are in bytes, the names ending with Ns or _seconds are durations, the CPU utilization
+// and the names ending with _percent are percents, the names ending with Fraction or _ratio are ratios.
+func metricUnit(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, "bytes") || name == "NextGC" || strings.HasSuffix(name, "Memory"):
+		return unitBytes
+	case strings.HasSuffix(name, "Alloc") || strings.HasSuffix(name, "Sys") || strings.HasSuffix(name, "Inuse") ||
+		strings.HasSuffix(name, "Idle") || strings.HasSuffix(name, "Released"):
+		return unitBytes
+	case strings.HasSuffix(name, "Ns") || strings.HasSuffix(lower, "_ns"):
+		return unitNanos
+	case strings.HasSuffix(lower, "_seconds"):
+		return unitSeconds
+	case strings.HasPrefix(name, "CPUutilization") || strings.HasSuffix(lower, "_percent"):
+		return unitPercent
+	case strings.HasSuffix(name, "Fraction") || strings.HasSuffix(lower, "_ratio"):
+		return unitRatio
+	}
+	return ""
+}
+
+// formatValue formats the value in the unit with three significant digits.
+func formatValue(v float64, unit string) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return formatSampleValue(v)
+	}
+	switch unit {
+	case unitBytes:
+		return scaled(v, 1024, []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}, " ")
+	case unitNanos:
+		return formatSeconds(v / 1e9)
+	case unitSeconds:
+		return formatSeconds(v)
+	case unitPercent:
+		return significant(v) + "%"
+	case unitRatio:
+		return significant(v*100) + "%"
+	}
+	return scaled(v, 1000, []string{"", "k", "M", "G", "T", "P"}, "")
+}
+
+func formatSeconds(v float64) string {
+	if v != 0 && math.Abs(v) < 1 {
+		for _, prefix := range []string{"ms", "µs", "ns"} {
+			v *= 1000
+			if math.Abs(v) >= 1 || prefix == "ns" {
+				return significant(v) + " " + prefix
+			}
+		}
+	}
+	return significant(v) + " s"
+}
+
+// scaled divides the value by the base until it is below the base or the prefixes end.
+func scaled(v float64, base float64, prefixes []string, sep string) string {
+	i := 0
+	for math.Abs(v) >= base && i < len(prefixes)-1 {
+		v /= base
+		i++
+	}
+	if len(prefixes[i]) == 0 {
+		return significant(v)
+	}
+	return significant(v) + sep + prefixes[i]
+}
+
+// significant formats the value with three significant digits, whole numbers below 1000 are kept as they are.
+func significant(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1000 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	s := strconv.FormatFloat(v, 'g', 3, 64)
+	if strings.Contains(s, "e") {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return s
+}
+
+// sparkline draws the values as an SVG polyline scaled to the box, it is empty for less than two values.
+func sparkline(points []services.HistoryPoint) template.HTML {
+	if len(points) < 2 {
+		return ""
+	}
+	lo, hi := points[0].V, points[0].V
+	for _, p := range points {
+		lo, hi = math.Min(lo, p.V), math.Max(hi, p.V)
+	}
+
+	var b strings.Builder
+	b.WriteString(`<svg class="sparkline" width="` + strconv.Itoa(sparklineWidth) + `" height="` +
+		strconv.Itoa(sparklineHeight) + `" viewBox="0 0 ` + strconv.Itoa(sparklineWidth) + " " +
+		strconv.Itoa(sparklineHeight) + `" aria-hidden="true"><polyline points="`)
+	for i, p := range points {
+		x := float64(i) * sparklineWidth / float64(len(points)-1)
+		// a flat line is drawn in the middle, the 1px margin keeps the stroke inside the box
+		y := float64(sparklineHeight) / 2
+		if hi > lo {
+			y = 1 + (hi-p.V)/(hi-lo)*(sparklineHeight-2)
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64))
+	}
+	b.WriteString(`"/></svg>`)
+	return template.HTML(b.String()) //nolint:gosec // only numbers are written into the markup
+}
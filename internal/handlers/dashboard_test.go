@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Dashboard(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, body := testRequest(t, ts, "GET", "/", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, "No metrics yet")
+
+	for _, v := range []string{"1048576", "2097152", "1572864"} {
+		statusCode, _ = testRequest(t, ts, "POST", "/update/gauge/HeapAlloc/"+v, nil)
+		require.Equal(t, http.StatusOK, statusCode)
+	}
+	statusCode, _ = testRequest(t, ts, "POST", "/update/", []byte(`{"id":"version","type":"info","info":{"text":"<b>1.0</b>"}}`))
+	require.Equal(t, http.StatusOK, statusCode)
+
+	// the history is recorded asynchronously
+	require.Eventually(t, func() bool {
+		_, body = testRequest(t, ts, "GET", "/", nil)
+		return strings.Contains(body, "<polyline")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, body, `data-name="HeapAlloc" data-type="gauge" data-value="1572864"`)
+	assert.Contains(t, body, `title="1572864">1.5 MiB</td>`)
+	assert.Contains(t, body, `<polyline points="0.0,23.0 60.0,1.0 120.0,12.0"/>`)
+	assert.Contains(t, body, "&lt;b&gt;1.0&lt;/b&gt;", "the info text was expected to be escaped")
+	assert.NotContains(t, body, "Название")
+
+	statusCode, body = testRequest(t, ts, "GET", "/static/dashboard.js", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, "DOMParser")
+	statusCode, _ = testRequest(t, ts, "GET", "/static/missing.js", nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		name string
+		v    float64
+		want string
+	}{
+		{"RandomValue", 0.123456, "0.123"},
+		{"PollCount", 42, "42"},
+		{"Lookups", 12345, "12.3k"},
+		{"Mallocs", 2.5e9, "2.5G"},
+		{"HeapAlloc", 512, "512 B"},
+		{"TotalAlloc", 1536, "1.5 KiB"},
+		{"TotalMemory", 16 * 1024 * 1024 * 1024, "16 GiB"},
+		{"PauseTotalNs", 1234567, "1.23 ms"},
+		{"request_duration_seconds", 0.00025, "250 µs"},
+		{"request_duration_seconds", 90, "90 s"},
+		{"CPUutilization1", 12.3456, "12.3%"},
+		{"GCCPUFraction", 0.0123, "1.23%"},
+		{"RandomValue", -0.0000123, "-0.0000123"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, formatValue(tt.v, metricUnit(tt.name)), tt.name)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	now := time.Now()
+	assert.Empty(t, sparkline(nil))
+	assert.Empty(t, sparkline([]services.HistoryPoint{{T: now, V: 1}}))
+	assert.Contains(t, string(sparkline([]services.HistoryPoint{{T: now, V: 1}, {T: now, V: 1}})),
+		`points="0.0,12.0 120.0,12.0"`, "a flat line was expected in the middle")
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// deleteResult is the response of a bulk delete.
+type deleteResult struct {
+	Deleted int `json:"deleted"`
+}
+
+// Delete deletes a metric by type and name.
+//
+//	@Description	Deletes a metric by type and name.
+//	@Param			type	path		string	true	"metric type"
+//	@Param			name	path		string	true	"metric name"
+//	@Success		200		{string}	string
+//	@Failure		403		{string}	string
+//	@Failure		404		{string}	string
+//	@Failure		500		{string}	string
+//	@Router			/value/{type}/{name} [delete]
+func (h *handler) Delete(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("request body closing error")
+		}
+	}(r.Body)
+
+	mType := chi.URLParam(r, "type")
+	mName := chi.URLParam(r, "name")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err := h.repository.Delete(ctx, mName, mType)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidMetric) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Error().Err(err).Msgf("metric %s of type %s deletion error", mName, mType)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.history.Remove(mName, mType)
+	log.Info().Msgf("metric %s of type %s deleted by %s", mName, mType, r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteMatching deletes the metrics selected by the name prefix, a regular expression and the type.
+// At least one of them is required.
+//
+//	@Description	Deletes the metrics selected by the name prefix, a regular expression and the type.
+//	@Produce		json
+//	@Param			prefix	query		string	false	"name prefix"
+//	@Param			regex	query		string	false	"regular expression matching a part of the name"
+//	@Param			type	query		string	false	"metric type"
+//	@Success		200		{object}	deleteResult
+//	@Failure		400		{string}	string
+//	@Failure		403		{string}	string
+//	@Failure		500		{string}	string
+//	@Router			/api/v1/metrics [delete]
+func (h *handler) DeleteMatching(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("request body closing error")
+		}
+	}(r.Body)
+
+	q := r.URL.Query()
+	filter := models.MetricFilter{Prefix: q.Get("prefix"), Regexp: q.Get("regex"), Type: q.Get("type")}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	deleted, err := h.repository.DeleteMatching(ctx, filter)
+	if err != nil {
+		log.Error().Err(err).Msgf("metrics deletion error, prefix %q, regex %q, type %q",
+			filter.Prefix, filter.Regexp, filter.Type)
+		if errors.Is(err, services.ErrInvalidFilter) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if match, err := services.NewMetricMatcher(filter); err == nil {
+		h.history.RemoveMatching(match)
+	}
+	log.Info().Msgf("%d metrics deleted by %s, prefix %q, regex %q, type %q",
+		deleted, r.RemoteAddr, filter.Prefix, filter.Regexp, filter.Type)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(deleteResult{Deleted: deleted}); err != nil {
+		log.Error().Err(err).Msg("JSON encoding error")
+	}
+}
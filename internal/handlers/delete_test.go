@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Delete(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	history := h.(*handler).history
+	require.Eventually(t, mem.Hub().Active, time.Second, time.Millisecond)
+
+	statusCode, _ := testRequest(t, ts, "POST", "/updates/", []byte(`[
+		{"id":"HeapAllc","type":"gauge","value":1},
+		{"id":"HeapAlloc","type":"gauge","value":1},
+		{"id":"test_1","type":"gauge","value":1},
+		{"id":"test_2","type":"counter","delta":1},
+		{"id":"test_3","type":"counter","delta":1}]`))
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Eventually(t, func() bool { return len(history.Get("test_3", services.Counter)) == 1 },
+		time.Second, time.Millisecond)
+
+	statusCode, _ = testRequest(t, ts, "DELETE", "/value/gauge/HeapAllc", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _ = testRequest(t, ts, "GET", "/value/gauge/HeapAllc", nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+	statusCode, _ = testRequest(t, ts, "DELETE", "/value/gauge/HeapAllc", nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	statusCode, body := testRequest(t, ts, "DELETE", "/api/v1/metrics?prefix=test_&type=counter", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"deleted":2}`, body)
+
+	statusCode, _ = testRequest(t, ts, "DELETE", "/api/v1/metrics", nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode, "a bulk delete without a filter was expected to be rejected")
+	statusCode, _ = testRequest(t, ts, "DELETE", "/api/v1/metrics?regex=(", nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	metrics, err := mem.GetAll(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	// the deleted metrics are gone from the dashboard history as well
+	assert.Empty(t, history.Get("HeapAllc", services.Gauge))
+	assert.Empty(t, history.Get("test_2", services.Counter))
+	assert.Len(t, history.Get("HeapAlloc", services.Gauge), 1)
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+	"github.com/dbulyk/metrics-alerting-service/internal/utils"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Histogram(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	body := []byte(`{"id":"latency","type":"histogram",
+		"histogram":{"bounds":[0.1,0.5,1],"counts":[2,6,2,0],"sum":4.2,"count":10}}`)
+	for i := 0; i < 2; i++ {
+		statusCode, _ := testRequest(t, ts, "POST", "/update/", body)
+		require.Equal(t, http.StatusOK, statusCode)
+	}
+
+	statusCode, _ := testRequest(t, ts, "POST", "/update/",
+		[]byte(`{"id":"latency","type":"histogram","histogram":{"bounds":[0.1],"counts":[1],"sum":1,"count":1}}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode, "counts not matching the bounds were expected to be rejected")
+
+	statusCode, resp := testRequest(t, ts, "POST", "/value/", []byte(`{"id":"latency","type":"histogram"}`))
+	require.Equal(t, http.StatusOK, statusCode)
+	var m models.Metric
+	require.NoError(t, json.Unmarshal([]byte(resp), &m))
+	assert.Equal(t, []uint64{4, 12, 4, 0}, m.Histogram.Counts)
+	assert.Equal(t, uint64(20), m.Histogram.Count)
+	assert.InDelta(t, 0.3, m.Histogram.Quantiles["p50"], 1e-9)
+	assert.InDelta(t, 0.75, m.Histogram.Quantiles["p90"], 1e-9)
+
+	statusCode, resp = testRequest(t, ts, "GET", "/value/histogram/latency?quantile=0.5", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	q, err := strconv.ParseFloat(resp, 64)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.3, q, 1e-9)
+
+	statusCode, _ = testRequest(t, ts, "GET", "/value/histogram/latency?quantile=2", nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	// single observations are counted in the default buckets
+	for _, v := range []string{"0.004", "0.3", "0.3", "20"} {
+		statusCode, _ = testRequest(t, ts, "POST", "/update/histogram/requests/"+v, nil)
+		require.Equal(t, http.StatusOK, statusCode)
+	}
+	statusCode, resp = testRequest(t, ts, "GET", "/value/histogram/requests", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "count=4 sum=20.604 p50=0.375 p90=10 p99=10", resp)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update/histogram/requests/fast", nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	for _, v := range []string{"NaN", "Inf", "-Inf"} {
+		statusCode, _ = testRequest(t, ts, "POST", "/update/histogram/requests/"+v, nil)
+		assert.Equal(t, http.StatusBadRequest, statusCode, "value %s was expected to be rejected", v)
+	}
+}
+
+func TestHandler_HistogramSigned(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "test")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// the hash of the histogram with the bounds 0.1, 0.5 and 1 does not match the same counts in other buckets
+	hash := utils.Hash("latency:histogram:0.1,0.5,1:2,6,2,0:10:4.200000", "test")
+	statusCode, _ := testRequest(t, ts, "POST", "/update/", []byte(`{"id":"latency","type":"histogram","hash":"`+hash+`",
+		"histogram":{"bounds":[10,50,100],"counts":[2,6,2,0],"sum":4.2,"count":10}}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode, "changed bounds were expected to break the signature")
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update/", []byte(`{"id":"latency","type":"histogram","hash":"`+hash+`",
+		"histogram":{"bounds":[0.1,0.5,1],"counts":[2,6,2,0],"sum":4.2,"count":10}}`))
+	assert.Equal(t, http.StatusOK, statusCode)
+}
+
+func TestHandler_HistogramConcurrentReads(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/update/histogram/latency/0.3", nil)
+	require.Equal(t, http.StatusOK, statusCode)
+
+	// the estimates are computed on a copy, so the readers neither race with each other nor with the writers;
+	// FailNow must not be called outside the test goroutine, so the requests are checked with assert
+	post := func(path string, body []byte) {
+		resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			post("/value/", []byte(`{"id":"latency","type":"histogram"}`))
+		}()
+		go func() {
+			defer wg.Done()
+			post("/update/histogram/latency/0.7", nil)
+		}()
+	}
+	wg.Wait()
+
+	stored, err := mem.Get(context.Background(), "latency", services.Histogram)
+	require.NoError(t, err)
+	assert.Nil(t, stored.Histogram.Quantiles, "the estimates were not expected to be stored")
+	assert.Equal(t, uint64(11), stored.Histogram.Count)
+}
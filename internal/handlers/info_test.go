@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Info(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/update/info/KernelVersion/6.1.0", nil)
+	require.Equal(t, http.StatusOK, statusCode)
+	statusCode, resp := testRequest(t, ts, "GET", "/value/info/KernelVersion", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "6.1.0", resp)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/updates/",
+		[]byte(`[{"id":"AgentBuild","type":"info","info":{"text":"1.4.2","labels":{"revision":"4f2a9c1"}}}]`))
+	require.Equal(t, http.StatusOK, statusCode)
+	statusCode, _ = testRequest(t, ts, "POST", "/update/", []byte(`{"id":"AgentBuild","type":"info","info":{}}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode, "an empty info was expected to be rejected")
+
+	statusCode, resp = testRequest(t, ts, "POST", "/value/", []byte(`{"id":"AgentBuild","type":"info"}`))
+	require.Equal(t, http.StatusOK, statusCode)
+	var m models.Metric
+	require.NoError(t, json.Unmarshal([]byte(resp), &m))
+	assert.Equal(t, &models.Info{Text: "1.4.2", Labels: map[string]string{"revision": "4f2a9c1"}}, m.Info)
+
+	statusCode, resp = testRequest(t, ts, "GET", "/value/info/AgentBuild", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, `1.4.2 revision="4f2a9c1"`, resp)
+
+	statusCode, resp = testRequest(t, ts, "GET", "/", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, resp, `>1.4.2 revision=&#34;4f2a9c1&#34;</td>`)
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// metricList is a page of the metric listing, NextCursor is empty on the last page.
+type metricList struct {
+	Metrics    []*models.Metric `json:"metrics"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// listCursor is the position after the last metric of a page, it keeps the sort order it was made for.
+type listCursor struct {
+	Sort string `json:"sort"`
+	Desc bool   `json:"desc,omitempty"`
+	models.MetricCursor
+}
+
+// ListMetrics returns a page of metrics filtered by the name prefix or a regular expression and by the type,
+// sorted by the name, the value or the update time. The next page is requested with the returned cursor.
+//
+//	@Description	Returns a page of metrics with filtering, sorting and cursor pagination.
+//	@Produce		json
+//	@Param			prefix	query		string	false	"name prefix"
+//	@Param			regex	query		string	false	"regular expression matching a part of the name"
+//	@Param			type	query		string	false	"metric type"
+//	@Param			sort	query		string	false	"name (default), value or updated"
+//	@Param			order	query		string	false	"asc (default) or desc"
+//	@Param			limit	query		int		false	"page size, 100 by default, at most 1000"
+//	@Param			cursor	query		string	false	"next_cursor of the previous page"
+//	@Success		200		{object}	metricList
+//	@Failure		400		{string}	string
+//	@Failure		500		{string}	string
+//	@Router			/api/v1/metrics [get]
+func (h *handler) ListMetrics(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("request body closing error")
+		}
+	}(r.Body)
+
+	filter, err := parseMetricFilter(r)
+	if err != nil {
+		log.Error().Err(err).Msg("metric filter parsing error")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit := filter.Limit
+	// one more metric tells whether there is a next page
+	filter.Limit++
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	metrics, err := h.repository.List(ctx, filter)
+	if err != nil {
+		log.Error().Err(err).Msg("metrics listing error")
+		if errors.Is(err, services.ErrInvalidFilter) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	list := metricList{Metrics: make([]*models.Metric, 0, len(metrics))}
+	if len(metrics) > limit {
+		metrics = metrics[:limit]
+		data, _ := json.Marshal(listCursor{Sort: filter.Sort, Desc: filter.Desc,
+			MetricCursor: *services.Cursor(metrics[limit-1])})
+		list.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	for _, m := range metrics {
+		list.Metrics = append(list.Metrics, services.WithEstimates(m))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(list); err != nil {
+		log.Error().Err(err).Msg("JSON encoding error")
+	}
+}
+
+func parseMetricFilter(r *http.Request) (models.MetricFilter, error) {
+	q := r.URL.Query()
+	filter := models.MetricFilter{
+		Prefix: q.Get("prefix"),
+		Regexp: q.Get("regex"),
+		Type:   q.Get("type"),
+		Sort:   q.Get("sort"),
+		Limit:  defaultListLimit,
+	}
+	if len(filter.Sort) == 0 {
+		filter.Sort = models.SortByName
+	}
+
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, errors.New("order must be asc or desc")
+	}
+
+	if l := q.Get("limit"); len(l) > 0 {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return filter, errors.New("limit must be from 1 to " + strconv.Itoa(maxListLimit))
+		}
+		filter.Limit = limit
+	}
+
+	if c := q.Get("cursor"); len(c) > 0 {
+		data, err := base64.RawURLEncoding.DecodeString(c)
+		var cursor listCursor
+		if err == nil {
+			err = json.Unmarshal(data, &cursor)
+		}
+		if err != nil {
+			return filter, errors.New("invalid cursor")
+		}
+		if cursor.Sort != filter.Sort || cursor.Desc != filter.Desc {
+			return filter, errors.New("the cursor was made for another sort order")
+		}
+		filter.After = &cursor.MetricCursor
+	}
+	return filter, nil
+}
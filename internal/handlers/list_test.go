@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_ListMetrics(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/updates/", []byte(`[
+		{"id":"Alloc","type":"gauge","value":300},
+		{"id":"CPUutilization1","type":"gauge","value":20},
+		{"id":"CPUutilization2","type":"gauge","value":40},
+		{"id":"PollCount","type":"counter","delta":20},
+		{"id":"users","type":"set","set":{"items":["alice"]}}]`))
+	require.Equal(t, http.StatusOK, statusCode)
+
+	type page struct {
+		Metrics []struct {
+			ID        string     `json:"id"`
+			UpdatedAt *time.Time `json:"updated_at"`
+			Set       *struct {
+				Cardinality *uint64 `json:"cardinality"`
+			} `json:"set"`
+		} `json:"metrics"`
+		NextCursor string `json:"next_cursor"`
+	}
+	list := func(query url.Values) page {
+		statusCode, body := testRequest(t, ts, "GET", "/api/v1/metrics?"+query.Encode(), nil)
+		require.Equal(t, http.StatusOK, statusCode, body)
+		var p page
+		require.NoError(t, json.Unmarshal([]byte(body), &p))
+		return p
+	}
+
+	var got []string
+	query := url.Values{"sort": {"value"}, "order": {"desc"}, "limit": {"2"}}
+	for i := 0; i < 5; i++ {
+		p := list(query)
+		for _, m := range p.Metrics {
+			got = append(got, m.ID)
+			assert.NotNil(t, m.UpdatedAt)
+		}
+		if len(p.NextCursor) == 0 {
+			break
+		}
+		query.Set("cursor", p.NextCursor)
+	}
+	assert.Equal(t, []string{"Alloc", "CPUutilization2", "PollCount", "CPUutilization1", "users"}, got)
+
+	p := list(url.Values{"type": {"set"}})
+	require.Len(t, p.Metrics, 1)
+	assert.Equal(t, uint64(1), *p.Metrics[0].Set.Cardinality, "the estimates were expected in the listing")
+	assert.Empty(t, p.NextCursor)
+
+	p = list(url.Values{"prefix": {"CPU"}, "regex": {"2$"}})
+	require.Len(t, p.Metrics, 1)
+	assert.Equal(t, "CPUutilization2", p.Metrics[0].ID)
+
+	for _, q := range []url.Values{
+		{"sort": {"size"}},
+		{"order": {"up"}},
+		{"limit": {"0"}},
+		{"regex": {"("}},
+		{"cursor": {"???"}},
+		{"sort": {"name"}, "cursor": {query.Get("cursor")}},
+	} {
+		statusCode, _ = testRequest(t, ts, "GET", "/api/v1/metrics?"+q.Encode(), nil)
+		assert.Equal(t, http.StatusBadRequest, statusCode, q.Encode())
+	}
+}
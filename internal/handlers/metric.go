@@ -1,14 +1,14 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"html/template"
 	"io"
+	"math"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"time"
 
@@ -28,29 +28,46 @@ import (
 //	@BasePath		/
 
 type handler struct {
-	repository storages.IRepository
-	r          chi.Router
+	repository   storages.IRepository
+	r            chi.Router
+	history      *services.History
+	agentConfigs *agentConfigCache
 }
 
 // NewRouter creates a new handler and returns a pointer to it.
+// The handler records the recent values of the metrics for the dashboard until the hub of the repository is closed.
 func NewRouter(router *chi.Mux, rep *storages.IRepository) (r Handler) {
-	return &handler{
-		repository: *rep,
-		r:          router,
+	h := &handler{
+		repository:   *rep,
+		r:            router,
+		history:      services.NewHistory(services.HistorySize),
+		agentConfigs: newAgentConfigCache(),
 	}
+	go h.history.Follow(h.repository.Hub())
+	return h
 }
 
 // Register registers all metric handlers.
 func (h *handler) Register(router *chi.Mux) {
 	router.Route("/", func(r chi.Router) {
 		r.Get("/", h.GetAll)
+		r.Handle("/static/*", staticHandler())
 		r.Get("/value/{type}/{name}", h.GetWithText)
+		r.Delete("/value/{type}/{name}", h.Delete)
 		r.Post("/value/", h.GetWithJSON)
 		r.Post("/update/{type}/{name}/{value}", h.UpdateWithText)
 		r.Post("/update/{type}/{name}/{value}/{hash}", h.UpdateWithText)
 		r.Post("/update/", h.UpdateWithJSON)
 		r.Post("/updates/", h.Updates)
 		r.Get("/ping", h.Ping)
+		r.Get("/agent/config", h.GetAgentConfig)
+		r.Put("/agent/config/{id}", h.SetAgentConfig)
+		r.Get("/api/v1/metrics", h.ListMetrics)
+		r.Delete("/api/v1/metrics", h.DeleteMatching)
+		r.Get("/api/v1/stream", h.Stream)
+		r.Get("/api/v1/ws", h.WebSocket)
+		r.Get("/api/v1/query", h.Query)
+		r.Post("/api/v1/query", h.Query)
 		r.Get("/swagger/*", httpSwagger.Handler(
 			httpSwagger.URL("/swagger/doc.json"),
 		))
@@ -81,12 +98,14 @@ func (h *handler) UpdateWithJSON(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	// the update time is set by the server
+	m.UpdatedAt = nil
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 	metric, err := h.repository.Set(ctx, m)
 	if err != nil {
-		if errors.Is(err, services.ErrInvalidHash) {
+		if isBadMetric(err) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -95,16 +114,18 @@ func (h *handler) UpdateWithJSON(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(metric); err != nil {
+	if err = json.NewEncoder(w).Encode(services.WithEstimates(metric)); err != nil {
 		log.Error().Err(err).Msg("JSON encoding error")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 }
 
-// UpdateWithText updates metrics with text.
+// UpdateWithText updates metrics with text. The value of a histogram or a summary is one observation
+// counted in the default buckets or with the default accuracy, the value of a set is one item,
+// the value of an info replaces its text.
 //
-//	@Description	Updates metrics with text.
+//	@Description	Updates metrics with text. The value of a histogram or a summary is one observation, of a set is one item, of an info is its text.
 //	@Param			type	path		string	true	"metric type"
 //	@Param			name	path		string	true	"metric name"
 //	@Param			value	path		string	true	"metric value"
@@ -124,6 +145,10 @@ func (h *handler) UpdateWithText(w http.ResponseWriter, r *http.Request) {
 	var (
 		mValueFloat *float64
 		mValueInt   *int64
+		mHistogram  *models.Histogram
+		mSummary    *models.Summary
+		mSet        *models.Set
+		mInfo       *models.Info
 	)
 
 	mType := chi.URLParam(r, "type")
@@ -154,14 +179,38 @@ func (h *handler) UpdateWithText(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		mValueInt = &value
+	case services.Histogram:
+		value, err := strconv.ParseFloat(chi.URLParam(r, "value"), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			log.Error().Msgf("metric value parsing error: %s", chi.URLParam(r, "value"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mHistogram = services.NewHistogram(services.DefaultHistogramBounds, value)
+	case services.Summary:
+		value, err := strconv.ParseFloat(chi.URLParam(r, "value"), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			log.Error().Msgf("metric value parsing error: %s", chi.URLParam(r, "value"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mSummary = services.NewSummary(services.DefaultSummaryAccuracy, value)
+	case services.Set:
+		mSet = &models.Set{Items: []string{chi.URLParam(r, "value")}}
+	case services.Info:
+		mInfo = &models.Info{Text: chi.URLParam(r, "value")}
 	}
 
 	metric := models.Metric{
-		ID:    mName,
-		MType: mType,
-		Value: mValueFloat,
-		Delta: mValueInt,
-		Hash:  mHash,
+		ID:        mName,
+		MType:     mType,
+		Value:     mValueFloat,
+		Delta:     mValueInt,
+		Histogram: mHistogram,
+		Summary:   mSummary,
+		Set:       mSet,
+		Info:      mInfo,
+		Hash:      mHash,
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
@@ -169,14 +218,18 @@ func (h *handler) UpdateWithText(w http.ResponseWriter, r *http.Request) {
 	_, err := h.repository.Set(ctx, metric)
 	if err != nil {
 		log.Error().Err(err).Msgf("metric %s update error ", mName)
+		if isBadMetric(err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		w.WriteHeader(http.StatusNotImplemented)
 		return
 	}
 }
 
-// GetAll returns all metrics.
+// GetAll returns the dashboard of all metrics with their recent values.
 //
-//	@Description	Returns all metrics.
+//	@Description	Returns the dashboard of all metrics.
 //	@Produce		html
 //	@Success		200	{array}		models.Metric
 //	@Failure		500	{string}	string
@@ -191,22 +244,24 @@ func (h *handler) GetAll(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
-	metrics, _ := h.repository.GetAll(ctx)
-
-	tmpl, err := template.ParseFiles(filepath.Join("internal", "templates", "index.gohtml"))
+	metrics, err := h.repository.GetAll(ctx)
 	if err != nil {
-		log.Error().Err(err).Msg("template parsing error")
+		log.Error().Err(err).Msg("metrics getting error")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/html")
-	err = tmpl.Execute(w, metrics)
-	if err != nil {
+	var page bytes.Buffer
+	if err = indexTemplate.Execute(&page, newDashboardPage(metrics, h.history)); err != nil {
 		log.Error().Err(err).Msg("template execution error")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err = page.WriteTo(w); err != nil {
+		log.Error().Err(err).Msg("page writing error")
+	}
 }
 
 // GetWithJSON returns a metric in application/json content-type.
@@ -245,18 +300,21 @@ func (h *handler) GetWithJSON(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(metric); err != nil {
+	if err = json.NewEncoder(w).Encode(services.WithEstimates(metric)); err != nil {
 		log.Error().Err(err).Msg("JSON encoding error")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 }
 
-// GetWithText returns a metric in text/plain content type.
+// GetWithText returns a metric in text/plain content type. A histogram or a summary is returned as its count,
+// sum and quantile estimates, or as one quantile estimate if the quantile query parameter is set.
+// A set is returned as its cardinality estimate, an info as its text followed by its labels.
 //
 //	@Description	Returns a metric in text/plain content type.
-//	@Param			type	path		string	true	"metric type"
-//	@Param			name	path		string	true	"metric name"
+//	@Param			type		path		string	true	"metric type"
+//	@Param			name		path		string	true	"metric name"
+//	@Param			quantile	query		number	false	"quantile of a histogram or a summary, e.g. 0.95"
 //	@Success		200		{string}	string
 //	@Failure		400		{string}	string
 //	@Failure		404		{string}	string
@@ -289,14 +347,61 @@ func (h *handler) GetWithText(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if mType == services.Histogram || mType == services.Summary {
+		writeQuantiles(w, r, metric)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	if mType == services.Counter {
+	switch mType {
+	case services.Counter:
 		fmt.Fprint(w, *metric.Delta)
-	} else {
+	case services.Set:
+		fmt.Fprint(w, services.SetCardinality(metric.Set))
+	case services.Info:
+		fmt.Fprint(w, services.InfoString(metric.Info))
+	default:
 		fmt.Fprint(w, *metric.Value)
 	}
 }
 
+// writeQuantiles writes the count, the sum and the quantiles like "count=9 sum=2.7 p50=0.3 p90=0.8 p99=0.98".
+func writeQuantiles(w http.ResponseWriter, r *http.Request, metric *models.Metric) {
+	if q := r.URL.Query().Get("quantile"); len(q) > 0 {
+		quantile, err := strconv.ParseFloat(q, 64)
+		if err != nil || quantile < 0 || quantile > 1 {
+			log.Error().Msgf("invalid quantile %s", q)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, services.Quantile(metric, quantile))
+		return
+	}
+
+	var count uint64
+	var sum float64
+	if metric.Histogram != nil {
+		count, sum = metric.Histogram.Count, metric.Histogram.Sum
+	}
+	if metric.Summary != nil {
+		count, sum = metric.Summary.Count, metric.Summary.Sum
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "count=%d sum=%v", count, sum)
+	for _, q := range services.ReadQuantiles {
+		fmt.Fprintf(w, " %s=%v", services.QuantileName(q), services.Quantile(metric, q))
+	}
+}
+
+// isBadMetric reports whether the metric was rejected because of its content.
+func isBadMetric(err error) bool {
+	return errors.Is(err, services.ErrInvalidHash) ||
+		errors.Is(err, services.ErrInvalidHistogram) || errors.Is(err, services.ErrHistogramBounds) ||
+		errors.Is(err, services.ErrInvalidSummary) || errors.Is(err, services.ErrSummaryAccuracy) ||
+		errors.Is(err, services.ErrInvalidSet) || errors.Is(err, services.ErrInvalidInfo)
+}
+
 // Updates handles HTTP requests to update metrics.
 // It decodes the JSON request body into metrics, updates them using a 5-second context,
 // and sends the updated metrics back as a JSON response.
@@ -323,6 +428,9 @@ func (h *handler) Updates(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	for i := range metrics {
+		metrics[i].UpdatedAt = nil
+	}
 
 	var metricsResp []models.Metric
 
@@ -335,6 +443,7 @@ func (h *handler) Updates(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.announceAgentConfig(ctx, w, r)
 	w.Header().Set("Content-Type", "application/json")
 	if err = json.NewEncoder(w).Encode(metricsResp); err != nil {
 		log.Error().Err(err).Msg("JSON encoding error")
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/query"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/rs/zerolog/log"
+)
+
+// queryResponse is the response of the query API in the format of the Prometheus HTTP API,
+// a sample value is a pair of the unix time in seconds and the value as a string.
+type queryResponse struct {
+	Status    string     `json:"status"`
+	Data      *queryData `json:"data,omitempty"`
+	ErrorType string     `json:"errorType,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType string `json:"resultType"`
+	Result     any    `json:"result"`
+}
+
+type querySample struct {
+	Metric query.Labels `json:"metric"`
+	Value  [2]any       `json:"value"`
+}
+
+// Query evaluates a query at the time given by the time parameter or now.
+// The query selects metrics by the __name__ and type labels, e.g. sum by (type) ({__name__=~"CPU.*"}).
+//
+//	@Description	Evaluates a query like rate(PollCount[5m]) or sum by (type) ({__name__=~"CPU.*"}).
+//	@Produce		json
+//	@Param			query	query		string	true	"query"
+//	@Param			time	query		string	false	"evaluation time as RFC 3339 or unix seconds, now by default"
+//	@Success		200		{object}	queryResponse
+//	@Failure		400		{object}	queryResponse
+//	@Failure		500		{object}	queryResponse
+//	@Router			/api/v1/query [get]
+func (h *handler) Query(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("request body closing error")
+		}
+	}(r.Body)
+
+	t := time.Now()
+	if ts := r.FormValue("time"); len(ts) > 0 {
+		var err error
+		if t, err = parseTime(ts); err != nil {
+			writeQueryError(w, http.StatusBadRequest, "bad_data", "invalid time "+ts)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	v, err := query.Query(ctx, services.NewQueryStorage(h.repository, h.history), r.FormValue("query"), t)
+	if err != nil {
+		if errors.Is(err, query.ErrInvalidQuery) {
+			writeQueryError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		log.Error().Err(err).Msgf("query %s evaluation error", r.FormValue("query"))
+		writeQueryError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+
+	ts := float64(t.UnixMilli()) / 1000
+	data := &queryData{ResultType: v.Type()}
+	switch v := v.(type) {
+	case query.Scalar:
+		data.Result = [2]any{ts, formatSampleValue(float64(v))}
+	case query.Vector:
+		result := make([]querySample, 0, len(v))
+		for _, s := range v {
+			result = append(result, querySample{Metric: s.Labels, Value: [2]any{ts, formatSampleValue(s.V)}})
+		}
+		data.Result = result
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(queryResponse{Status: "success", Data: data}); err != nil {
+		log.Error().Err(err).Msg("JSON encoding error")
+	}
+}
+
+func writeQueryError(w http.ResponseWriter, status int, errorType string, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(queryResponse{Status: "error", ErrorType: errorType, Error: msg}); err != nil {
+		log.Error().Err(err).Msg("JSON encoding error")
+	}
+}
+
+// parseTime parses a time in RFC 3339 or in unix seconds with an optional fraction.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, errors.New("invalid time")
+	}
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// formatSampleValue formats a value like Prometheus does, so that NaN and infinities survive JSON.
+func formatSampleValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
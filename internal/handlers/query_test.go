@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Query(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/updates/", []byte(`[
+		{"id":"CPUutilization1","type":"gauge","value":20},
+		{"id":"CPUutilization2","type":"gauge","value":40},
+		{"id":"PollCount","type":"counter","delta":5}]`))
+	require.Equal(t, http.StatusOK, statusCode)
+	for _, v := range []string{"1", "2", "3"} {
+		statusCode, _ = testRequest(t, ts, "POST", "/update/summary/latency/"+v, nil)
+		require.Equal(t, http.StatusOK, statusCode)
+	}
+
+	type response struct {
+		Status    string `json:"status"`
+		ErrorType string `json:"errorType"`
+		Data      struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	type sample struct {
+		Metric map[string]string `json:"metric"`
+		Value  [2]any            `json:"value"`
+	}
+	decode := func(body io.Reader) (response, []sample) {
+		var decoded response
+		require.NoError(t, json.NewDecoder(body).Decode(&decoded))
+		var samples []sample
+		if decoded.Data.ResultType == "vector" {
+			require.NoError(t, json.Unmarshal(decoded.Data.Result, &samples))
+		}
+		return decoded, samples
+	}
+	run := func(method, q string) (int, response, []sample) {
+		var resp *http.Response
+		var err error
+		if method == http.MethodGet {
+			resp, err = http.Get(ts.URL + "/api/v1/query?query=" + url.QueryEscape(q))
+		} else {
+			resp, err = http.PostForm(ts.URL+"/api/v1/query", url.Values{"query": {q}})
+		}
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		decoded, samples := decode(resp.Body)
+		return resp.StatusCode, decoded, samples
+	}
+
+	statusCode, resp, samples := run(http.MethodGet, `avg by (type) ({__name__=~"CPUutilization.*"})`)
+	require.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "vector", resp.Data.ResultType)
+	require.Len(t, samples, 1)
+	assert.Equal(t, map[string]string{"type": "gauge"}, samples[0].Metric)
+	assert.Equal(t, "30", samples[0].Value[1])
+
+	statusCode, _, samples = run(http.MethodPost, `PollCount * 2`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Len(t, samples, 1)
+	assert.Equal(t, "10", samples[0].Value[1])
+
+	statusCode, _, samples = run(http.MethodGet, `latency_count + latency{quantile="0.5"}`)
+	require.Equal(t, http.StatusOK, statusCode)
+	assert.Empty(t, samples, "the quantile label was expected to prevent the match")
+	statusCode, _, samples = run(http.MethodGet, `sum(latency_count)`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Len(t, samples, 1)
+	assert.Equal(t, "3", samples[0].Value[1])
+
+	statusCode, resp, _ = run(http.MethodGet, `1 / 0`)
+	require.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "scalar", resp.Data.ResultType)
+	var scalar [2]any
+	require.NoError(t, json.Unmarshal(resp.Data.Result, &scalar))
+	assert.Equal(t, "+Inf", scalar[1])
+
+	statusCode, resp, _ = run(http.MethodGet, `rate(PollCount)`)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.Equal(t, "error", resp.Status)
+	assert.Equal(t, "bad_data", resp.ErrorType)
+
+	statusCode, _ = testRequest(t, ts, "GET", "/api/v1/query?query=PollCount&time=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	// the range functions are computed over the values recorded by the history
+	history := h.(*handler).history
+	for i, v := range []string{"3", "4"} {
+		statusCode, _ = testRequest(t, ts, "POST", "/update/counter/Requests/"+v, nil)
+		require.Equal(t, http.StatusOK, statusCode)
+		require.Eventually(t, func() bool { return len(history.Get("Requests", services.Counter)) == i+1 },
+			time.Second, time.Millisecond)
+	}
+	statusCode, _, samples = run(http.MethodGet, `increase(Requests[5m])`)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Len(t, samples, 1)
+	assert.Equal(t, "4", samples[0].Value[1])
+
+	statusCode, body := testRequest(t, ts, "GET", "/api/v1/query?query=Requests&time="+
+		url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), nil)
+	require.Equal(t, http.StatusOK, statusCode)
+	_, samples = decode(strings.NewReader(body))
+	assert.Empty(t, samples, "the metric was not expected before its first update")
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Set(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for i := 0; i < 20; i++ {
+		statusCode, _ := testRequest(t, ts, "POST", fmt.Sprintf("/update/set/users/user-%d", i%10), nil)
+		require.Equal(t, http.StatusOK, statusCode)
+	}
+
+	// registers sent by another agent are merged with the stored ones
+	registers := base64.StdEncoding.EncodeToString(services.NewSet("user-5", "user-10", "user-11").Registers)
+	statusCode, _ := testRequest(t, ts, "POST", "/update/",
+		[]byte(`{"id":"users","type":"set","set":{"items":["user-12"],"registers":"`+registers+`"}}`))
+	require.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update/", []byte(`{"id":"users","type":"set","set":{"registers":"AAEC"}}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode, "registers of a wrong size were expected to be rejected")
+
+	statusCode, resp := testRequest(t, ts, "POST", "/value/", []byte(`{"id":"users","type":"set"}`))
+	require.Equal(t, http.StatusOK, statusCode)
+	var m models.Metric
+	require.NoError(t, json.Unmarshal([]byte(resp), &m))
+	require.NotNil(t, m.Set.Cardinality)
+	assert.Equal(t, uint64(13), *m.Set.Cardinality)
+
+	statusCode, resp = testRequest(t, ts, "GET", "/value/set/users", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "13", resp)
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/rs/zerolog/log"
+)
+
+// streamBuffer is the number of updates a stream client may lag behind before it is dropped.
+const streamBuffer = 256
+
+// streamHeartbeat is the interval of the comments keeping proxies from closing idle streams.
+var streamHeartbeat = 15 * time.Second
+
+// Stream pushes every accepted metric update as a Server-Sent Event "metric" with the metric as JSON.
+// The updates are filtered by the repeated name and type parameters. A client that does not keep up
+// is sent the event "close" with the reason and disconnected.
+//
+//	@Description	Streams the accepted metric updates as Server-Sent Events.
+//	@Produce		text/event-stream
+//	@Param			name	query		[]string	false	"metric names"	collectionFormat(multi)
+//	@Param			type	query		[]string	false	"metric types"	collectionFormat(multi)
+//	@Success		200		{string}	string
+//	@Failure		400		{string}	string
+//	@Failure		500		{string}	string
+//	@Router			/api/v1/stream [get]
+func (h *handler) Stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error().Msg("the response writer does not support streaming")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	names := make(map[string]bool)
+	for _, name := range r.URL.Query()["name"] {
+		names[name] = true
+	}
+	types := make(map[string]bool)
+	for _, mType := range r.URL.Query()["type"] {
+		switch mType {
+		case services.Counter, services.Gauge, services.Histogram, services.Summary, services.Set, services.Info:
+			types[mType] = true
+		default:
+			log.Error().Err(services.ErrInvalidMetricType).Msgf("stream type %s", mType)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub := h.repository.Hub().Subscribe(streamBuffer, func(id string, mType string) bool {
+		return (len(names) == 0 || names[id]) && (len(types) == 0 || types[mType])
+	})
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case u, ok := <-sub.Updates():
+			if !ok {
+				log.Info().Err(sub.Err()).Msgf("stream of %s closed", r.RemoteAddr)
+				if _, err = fmt.Fprintf(w, "event: close\ndata: %s\n\n", sub.Err()); err == nil {
+					flusher.Flush()
+				}
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: metric\ndata: %s\n\n", u.Data)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("stream of %s writing error", r.RemoteAddr)
+			return
+		}
+		flusher.Flush()
+	}
+}
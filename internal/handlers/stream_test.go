@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Stream(t *testing.T) {
+	streamHeartbeat = 50 * time.Millisecond
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "GET", "/api/v1/stream?type=unknown", nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	resp, err := http.Get(ts.URL + "/api/v1/stream?type=counter&name=PollCount&name=Missing")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	statusCode, _ = testRequest(t, ts, "POST", "/updates/", []byte(`[
+		{"id":"PollCount","type":"counter","delta":5},
+		{"id":"PollCount","type":"gauge","value":5},
+		{"id":"Alloc","type":"counter","delta":1}]`))
+	require.Equal(t, http.StatusOK, statusCode)
+	statusCode, _ = testRequest(t, ts, "POST", "/update/counter/PollCount/2", nil)
+	require.Equal(t, http.StatusOK, statusCode)
+
+	var (
+		deltas    []int64
+		heartbeat bool
+	)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && (len(deltas) < 2 || !heartbeat) {
+		line := scanner.Text()
+		switch {
+		case line == ": heartbeat":
+			heartbeat = true
+		case strings.HasPrefix(line, "data: "):
+			var m models.Metric
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m))
+			assert.Equal(t, "PollCount", m.ID)
+			assert.Equal(t, services.Counter, m.MType)
+			require.NotNil(t, m.Delta)
+			deltas = append(deltas, *m.Delta)
+		}
+	}
+	assert.Equal(t, []int64{5, 7}, deltas, "the stored value was expected after every update")
+	assert.True(t, heartbeat)
+
+	mem.Hub().Close()
+	var closed bool
+	for scanner.Scan() {
+		if scanner.Text() == "event: close" {
+			closed = true
+		}
+	}
+	assert.True(t, closed)
+}
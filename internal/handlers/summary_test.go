@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Summary(t *testing.T) {
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for i := 1; i <= 100; i++ {
+		statusCode, _ := testRequest(t, ts, "POST", fmt.Sprintf("/update/summary/latency/%d", i), nil)
+		require.Equal(t, http.StatusOK, statusCode)
+	}
+
+	// a sketch sent by another agent is merged with the stored one
+	body := []byte(`{"id":"latency","type":"summary",
+		"summary":{"accuracy":0.01,"positive":{"0":1},"count":1,"sum":1,"min":1,"max":1}}`)
+	statusCode, _ := testRequest(t, ts, "POST", "/update/", body)
+	require.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update/",
+		[]byte(`{"id":"latency","type":"summary","summary":{"accuracy":0.05,"count":0}}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode, "a sketch with another accuracy was expected to be rejected")
+
+	statusCode, resp := testRequest(t, ts, "POST", "/value/", []byte(`{"id":"latency","type":"summary"}`))
+	require.Equal(t, http.StatusOK, statusCode)
+	var m models.Metric
+	require.NoError(t, json.Unmarshal([]byte(resp), &m))
+	assert.Equal(t, uint64(101), m.Summary.Count)
+	assert.InEpsilon(t, 50, m.Summary.Quantiles["p50"], 0.02)
+	assert.InEpsilon(t, 90, m.Summary.Quantiles["p90"], 0.02)
+	assert.InEpsilon(t, 99, m.Summary.Quantiles["p99"], 0.02)
+
+	statusCode, resp = testRequest(t, ts, "GET", "/value/summary/latency?quantile=0.9", nil)
+	require.Equal(t, http.StatusOK, statusCode)
+	q, err := strconv.ParseFloat(resp, 64)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 90, q, 0.02)
+
+	statusCode, resp = testRequest(t, ts, "GET", "/value/summary/latency", nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, resp, "count=101 sum=5051 p50=")
+}
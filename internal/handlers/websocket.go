@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/hub"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/query"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// wsMaxMessage is the largest message accepted from a client.
+	wsMaxMessage = 64 << 10
+	// wsMaxSubscriptions is the number of subscriptions a connection may have.
+	wsMaxSubscriptions = 100
+	// wsWriteTimeout is the time a client has to accept a message before it is disconnected.
+	wsWriteTimeout = 10 * time.Second
+	// wsAlertTimeout is the time the evaluation of all the alert rules of a connection may take.
+	wsAlertTimeout = 5 * time.Second
+)
+
+// wsAlertInterval is the interval of the evaluation of the alert rules of a connection.
+var wsAlertInterval = 10 * time.Second
+
+// Message types of the WebSocket API.
+const (
+	wsSubscribe    = "subscribe"
+	wsUnsubscribe  = "unsubscribe"
+	wsSnapshot     = "snapshot"
+	wsAlert        = "alert"
+	wsSubscribed   = "subscribed"
+	wsUnsubscribed = "unsubscribed"
+	wsUpdate       = "update"
+	wsHeartbeat    = "heartbeat"
+	wsError        = "error"
+	wsClose        = "close"
+)
+
+// wsRequest is a message from a client, Prefix, Regexp and MetricType select the metrics like the parameters
+// of the metric listing. Query, Above, Below and For are the alert rule of an alert request.
+type wsRequest struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Prefix     string   `json:"prefix,omitempty"`
+	Regexp     string   `json:"regex,omitempty"`
+	MetricType string   `json:"metric_type,omitempty"`
+	Query      string   `json:"query,omitempty"`
+	Above      *float64 `json:"above,omitempty"`
+	Below      *float64 `json:"below,omitempty"`
+	For        string   `json:"for,omitempty"`
+}
+
+// wsResponse is a message to a client.
+type wsResponse struct {
+	Type          string          `json:"type"`
+	ID            string          `json:"id,omitempty"`
+	Subscriptions []string        `json:"subscriptions,omitempty"`
+	Metric        json.RawMessage `json:"metric,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
+
+// wsSnapshotResponse is the answer to a snapshot request.
+type wsSnapshotResponse struct {
+	Type    string           `json:"type"`
+	ID      string           `json:"id"`
+	Metrics []*models.Metric `json:"metrics"`
+}
+
+// wsAlertResponse is a change of the state of an alert.
+type wsAlertResponse struct {
+	Type   string       `json:"type"`
+	ID     string       `json:"id"`
+	State  string       `json:"state"`
+	Labels query.Labels `json:"labels"`
+	Value  float64      `json:"value"`
+	Since  time.Time    `json:"since"`
+}
+
+// wsClient is a WebSocket connection with its subscriptions and alerts.
+type wsClient struct {
+	sync.Mutex
+	subscriptions map[string]func(id string, mType string) bool
+	alerts        map[string]*services.Alert
+	conn          *websocket.Conn
+	// writeMu serializes the messages written by the request, the update and the alert loops.
+	writeMu sync.Mutex
+}
+
+// WebSocket serves the bidirectional metric subscriptions. Every message is a JSON object with a type.
+//
+// A client sends:
+//
+//	{"type":"subscribe","id":"cpu","prefix":"CPU","regex":"[0-9]$","metric_type":"gauge"}
+//	{"type":"unsubscribe","id":"cpu"}
+//	{"type":"snapshot","id":"s1","prefix":"CPU"}
+//	{"type":"alert","id":"cpu-high","query":"avg({__name__=~\"CPU.*\"})","above":90,"for":"1m"}
+//
+// The id of a subscription is chosen by the client, subscribing with the same id replaces the subscription.
+// The prefix, regex and metric_type are optional, a subscription without them receives every update.
+// A snapshot request returns the current metrics selected the same way, subscribing first and then requesting
+// a snapshot gives the full state, though the updates made in between may be received twice.
+// An alert request subscribes to the state changes of an alert rule, it takes the place of a subscription
+// with the same id and is removed by unsubscribing. The rules are evaluated every 10 seconds, all of them within
+// 5 seconds, a rule fires for every sample of the query whose value stays above or below the thresholds
+// for the optional duration.
+//
+// The server sends:
+//
+//	{"type":"subscribed","id":"cpu"}
+//	{"type":"unsubscribed","id":"cpu"}
+//	{"type":"snapshot","id":"s1","metrics":[{"id":"CPUutilization1","type":"gauge","value":20}]}
+//	{"type":"update","subscriptions":["cpu"],"metric":{"id":"CPUutilization1","type":"gauge","value":21}}
+//	{"type":"alert","id":"cpu-high","state":"firing","labels":{},"value":93.5,"since":"2024-01-01T12:00:00Z"}
+//	{"type":"heartbeat"}
+//	{"type":"error","id":"cpu","error":"invalid metric filter: ..."}
+//	{"type":"close","error":"the subscriber did not keep up with the updates"}
+//
+// An update is the stored metric after every accepted update, it lists the ids of the matching subscriptions.
+// An alert is sent when a sample starts firing and when it is resolved, since is when its value crossed
+// the threshold and value is the last value beyond the threshold.
+// A client that does not keep up or the server shutting down gets a close message and the connection is closed.
+//
+//	@Description	Serves the WebSocket API of the metric subscriptions, snapshots and alerts.
+//	@Success		101	{string}	string
+//	@Failure		403	{string}	string
+//	@Router			/api/v1/ws [get]
+func (h *handler) WebSocket(w http.ResponseWriter, r *http.Request) {
+	srv := websocket.Server{Handshake: checkWebSocketOrigin, Handler: h.serveWebSocket}
+	srv.ServeHTTP(w, r)
+}
+
+// checkWebSocketOrigin accepts the clients without an origin and the pages served by this server,
+// so that other sites cannot read the metrics through the browsers of their visitors.
+func checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host != r.Host {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	config.Origin = u
+	return nil
+}
+
+func (h *handler) serveWebSocket(conn *websocket.Conn) {
+	conn.MaxPayloadBytes = wsMaxMessage
+	c := &wsClient{
+		subscriptions: make(map[string]func(id string, mType string) bool),
+		alerts:        make(map[string]*services.Alert),
+		conn:          conn,
+	}
+	addr := conn.Request().RemoteAddr
+
+	sub := h.repository.Hub().Subscribe(streamBuffer, c.match)
+	defer sub.Close()
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Error().Err(err).Msgf("websocket of %s closing error", addr)
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.readWebSocket(c, addr)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alertErr := make(chan error, 1)
+	go func() {
+		alertErr <- h.runAlerts(ctx, c)
+	}()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case u, ok := <-sub.Updates():
+			if !ok {
+				log.Info().Err(sub.Err()).Msgf("websocket of %s closed", addr)
+				if err = c.send(wsResponse{Type: wsClose, Error: sub.Err().Error()}); err != nil {
+					log.Error().Err(err).Msgf("websocket of %s writing error", addr)
+				}
+				return
+			}
+			err = c.sendUpdate(u)
+		case <-heartbeat.C:
+			err = c.send(wsResponse{Type: wsHeartbeat})
+		case err = <-alertErr:
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("websocket of %s writing error", addr)
+			return
+		}
+	}
+}
+
+// readWebSocket serves the requests of the client until the connection is closed.
+func (h *handler) readWebSocket(c *wsClient, addr string) {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(c.conn, &data); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Error().Err(err).Msgf("websocket of %s reading error", addr)
+			}
+			return
+		}
+
+		var answer any
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			answer = wsResponse{Type: wsError, Error: "JSON decoding error: " + err.Error()}
+		} else {
+			answer = h.answerWebSocket(c, req)
+		}
+		if err := c.send(answer); err != nil {
+			log.Error().Err(err).Msgf("websocket of %s writing error", addr)
+			return
+		}
+	}
+}
+
+// answerWebSocket serves a request and returns the answer.
+func (h *handler) answerWebSocket(c *wsClient, req wsRequest) any {
+	filter := models.MetricFilter{Prefix: req.Prefix, Regexp: req.Regexp, Type: req.MetricType}
+	var err error
+	switch req.Type {
+	case wsSubscribe:
+		if err = c.subscribe(req.ID, filter); err == nil {
+			return wsResponse{Type: wsSubscribed, ID: req.ID}
+		}
+	case wsAlert:
+		if err = c.addAlert(req); err == nil {
+			return wsResponse{Type: wsSubscribed, ID: req.ID}
+		}
+	case wsUnsubscribe:
+		if c.unsubscribe(req.ID) {
+			return wsResponse{Type: wsUnsubscribed, ID: req.ID}
+		}
+		err = errors.New("there is no such subscription")
+	case wsSnapshot:
+		var metrics []*models.Metric
+		if metrics, err = h.snapshot(filter); err == nil {
+			return wsSnapshotResponse{Type: wsSnapshot, ID: req.ID, Metrics: metrics}
+		}
+	default:
+		err = errors.New("unknown message type " + req.Type)
+	}
+	return wsResponse{Type: wsError, ID: req.ID, Error: err.Error()}
+}
+
+// snapshot returns the current metrics selected by the filter.
+func (h *handler) snapshot(filter models.MetricFilter) ([]*models.Metric, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	metrics, err := h.repository.List(ctx, filter)
+	if err != nil {
+		if !errors.Is(err, services.ErrInvalidFilter) {
+			log.Error().Err(err).Msg("metrics listing error")
+		}
+		return nil, err
+	}
+	result := make([]*models.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		result = append(result, services.WithEstimates(m))
+	}
+	return result, nil
+}
+
+func (c *wsClient) subscribe(id string, filter models.MetricFilter) error {
+	if len(id) == 0 {
+		return errors.New("the subscription id is required")
+	}
+	match, err := services.NewMetricMatcher(filter)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if err = c.checkLimit(id); err != nil {
+		return err
+	}
+	delete(c.alerts, id)
+	c.subscriptions[id] = match
+	return nil
+}
+
+// addAlert adds the alert rule of the request.
+func (c *wsClient) addAlert(req wsRequest) error {
+	if len(req.ID) == 0 {
+		return errors.New("the alert id is required")
+	}
+	rule := services.AlertRule{Query: req.Query, Above: req.Above, Below: req.Below}
+	if len(req.For) > 0 {
+		var err error
+		if rule.For, err = time.ParseDuration(req.For); err != nil {
+			return fmt.Errorf("%w: %s", services.ErrInvalidAlertRule, err.Error())
+		}
+	}
+	alert, err := services.NewAlert(rule)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if err = c.checkLimit(req.ID); err != nil {
+		return err
+	}
+	delete(c.subscriptions, req.ID)
+	c.alerts[req.ID] = alert
+	return nil
+}
+
+// checkLimit returns an error if a new subscription or alert with the id would exceed the limit,
+// it must be called with the lock held.
+func (c *wsClient) checkLimit(id string) error {
+	_, subscribed := c.subscriptions[id]
+	_, alerted := c.alerts[id]
+	if !subscribed && !alerted && len(c.subscriptions)+len(c.alerts) >= wsMaxSubscriptions {
+		return fmt.Errorf("at most %d subscriptions are allowed", wsMaxSubscriptions)
+	}
+	return nil
+}
+
+func (c *wsClient) unsubscribe(id string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, subscribed := c.subscriptions[id]
+	_, alerted := c.alerts[id]
+	delete(c.subscriptions, id)
+	delete(c.alerts, id)
+	return subscribed || alerted
+}
+
+// runAlerts evaluates the alert rules of the client every wsAlertInterval until the context is cancelled.
+// It runs apart from the update loop, so slow queries do not hold the updates back, and returns
+// the error of sending a change.
+func (h *handler) runAlerts(ctx context.Context, c *wsClient) error {
+	ticker := time.NewTicker(wsAlertInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if err := h.evalAlerts(ctx, c); err != nil {
+			return err
+		}
+	}
+}
+
+// evalAlerts evaluates the alert rules of the client and sends the state changes. The rules are evaluated
+// without the lock, the changes of a rule that was removed or replaced meanwhile are not sent.
+// All the rules share the deadline wsAlertTimeout, the rules left when it passes are skipped until the next pass.
+func (h *handler) evalAlerts(ctx context.Context, c *wsClient) error {
+	c.Lock()
+	alerts := make(map[string]*services.Alert, len(c.alerts))
+	for id, alert := range c.alerts {
+		alerts[id] = alert
+	}
+	c.Unlock()
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	storage := services.NewQueryStorage(h.repository, h.history)
+	now := time.Now()
+	ids := make([]string, 0, len(alerts))
+	for id := range alerts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	ctx, cancel := context.WithTimeout(ctx, wsAlertTimeout)
+	defer cancel()
+	for i, id := range ids {
+		if ctx.Err() != nil {
+			log.Error().Err(ctx.Err()).Msgf("evaluation of %d alert rules skipped", len(ids)-i)
+			return nil
+		}
+		changes, err := alerts[id].Eval(ctx, storage, now)
+		if err != nil {
+			log.Error().Err(err).Msgf("alert %s evaluation error", id)
+			continue
+		}
+
+		c.Lock()
+		current := c.alerts[id] == alerts[id]
+		c.Unlock()
+		if !current {
+			continue
+		}
+		for _, change := range changes {
+			err = c.send(wsAlertResponse{Type: wsAlert, ID: id, State: change.State, Labels: change.Labels,
+				Value: change.Value, Since: change.Since})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// match reports whether any subscription selects the metric, the hub calls it while publishing.
+func (c *wsClient) match(id string, mType string) bool {
+	c.Lock()
+	defer c.Unlock()
+	for _, match := range c.subscriptions {
+		if match(id, mType) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendUpdate sends the update with the ids of the subscriptions selecting it, the subscriptions
+// may have changed since it was published.
+func (c *wsClient) sendUpdate(u hub.Update) error {
+	c.Lock()
+	ids := make([]string, 0, 1)
+	for id, match := range c.subscriptions {
+		if match(u.ID, u.MType) {
+			ids = append(ids, id)
+		}
+	}
+	c.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Strings(ids)
+	return c.send(wsResponse{Type: wsUpdate, Subscriptions: ids, Metric: u.Data})
+}
+
+func (c *wsClient) send(v any) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+	return websocket.JSON.Send(c.conn, v)
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/middlewares"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/services"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestHandler_WebSocket(t *testing.T) {
+	defer func(d time.Duration) { wsAlertInterval = d }(wsAlertInterval)
+	wsAlertInterval = 10 * time.Millisecond
+	mem := services.NewFileRepository("", time.Second, "")
+
+	r := chi.NewRouter()
+	r.Use(middlewares.GzipMiddleware)
+	h := NewRouter(r, &mem)
+	h.Register(r)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/updates/", []byte(`[
+		{"id":"CPUutilization1","type":"gauge","value":20},
+		{"id":"PollCount","type":"counter","delta":5}]`))
+	require.Equal(t, http.StatusOK, statusCode)
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/v1/ws"
+	_, err := websocket.Dial(wsURL, "", "http://evil.example.com")
+	assert.Error(t, err, "a foreign origin was expected to be rejected")
+
+	config, err := websocket.NewConfig(wsURL, ts.URL)
+	require.NoError(t, err)
+	config.Header.Set("Accept-Encoding", "gzip")
+	conn, err := websocket.DialConfig(config)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	type message struct {
+		Type          string            `json:"type"`
+		ID            string            `json:"id"`
+		Subscriptions []string          `json:"subscriptions"`
+		Metric        models.Metric     `json:"metric"`
+		Metrics       []*models.Metric  `json:"metrics"`
+		Error         string            `json:"error"`
+		State         string            `json:"state"`
+		Labels        map[string]string `json:"labels"`
+		Value         float64           `json:"value"`
+	}
+	exchange := func(req string) message {
+		t.Helper()
+		require.NoError(t, websocket.Message.Send(conn, req))
+		var msg message
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, websocket.JSON.Receive(conn, &msg))
+		return msg
+	}
+
+	msg := exchange(`{"type":"subscribe","id":"cpu","prefix":"CPU","metric_type":"gauge"}`)
+	assert.Equal(t, message{Type: "subscribed", ID: "cpu"}, msg)
+	msg = exchange(`{"type":"subscribe","id":"all"}`)
+	assert.Equal(t, "subscribed", msg.Type)
+	msg = exchange(`{"type":"subscribe","id":"bad","regex":"("}`)
+	assert.Equal(t, "error", msg.Type)
+	assert.Equal(t, "bad", msg.ID)
+	msg = exchange(`{"type":"unsubscribe","id":"missing"}`)
+	assert.Equal(t, "error", msg.Type)
+	msg = exchange(`{"type":"ping"}`)
+	assert.Equal(t, "error", msg.Type)
+	msg = exchange(`not json`)
+	assert.Equal(t, "error", msg.Type)
+
+	msg = exchange(`{"type":"snapshot","id":"s1","prefix":"CPU"}`)
+	assert.Equal(t, "snapshot", msg.Type)
+	assert.Equal(t, "s1", msg.ID)
+	require.Len(t, msg.Metrics, 1)
+	assert.Equal(t, "CPUutilization1", msg.Metrics[0].ID)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update/gauge/CPUutilization1/21", nil)
+	require.Equal(t, http.StatusOK, statusCode)
+	var update message
+	require.NoError(t, websocket.JSON.Receive(conn, &update))
+	assert.Equal(t, "update", update.Type)
+	assert.Equal(t, []string{"all", "cpu"}, update.Subscriptions)
+	assert.Equal(t, 21.0, *update.Metric.Value)
+
+	msg = exchange(`{"type":"unsubscribe","id":"all"}`)
+	assert.Equal(t, message{Type: "unsubscribed", ID: "all"}, msg)
+	statusCode, _ = testRequest(t, ts, "POST", "/update/counter/PollCount/1", nil)
+	require.Equal(t, http.StatusOK, statusCode)
+	statusCode, _ = testRequest(t, ts, "POST", "/update/gauge/CPUutilization1/22", nil)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.NoError(t, websocket.JSON.Receive(conn, &update))
+	assert.Equal(t, []string{"cpu"}, update.Subscriptions)
+	assert.Equal(t, 22.0, *update.Metric.Value, "the counter was expected to be skipped")
+
+	msg = exchange(`{"type":"unsubscribe","id":"cpu"}`)
+	assert.Equal(t, message{Type: "unsubscribed", ID: "cpu"}, msg)
+	msg = exchange(`{"type":"alert","id":"bad","query":"CPUutilization1"}`)
+	assert.Equal(t, "error", msg.Type, "an alert without a threshold was expected to be rejected")
+	msg = exchange(`{"type":"alert","id":"hot","query":"CPUutilization1","above":30}`)
+	assert.Equal(t, message{Type: "subscribed", ID: "hot"}, msg)
+	labels := map[string]string{"__name__": "CPUutilization1", "type": "gauge"}
+	for _, step := range []struct {
+		value string
+		state string
+	}{{"40", "firing"}, {"10", "resolved"}} {
+		statusCode, _ = testRequest(t, ts, "POST", "/update/gauge/CPUutilization1/"+step.value, nil)
+		require.Equal(t, http.StatusOK, statusCode)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		var alert message
+		require.NoError(t, websocket.JSON.Receive(conn, &alert))
+		assert.Equal(t, message{Type: "alert", ID: "hot", State: step.state, Labels: labels, Value: 40}, alert)
+	}
+
+	mem.Hub().Close()
+	var raw json.RawMessage
+	require.NoError(t, websocket.JSON.Receive(conn, &raw))
+	assert.JSONEq(t, `{"type":"close","error":"the hub is closed"}`, string(raw))
+	assert.Error(t, websocket.JSON.Receive(conn, &raw), "the connection was expected to be closed")
+}
@@ -0,0 +1,118 @@
+// Package hub fans out the accepted metric updates to the live consumers like the stream API.
+package hub
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrSlowSubscriber = errors.New("the subscriber did not keep up with the updates")
+	ErrClosed         = errors.New("the hub is closed")
+)
+
+// Update is an accepted metric update, Data is the stored metric as JSON.
+type Update struct {
+	ID    string
+	MType string
+	Data  []byte
+}
+
+// Hub delivers every published update to the subscribers matching it. Each subscriber has its own buffer,
+// a subscriber whose buffer is full is dropped, so publishing never waits for slow consumers.
+type Hub struct {
+	sync.Mutex
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+// Subscription receives the updates accepted by its match function until it is closed or dropped.
+type Subscription struct {
+	hub   *Hub
+	match func(id string, mType string) bool
+	ch    chan Update
+	err   error
+}
+
+// New creates a new hub and returns a pointer to it.
+func New() *Hub {
+	return &Hub{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe adds a subscriber with a buffer of the given size. A nil match function accepts every update.
+// The match function is called while publishing, so it must be fast and must not call the hub.
+func (h *Hub) Subscribe(buffer int, match func(id string, mType string) bool) *Subscription {
+	s := &Subscription{hub: h, match: match, ch: make(chan Update, buffer)}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		s.err = ErrClosed
+		close(s.ch)
+		return s
+	}
+	h.subscribers[s] = struct{}{}
+	return s
+}
+
+// Active reports whether there are subscribers, so that publishers can skip encoding updates nobody reads.
+func (h *Hub) Active() bool {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.subscribers) > 0
+}
+
+// Publish delivers the update to the matching subscribers and drops those whose buffer is full.
+func (h *Hub) Publish(u Update) {
+	h.Lock()
+	defer h.Unlock()
+	for s := range h.subscribers {
+		if s.match != nil && !s.match(u.ID, u.MType) {
+			continue
+		}
+		select {
+		case s.ch <- u:
+		default:
+			h.remove(s, ErrSlowSubscriber)
+		}
+	}
+}
+
+// Close closes all subscriptions, later subscriptions are closed right away.
+func (h *Hub) Close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	for s := range h.subscribers {
+		h.remove(s, ErrClosed)
+	}
+}
+
+// remove must be called with the lock held.
+func (h *Hub) remove(s *Subscription, err error) {
+	if _, ok := h.subscribers[s]; !ok {
+		return
+	}
+	delete(h.subscribers, s)
+	s.err = err
+	close(s.ch)
+}
+
+// Updates returns the channel of the updates, it is closed when the subscription ends.
+func (s *Subscription) Updates() <-chan Update {
+	return s.ch
+}
+
+// Err returns why the subscription ended: ErrSlowSubscriber, ErrClosed or nil if it was closed by the subscriber.
+func (s *Subscription) Err() error {
+	s.hub.Lock()
+	defer s.hub.Unlock()
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.hub.Lock()
+	defer s.hub.Unlock()
+	s.hub.remove(s, nil)
+}
@@ -0,0 +1,49 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHub(t *testing.T) {
+	h := New()
+	assert.False(t, h.Active())
+
+	all := h.Subscribe(10, nil)
+	gauges := h.Subscribe(10, func(_ string, mType string) bool { return mType == "gauge" })
+	slow := h.Subscribe(1, nil)
+	assert.True(t, h.Active())
+
+	h.Publish(Update{ID: "Alloc", MType: "gauge", Data: []byte("1")})
+	h.Publish(Update{ID: "PollCount", MType: "counter", Data: []byte("2")})
+
+	assert.Equal(t, "Alloc", (<-all.Updates()).ID)
+	assert.Equal(t, "PollCount", (<-all.Updates()).ID)
+	assert.Equal(t, "Alloc", (<-gauges.Updates()).ID)
+	assert.Empty(t, gauges.Updates())
+
+	// the second update did not fit into the buffer of the slow subscriber
+	assert.Equal(t, "Alloc", (<-slow.Updates()).ID)
+	_, ok := <-slow.Updates()
+	assert.False(t, ok)
+	assert.ErrorIs(t, slow.Err(), ErrSlowSubscriber)
+
+	gauges.Close()
+	_, ok = <-gauges.Updates()
+	assert.False(t, ok)
+	assert.NoError(t, gauges.Err())
+	gauges.Close()
+
+	h.Close()
+	_, ok = <-all.Updates()
+	assert.False(t, ok)
+	assert.ErrorIs(t, all.Err(), ErrClosed)
+	assert.False(t, h.Active())
+
+	late := h.Subscribe(10, nil)
+	_, ok = <-late.Updates()
+	require.False(t, ok)
+	assert.ErrorIs(t, late.Err(), ErrClosed)
+}
@@ -13,10 +13,10 @@ type gzipWriter struct {
 	Writer *gzip.Writer
 }
 
-// GzipMiddleware compresses HTTP response using gzip.
+// GzipMiddleware compresses HTTP response using gzip. Protocol upgrades like WebSocket are passed as is.
 func GzipMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || len(r.Header.Get("Upgrade")) > 0 {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -50,3 +50,14 @@ func (gzResponse gzipWriter) Header() http.Header {
 func (gzResponse gzipWriter) WriteHeader(statusCode int) {
 	gzResponse.ResponseWriter.WriteHeader(statusCode)
 }
+
+// Flush sends the data compressed so far to the client, so that streaming responses are not held back.
+func (gzResponse gzipWriter) Flush() {
+	if err := gzResponse.Writer.Flush(); err != nil {
+		log.Error().Err(err).Msg("gzip.Writer flushing error")
+		return
+	}
+	if f, ok := gzResponse.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
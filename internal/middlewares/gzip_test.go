@@ -60,3 +60,32 @@ func BenchmarkGzipMiddleware(b *testing.B) {
 		middleware.ServeHTTP(gw, req)
 	}
 }
+
+func TestGzipMiddleware_Flush(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(GzipMiddleware)
+
+	flushed := make(chan struct{})
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("event"))
+		w.(http.Flusher).Flush()
+		<-flushed
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	reader, err := gzip.NewReader(resp.Body)
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(reader, buf)
+	close(flushed)
+	assert.NoError(t, err)
+	assert.Equal(t, "event", string(buf))
+}
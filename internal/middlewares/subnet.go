@@ -0,0 +1,71 @@
+package middlewares
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TrustedSubnet rejects requests to the metric update routes, deletes and changes of the agent configs
+// whose X-Real-IP does not belong to the subnet.
+// If the header is absent, the remote address is used, which middleware.RealIP has already resolved.
+// A nil subnet disables the check, but the agent configs then cannot be changed and the metrics cannot be
+// deleted at all, as that would let anybody reconfigure the whole fleet or wipe the stored metrics.
+func TrustedSubnet(subnet *net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subnet == nil && (isConfigWrite(r) || r.Method == http.MethodDelete) {
+				log.Warn().Msgf("%s %s from %s rejected, no trusted subnet is set", r.Method, r.URL.Path, r.RemoteAddr)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if subnet == nil || !isWrite(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			address := r.Header.Get("X-Real-IP")
+			if len(address) == 0 {
+				address = r.RemoteAddr
+			}
+
+			ip := parseIP(address)
+			if ip == nil || !subnet.Contains(ip) {
+				log.Warn().Msgf("request from %s rejected, the address is not in the trusted subnet %s",
+					address, subnet)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isWrite reports whether the request changes the stored metrics or the agent configs.
+func isWrite(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/update") || r.Method == http.MethodDelete {
+		return true
+	}
+	return isConfigWrite(r)
+}
+
+// isConfigWrite reports whether the request changes the agent configs.
+func isConfigWrite(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/agent/") && r.Method != http.MethodGet
+}
+
+// parseIP parses an address that may come with a port or an IPv6 zone.
+func parseIP(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.Trim(address, "[]")
+	if i := strings.IndexByte(address, '%'); i >= 0 {
+		address = address[:i]
+	}
+	return net.ParseIP(address)
+}
@@ -0,0 +1,81 @@
+package middlewares
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedSubnet(t *testing.T) {
+	_, subnet4, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	_, subnet6, err := net.ParseCIDR("fd00::/64")
+	require.NoError(t, err)
+
+	newRouter := func(subnet *net.IPNet) *chi.Mux {
+		r := chi.NewRouter()
+		r.Use(middleware.RealIP)
+		r.Use(TrustedSubnet(subnet))
+		ok := func(w http.ResponseWriter, r *http.Request) {}
+		r.Post("/update/", ok)
+		r.Post("/updates/", ok)
+		r.Get("/value/{type}/{name}", ok)
+		r.Get("/ping", ok)
+		r.Get("/agent/config", ok)
+		r.Put("/agent/config/{id}", ok)
+		r.Delete("/value/{type}/{name}", ok)
+		r.Delete("/api/v1/metrics", ok)
+		return r
+	}
+
+	testCases := []struct {
+		name       string
+		subnet     *net.IPNet
+		method     string
+		path       string
+		realIP     string
+		statusCode int
+	}{
+		{"ipv4 inside", subnet4, http.MethodPost, "/updates/", "192.168.1.10", http.StatusOK},
+		{"ipv4 outside", subnet4, http.MethodPost, "/updates/", "10.0.0.1", http.StatusForbidden},
+		{"single update outside", subnet4, http.MethodPost, "/update/", "10.0.0.1", http.StatusForbidden},
+		{"no header", subnet4, http.MethodPost, "/update/", "", http.StatusForbidden},
+		{"garbage header", subnet4, http.MethodPost, "/update/", "not-an-ip", http.StatusForbidden},
+		{"ipv6 inside", subnet6, http.MethodPost, "/updates/", "fd00::1", http.StatusOK},
+		{"ipv6 outside", subnet6, http.MethodPost, "/updates/", "fd01::1", http.StatusForbidden},
+		{"read-only route", subnet4, http.MethodGet, "/value/gauge/test", "10.0.0.1", http.StatusOK},
+		{"ping", subnet4, http.MethodGet, "/ping", "10.0.0.1", http.StatusOK},
+		{"agent config fetch", subnet4, http.MethodGet, "/agent/config", "10.0.0.1", http.StatusOK},
+		{"agent config change outside", subnet4, http.MethodPut, "/agent/config/web", "10.0.0.1", http.StatusForbidden},
+		{"agent config change inside", subnet4, http.MethodPut, "/agent/config/web", "192.168.1.10", http.StatusOK},
+		{"delete outside", subnet4, http.MethodDelete, "/value/gauge/test", "10.0.0.1", http.StatusForbidden},
+		{"bulk delete outside", subnet4, http.MethodDelete, "/api/v1/metrics?prefix=test", "10.0.0.1", http.StatusForbidden},
+		{"bulk delete inside", subnet4, http.MethodDelete, "/api/v1/metrics?prefix=test", "192.168.1.10", http.StatusOK},
+		{"check disabled", nil, http.MethodPost, "/updates/", "10.0.0.1", http.StatusOK},
+		{"agent config change without subnet", nil, http.MethodPut, "/agent/config/web", "192.168.1.10", http.StatusForbidden},
+		{"agent config fetch without subnet", nil, http.MethodGet, "/agent/config", "10.0.0.1", http.StatusOK},
+		{"delete without subnet", nil, http.MethodDelete, "/value/gauge/test", "192.168.1.10", http.StatusForbidden},
+		{"bulk delete without subnet", nil, http.MethodDelete, "/api/v1/metrics?prefix=test", "192.168.1.10", http.StatusForbidden},
+		{"read without subnet", nil, http.MethodGet, "/value/gauge/test", "10.0.0.1", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.RemoteAddr = "172.16.0.1:12345"
+			if len(tc.realIP) > 0 {
+				req.Header.Set("X-Real-IP", tc.realIP)
+			}
+
+			rec := httptest.NewRecorder()
+			newRouter(tc.subnet).ServeHTTP(rec, req)
+			assert.Equal(t, tc.statusCode, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// Headers used by agents to introduce themselves and by the server to announce the config version.
+const (
+	AgentIDHeader            = "X-Agent-ID"
+	AgentLabelsHeader        = "X-Agent-Labels"
+	AgentConfigVersionHeader = "X-Agent-Config-Version"
+)
+
+// AgentConfig is the part of the agent config that can be changed by the server.
+type AgentConfig struct {
+	PollInterval   string   `json:"poll_interval,omitempty" example:"2s"`
+	ReportInterval string   `json:"report_interval,omitempty" example:"10s"`
+	Collectors     []string `json:"collectors,omitempty" example:"runtime,advanced"`
+}
+
+// Version returns a short digest of the config, agents compare it to find out that the config has changed.
+func (c AgentConfig) Version() string {
+	b, _ := json.Marshal(c)
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:16]
+}
+
+// AgentConfigRule assigns a config to an agent by its ID or to the agents having all the labels.
+type AgentConfigRule struct {
+	ID     string            `json:"id" example:"web-servers"`
+	Agent  string            `json:"agent,omitempty" example:"web-01"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Config AgentConfig       `json:"config"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// Sort orders of the metric listing.
+const (
+	SortByName    = "name"
+	SortByValue   = "value"
+	SortByUpdated = "updated"
+)
+
+// MetricFilter selects, sorts and pages metrics. Empty fields do not filter.
+// Metrics are sorted by the sort key, then by name and type. Sorted by value, metrics without
+// a numeric value, all but gauges and counters, go last in both orders.
+type MetricFilter struct {
+	// Prefix of the metric name.
+	Prefix string
+	// Regexp matching a part of the metric name, in the syntax shared by Go and Postgres.
+	Regexp string
+	Type   string
+	Sort   string
+	Desc   bool
+	// After is the last metric of the previous page.
+	After *MetricCursor
+	// Limit of the metrics returned, 0 means no limit.
+	Limit int
+}
+
+// MetricCursor is the position of a metric in the sort order.
+type MetricCursor struct {
+	ID        string    `json:"id"`
+	MType     string    `json:"type"`
+	Value     *float64  `json:"value,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -1,10 +1,63 @@
 package models
 
+import "time"
+
 // Metric is a struct for metrics.
 type Metric struct {
 	ID    string   `json:"id" example:"metric_name"`
 	MType string   `json:"type" example:"counter"`
 	Delta *int64   `json:"delta,omitempty" example:"1"`
 	Value *float64 `json:"value,omitempty" example:"1.0"`
-	Hash  string   `json:"hash,omitempty" example:"hash"`
+	// Histogram is set for the histogram type only.
+	Histogram *Histogram `json:"histogram,omitempty"`
+	// Summary is set for the summary type only.
+	Summary *Summary `json:"summary,omitempty"`
+	// Set is set for the set type only.
+	Set *Set `json:"set,omitempty"`
+	// Info is set for the info type only.
+	Info *Info  `json:"info,omitempty"`
+	Hash string `json:"hash,omitempty" example:"hash"`
+	// UpdatedAt is set by the server when the metric is stored and ignored on update.
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// Histogram counts observations in buckets. Counts[i] is the number of observations not greater
+// than Bounds[i] and greater than the previous bound, the last count is the +Inf bucket.
+type Histogram struct {
+	Bounds []float64 `json:"bounds" example:"0.1,0.5,1"`
+	Counts []uint64  `json:"counts" example:"3,5,1,0"`
+	Sum    float64   `json:"sum" example:"2.7"`
+	Count  uint64    `json:"count" example:"9"`
+	// Quantiles are estimated by the server on read and ignored on update.
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// Summary is a mergeable quantile sketch (DDSketch). A positive value v is counted in the bin
+// ceil(log(v) / log((1 + Accuracy) / (1 - Accuracy))), negative values in the bins of their absolute value.
+type Summary struct {
+	Accuracy float64          `json:"accuracy" example:"0.01"`
+	Positive map[int32]uint64 `json:"positive,omitempty"`
+	Negative map[int32]uint64 `json:"negative,omitempty"`
+	Zero     uint64           `json:"zero,omitempty"`
+	Count    uint64           `json:"count" example:"9"`
+	Sum      float64          `json:"sum" example:"2.7"`
+	Min      float64          `json:"min" example:"0.1"`
+	Max      float64          `json:"max" example:"0.9"`
+	// Quantiles are estimated by the server on read and ignored on update.
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// Set counts distinct items with HyperLogLog. Clients send raw items, the registers of their own sketch
+// or both, the server keeps only the registers.
+type Set struct {
+	Items     []string `json:"items,omitempty" example:"user-1,user-2"`
+	Registers []byte   `json:"registers,omitempty" swaggertype:"string" format:"base64"`
+	// Cardinality is estimated by the server on read and ignored on update.
+	Cardinality *uint64 `json:"cardinality,omitempty" example:"2"`
+}
+
+// Info carries a short text like a version and labels like build metadata. An update replaces the stored info.
+type Info struct {
+	Text   string            `json:"text,omitempty" example:"1.4.2"`
+	Labels map[string]string `json:"labels,omitempty"`
 }
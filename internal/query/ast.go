@@ -0,0 +1,206 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expr is a parsed query expression.
+type Expr interface {
+	String() string
+}
+
+// NumberLiteral is a number like 100 or 0.5.
+type NumberLiteral struct {
+	Value float64
+}
+
+// VectorSelector selects the series matching all matchers, the metric name is a matcher of the __name__ label.
+// Range is set for a range selector like cpu[5m], which is only allowed as a function argument.
+type VectorSelector struct {
+	Matchers []*Matcher
+	Range    time.Duration
+}
+
+// Call is a range function like rate(requests[5m]).
+type Call struct {
+	Func string
+	Arg  *VectorSelector
+}
+
+// Aggregate is an aggregation like sum by (type) (expr).
+type Aggregate struct {
+	Op   string
+	By   []string
+	Expr Expr
+}
+
+// Binary is an arithmetic operation between two expressions.
+type Binary struct {
+	Op       string
+	LHS, RHS Expr
+}
+
+// MatchType is the comparison of a label matcher.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher matches the value of a label. A missing label has an empty value.
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewMatcher returns a label matcher, the regular expression of a regexp matcher must match the whole value.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Name: name, Type: t, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches reports whether the label value matches.
+func (m *Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// MatchLabels reports whether the labels match all matchers.
+func MatchLabels(matchers []*Matcher, labels Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Matcher) String() string {
+	return m.Name + string(m.Type) + strconv.Quote(m.Value)
+}
+
+func (n *NumberLiteral) String() string {
+	return strconv.FormatFloat(n.Value, 'g', -1, 64)
+}
+
+func (s *VectorSelector) String() string {
+	var name string
+	matchers := make([]string, 0, len(s.Matchers))
+	for _, m := range s.Matchers {
+		if m.Name == NameLabel && m.Type == MatchEqual && len(name) == 0 {
+			name = m.Value
+			continue
+		}
+		matchers = append(matchers, m.String())
+	}
+
+	str := name
+	if len(matchers) > 0 || len(name) == 0 {
+		str += "{" + strings.Join(matchers, ",") + "}"
+	}
+	if s.Range > 0 {
+		str += "[" + formatDuration(s.Range) + "]"
+	}
+	return str
+}
+
+func (c *Call) String() string {
+	return c.Func + "(" + c.Arg.String() + ")"
+}
+
+func (a *Aggregate) String() string {
+	if len(a.By) == 0 {
+		return a.Op + "(" + a.Expr.String() + ")"
+	}
+	return fmt.Sprintf("%s by (%s) (%s)", a.Op, strings.Join(a.By, ", "), a.Expr)
+}
+
+func (b *Binary) String() string {
+	return "(" + b.LHS.String() + " " + b.Op + " " + b.RHS.String() + ")"
+}
+
+// durationUnits are the units of a duration like 1h30m, from the largest.
+var durationUnits = []struct {
+	unit string
+	d    time.Duration
+}{
+	{"w", 7 * 24 * time.Hour},
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+}
+
+// parseDuration parses a duration like 5m, 1h30m or 7d. Units must go from the largest to the smallest.
+func parseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	last := -1
+	for len(s) > 0 {
+		i := 0
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		j := i
+		for j < len(s) && isLetter(s[j]) {
+			j++
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if i == 0 || err != nil {
+			return 0, fmt.Errorf("invalid duration")
+		}
+
+		unit := -1
+		for k := range durationUnits {
+			if durationUnits[k].unit == s[i:j] {
+				unit = k
+			}
+		}
+		if unit <= last {
+			return 0, fmt.Errorf("invalid duration unit %q", s[i:j])
+		}
+		last = unit
+		d += time.Duration(n) * durationUnits[unit].d
+		s = s[j:]
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive")
+	}
+	return d, nil
+}
+
+func formatDuration(d time.Duration) string {
+	var s string
+	for _, u := range durationUnits {
+		if n := d / u.d; n > 0 {
+			s += strconv.FormatInt(int64(n), 10) + u.unit
+			d -= n * u.d
+		}
+	}
+	return s
+}
@@ -0,0 +1,327 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LookbackDelta is how old the last sample of a series may be to be selected by an instant selector.
+const LookbackDelta = 5 * time.Minute
+
+// Labels identify a series.
+type Labels map[string]string
+
+// Point is a sample of a series.
+type Point struct {
+	T time.Time
+	V float64
+}
+
+// Series is a labeled list of points sorted by time.
+type Series struct {
+	Labels Labels
+	Points []Point
+}
+
+// Storage returns the series matching all matchers with their points in the time range [start, end].
+type Storage interface {
+	Select(ctx context.Context, matchers []*Matcher, start, end time.Time) ([]Series, error)
+}
+
+// Value is the result of a query, a Scalar or a Vector.
+type Value interface {
+	Type() string
+}
+
+// Scalar is a single number.
+type Scalar float64
+
+// Sample is one value of a vector.
+type Sample struct {
+	Labels Labels
+	V      float64
+}
+
+// Vector is a set of samples with distinct labels, all at the evaluation time.
+type Vector []Sample
+
+func (Scalar) Type() string { return "scalar" }
+func (Vector) Type() string { return "vector" }
+
+// Query parses the query and evaluates it at the time t.
+func Query(ctx context.Context, s Storage, input string, t time.Time) (Value, error) {
+	expr, err := Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	return Eval(ctx, s, expr, t)
+}
+
+// Eval evaluates the expression at the time t. The samples of a vector are sorted by their labels.
+func Eval(ctx context.Context, s Storage, expr Expr, t time.Time) (Value, error) {
+	ev := &evaluator{ctx: ctx, storage: s, t: t}
+	v, err := ev.eval(expr)
+	if err != nil {
+		return nil, err
+	}
+	if vec, ok := v.(Vector); ok {
+		sort.Slice(vec, func(i, j int) bool { return vec[i].Labels.String() < vec[j].Labels.String() })
+	}
+	return v, nil
+}
+
+type evaluator struct {
+	ctx     context.Context
+	storage Storage
+	t       time.Time
+}
+
+func (ev *evaluator) eval(expr Expr) (Value, error) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return Scalar(e.Value), nil
+	case *VectorSelector:
+		if e.Range > 0 {
+			return nil, fmt.Errorf("%w: range selector %s must be an argument of a function", ErrInvalidQuery, e)
+		}
+		return ev.instant(e)
+	case *Call:
+		return ev.call(e)
+	case *Aggregate:
+		return ev.aggregate(e)
+	case *Binary:
+		return ev.binary(e)
+	}
+	return nil, fmt.Errorf("%w: unknown expression %s", ErrInvalidQuery, expr)
+}
+
+// instant selects the last point of every series not older than LookbackDelta.
+func (ev *evaluator) instant(s *VectorSelector) (Value, error) {
+	series, err := ev.storage.Select(ev.ctx, s.Matchers, ev.t.Add(-LookbackDelta), ev.t)
+	if err != nil {
+		return nil, err
+	}
+
+	vec := make(Vector, 0, len(series))
+	for _, ser := range series {
+		points := window(ser.Points, ev.t.Add(-LookbackDelta), ev.t)
+		if len(points) > 0 {
+			vec = append(vec, Sample{Labels: ser.Labels, V: points[len(points)-1].V})
+		}
+	}
+	return vec, nil
+}
+
+// call applies a range function to the points of every series in the range before the evaluation time.
+// rate and increase need at least two points and are not extrapolated to the range borders:
+// increase is the growth between the first and the last point adjusted for counter resets,
+// rate is that growth per second between them.
+func (ev *evaluator) call(c *Call) (Value, error) {
+	start := ev.t.Add(-c.Arg.Range)
+	series, err := ev.storage.Select(ev.ctx, c.Arg.Matchers, start, ev.t)
+	if err != nil {
+		return nil, err
+	}
+
+	vec := make(Vector, 0, len(series))
+	for _, ser := range series {
+		points := window(ser.Points, start, ev.t)
+		var v float64
+		switch c.Func {
+		case "avg_over_time":
+			if len(points) == 0 {
+				continue
+			}
+			for _, p := range points {
+				v += p.V
+			}
+			v /= float64(len(points))
+		case "rate", "increase":
+			if len(points) < 2 {
+				continue
+			}
+			v = points[len(points)-1].V - points[0].V
+			for i := 1; i < len(points); i++ {
+				if points[i].V < points[i-1].V {
+					v += points[i-1].V
+				}
+			}
+			if c.Func == "rate" {
+				v /= points[len(points)-1].T.Sub(points[0].T).Seconds()
+			}
+		}
+		vec = append(vec, Sample{Labels: ser.Labels.without(NameLabel), V: v})
+	}
+	return vec, nil
+}
+
+func (ev *evaluator) aggregate(a *Aggregate) (Value, error) {
+	v, err := ev.eval(a.Expr)
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := v.(Vector)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s expects a vector", ErrInvalidQuery, a.Op)
+	}
+
+	type group struct {
+		labels Labels
+		value  float64
+		count  int
+	}
+	groups := make(map[string]*group)
+	for _, s := range vec {
+		labels := s.Labels.only(a.By)
+		key := labels.String()
+		g, ok := groups[key]
+		if !ok {
+			groups[key] = &group{labels: labels, value: s.V, count: 1}
+			continue
+		}
+		g.count++
+		switch a.Op {
+		case "sum", "avg":
+			g.value += s.V
+		case "max":
+			g.value = math.Max(g.value, s.V)
+		case "min":
+			g.value = math.Min(g.value, s.V)
+		}
+	}
+
+	result := make(Vector, 0, len(groups))
+	for _, g := range groups {
+		if a.Op == "avg" {
+			g.value /= float64(g.count)
+		}
+		result = append(result, Sample{Labels: g.labels, V: g.value})
+	}
+	return result, nil
+}
+
+// binary applies an arithmetic operation. Two vectors are matched by their labels without the metric name,
+// the samples without a match are dropped. The result does not keep the metric name.
+func (ev *evaluator) binary(b *Binary) (Value, error) {
+	lhs, err := ev.eval(b.LHS)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(b.RHS)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			return Scalar(apply(b.Op, float64(l), float64(r))), nil
+		case Vector:
+			result := make(Vector, 0, len(r))
+			for _, s := range r {
+				result = append(result, Sample{Labels: s.Labels.without(NameLabel), V: apply(b.Op, float64(l), s.V)})
+			}
+			return result, nil
+		}
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			result := make(Vector, 0, len(l))
+			for _, s := range l {
+				result = append(result, Sample{Labels: s.Labels.without(NameLabel), V: apply(b.Op, s.V, float64(r))})
+			}
+			return result, nil
+		case Vector:
+			right := make(map[string]Sample, len(r))
+			for _, s := range r {
+				key := s.Labels.without(NameLabel).String()
+				if _, ok := right[key]; ok {
+					return nil, fmt.Errorf("%w: many samples with labels %s on the right side of %s", ErrInvalidQuery, key, b.Op)
+				}
+				right[key] = s
+			}
+
+			result := make(Vector, 0, len(l))
+			seen := make(map[string]bool, len(l))
+			for _, s := range l {
+				labels := s.Labels.without(NameLabel)
+				key := labels.String()
+				if seen[key] {
+					return nil, fmt.Errorf("%w: many samples with labels %s on the left side of %s", ErrInvalidQuery, key, b.Op)
+				}
+				seen[key] = true
+				if rs, ok := right[key]; ok {
+					result = append(result, Sample{Labels: labels, V: apply(b.Op, s.V, rs.V)})
+				}
+			}
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unexpected operands of %s", ErrInvalidQuery, b.Op)
+}
+
+func apply(op string, l, r float64) float64 {
+	switch op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		return l / r
+	}
+	return math.NaN()
+}
+
+// window returns the points in the time range (start, end].
+func window(points []Point, start, end time.Time) []Point {
+	from := sort.Search(len(points), func(i int) bool { return points[i].T.After(start) })
+	to := sort.Search(len(points), func(i int) bool { return points[i].T.After(end) })
+	return points[from:to]
+}
+
+// String returns the labels sorted by name like {name="value", ...}.
+func (l Labels) String() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s=%q", name, l[name])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (l Labels) without(name string) Labels {
+	c := make(Labels, len(l))
+	for n, v := range l {
+		if n != name {
+			c[n] = v
+		}
+	}
+	return c
+}
+
+func (l Labels) only(names []string) Labels {
+	c := make(Labels, len(names))
+	for _, n := range names {
+		if v, ok := l[n]; ok {
+			c[n] = v
+		}
+	}
+	return c
+}
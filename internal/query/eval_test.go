@@ -0,0 +1,108 @@
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testStorage []Series
+
+func (s testStorage) Select(_ context.Context, matchers []*Matcher, _, _ time.Time) ([]Series, error) {
+	var result []Series
+	for _, ser := range s {
+		if MatchLabels(matchers, ser.Labels) {
+			result = append(result, ser)
+		}
+	}
+	return result, nil
+}
+
+var testNow = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func points(step time.Duration, values ...float64) []Point {
+	result := make([]Point, len(values))
+	for i, v := range values {
+		result[i] = Point{T: testNow.Add(-time.Duration(len(values)-1-i) * step), V: v}
+	}
+	return result
+}
+
+func testSeries() testStorage {
+	return testStorage{
+		{Labels: Labels{NameLabel: "requests", "host": "a", "type": "counter"}, Points: points(time.Minute, 0, 60, 120, 30, 90)},
+		{Labels: Labels{NameLabel: "requests", "host": "b", "type": "counter"}, Points: points(time.Minute, 10, 20)},
+		{Labels: Labels{NameLabel: "cpu", "host": "a", "type": "gauge"}, Points: points(time.Minute, 10, 20, 30)},
+		{Labels: Labels{NameLabel: "cpu", "host": "b", "type": "gauge"}, Points: points(time.Minute, 50)},
+		{Labels: Labels{NameLabel: "cpu", "host": "c", "type": "gauge"}, Points: []Point{{T: testNow.Add(-time.Hour), V: 99}}},
+		{Labels: Labels{NameLabel: "total", "host": "a"}, Points: points(time.Minute, 200)},
+		{Labels: Labels{NameLabel: "total", "host": "b"}, Points: points(time.Minute, 100)},
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Value
+	}{
+		{`cpu`, Vector{
+			{Labels: Labels{NameLabel: "cpu", "host": "a", "type": "gauge"}, V: 30},
+			{Labels: Labels{NameLabel: "cpu", "host": "b", "type": "gauge"}, V: 50},
+		}},
+		{`cpu{host=~"a|c"}`, Vector{{Labels: Labels{NameLabel: "cpu", "host": "a", "type": "gauge"}, V: 30}}},
+		{`{type="counter", host!="a"}`, Vector{{Labels: Labels{NameLabel: "requests", "host": "b", "type": "counter"}, V: 20}}},
+		// the counter of the host a was reset from 120 to 30
+		{`increase(requests[10m])`, Vector{
+			{Labels: Labels{"host": "a", "type": "counter"}, V: 210},
+			{Labels: Labels{"host": "b", "type": "counter"}, V: 10},
+		}},
+		{`rate(requests{host="a"}[10m])`, Vector{{Labels: Labels{"host": "a", "type": "counter"}, V: 210.0 / 240}}},
+		{`rate(requests{host="a"}[1m])`, Vector{}},
+		{`avg_over_time(cpu[2h])`, Vector{
+			{Labels: Labels{"host": "a", "type": "gauge"}, V: 20},
+			{Labels: Labels{"host": "b", "type": "gauge"}, V: 50},
+			{Labels: Labels{"host": "c", "type": "gauge"}, V: 99},
+		}},
+		{`sum(cpu)`, Vector{{Labels: Labels{}, V: 80}}},
+		{`avg by (type) ({type=~".+"})`, Vector{
+			{Labels: Labels{"type": "counter"}, V: 55},
+			{Labels: Labels{"type": "gauge"}, V: 40},
+		}},
+		{`max(cpu) by (type)`, Vector{{Labels: Labels{"type": "gauge"}, V: 50}}},
+		{`min by (host) (cpu)`, Vector{
+			{Labels: Labels{"host": "a"}, V: 30},
+			{Labels: Labels{"host": "b"}, V: 50},
+		}},
+		{`cpu{host="a"} * 2 - 10`, Vector{{Labels: Labels{"host": "a", "type": "gauge"}, V: 50}}},
+		{`100 * sum by (host) (cpu) / sum by (host) (total)`, Vector{
+			{Labels: Labels{"host": "a"}, V: 15},
+			{Labels: Labels{"host": "b"}, V: 50},
+		}},
+		{`cpu + requests`, Vector{}},
+		{`(1 + 2) * -3`, Scalar(-9)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			v, err := Query(context.Background(), testSeries(), tt.query, testNow)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, v)
+		})
+	}
+}
+
+func TestQuery_Errors(t *testing.T) {
+	// the series differ only by the name, which is dropped to match the sides of an operation
+	storage := append(testSeries(), Series{Labels: Labels{NameLabel: "total2", "host": "a"}, Points: points(time.Minute, 1)})
+	for _, query := range []string{
+		`cpu[5m]`,
+		`sum(1)`,
+		`{__name__=~"total.*"} / 2 + cpu`,
+		`cpu + {__name__=~"total.*"}`,
+	} {
+		_, err := Query(context.Background(), storage, query, testNow)
+		assert.ErrorIs(t, err, ErrInvalidQuery, "query %q", query)
+	}
+}
@@ -0,0 +1,115 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokDuration
+	tokPunct
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	if t.typ == tokEOF {
+		return "end of input"
+	}
+	return strconv.Quote(t.val)
+}
+
+// lex splits the query into tokens. A duration is only expected right after "[".
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case len(tokens) > 0 && tokens[len(tokens)-1].val == "[" && tokens[len(tokens)-1].typ == tokPunct:
+			j := i
+			for j < len(input) && (isDigit(input[j]) || isLetter(input[j])) {
+				j++
+			}
+			if j == i {
+				return nil, errorAt(i, "duration expected")
+			}
+			tokens = append(tokens, token{tokDuration, input[i:j], i})
+			i = j
+		case isDigit(c) || c == '.' && i+1 < len(input) && isDigit(input[i+1]):
+			j := i
+			for j < len(input) && (isDigit(input[j]) || input[j] == '.' ||
+				(input[j] == 'e' || input[j] == 'E') ||
+				(input[j] == '+' || input[j] == '-') && (input[j-1] == 'e' || input[j-1] == 'E')) {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, input[i:j], i})
+			i = j
+		case isLetter(c) || c == '_' || c == ':':
+			j := i
+			for j < len(input) && (isLetter(input[j]) || isDigit(input[j]) || input[j] == '_' || input[j] == ':') {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, input[i:j], i})
+			i = j
+		case c == '"' || c == '\'':
+			s, n, err := lexString(input[i:])
+			if err != nil {
+				return nil, errorAt(i, err.Error())
+			}
+			tokens = append(tokens, token{tokString, s, i})
+			i += n
+		case strings.HasPrefix(input[i:], "!=") || strings.HasPrefix(input[i:], "=~") || strings.HasPrefix(input[i:], "!~"):
+			tokens = append(tokens, token{tokPunct, input[i : i+2], i})
+			i += 2
+		case strings.IndexByte("+-*/(){}[],=", c) >= 0:
+			tokens = append(tokens, token{tokPunct, input[i : i+1], i})
+			i++
+		default:
+			return nil, errorAt(i, fmt.Sprintf("unexpected character %q", rune(c)))
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(input)}), nil
+}
+
+// lexString reads a string in double or single quotes with Go escapes and returns it with the length of its source.
+func lexString(input string) (string, int, error) {
+	quote := input[0]
+	for i := 1; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case quote:
+			raw := input[1:i]
+			if quote == '\'' {
+				raw = strings.ReplaceAll(strings.ReplaceAll(raw, `\'`, `'`), `"`, `\"`)
+			}
+			s, err := strconv.Unquote(`"` + raw + `"`)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s", input[:i+1])
+			}
+			return s, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
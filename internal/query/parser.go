@@ -0,0 +1,297 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// NameLabel is the label holding the metric name.
+const NameLabel = "__name__"
+
+// ErrInvalidQuery is wrapped by the errors of a query that cannot be parsed or evaluated.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// functions are the range functions, aggregations are the aggregation operators.
+var (
+	functions    = map[string]bool{"rate": true, "increase": true, "avg_over_time": true}
+	aggregations = map[string]bool{"sum": true, "avg": true, "max": true, "min": true}
+)
+
+func errorAt(pos int, msg string) error {
+	return fmt.Errorf("%w: %s at position %d", ErrInvalidQuery, msg, pos)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a query. The grammar, from the lowest precedence:
+//
+//	expr      = term { ("+" | "-") term }
+//	term      = unary { ("*" | "/") unary }
+//	unary     = "-" unary | primary
+//	primary   = number | "(" expr ")" | aggregate | call | selector
+//	aggregate = ("sum" | "avg" | "max" | "min") [ by ] "(" expr ")" [ by ]
+//	by        = "by" "(" [ label { "," label } ] ")"
+//	call      = ("rate" | "increase" | "avg_over_time") "(" selector ")"
+//	selector  = name [ "{" matchers "}" ] [ "[" duration "]" ] | "{" matchers "}" [ "[" duration "]" ]
+//	matchers  = [ label ("=" | "!=" | "=~" | "!~") string { "," ... } ]
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokEOF {
+		return nil, errorAt(t.pos, "unexpected "+t.String())
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isPunct(val string) bool {
+	t := p.peek()
+	return t.typ == tokPunct && t.val == val
+}
+
+func (p *parser) expect(val string) error {
+	if t := p.next(); t.typ != tokPunct || t.val != val {
+		return errorAt(t.pos, fmt.Sprintf("%q expected, got %s", val, t))
+	}
+	return nil
+}
+
+func (p *parser) expr() (Expr, error) {
+	lhs, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("+") || p.isPunct("-") {
+		op := p.next().val
+		rhs, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: op, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) term() (Expr, error) {
+	lhs, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("*") || p.isPunct("/") {
+		op := p.next().val
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: op, LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) unary() (Expr, error) {
+	if p.isPunct("-") {
+		p.next()
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := expr.(*NumberLiteral); ok {
+			return &NumberLiteral{Value: -n.Value}, nil
+		}
+		return &Binary{Op: "*", LHS: &NumberLiteral{Value: -1}, RHS: expr}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (Expr, error) {
+	t := p.peek()
+	switch {
+	case t.typ == tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, errorAt(t.pos, "invalid number "+t.String())
+		}
+		return &NumberLiteral{Value: v}, nil
+	case p.isPunct("("):
+		p.next()
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	case p.isPunct("{"):
+		return p.selector("")
+	case t.typ == tokIdent:
+		p.next()
+		next := p.peek()
+		switch {
+		case aggregations[t.val] && (p.isPunct("(") || next.typ == tokIdent && next.val == "by"):
+			return p.aggregate(t.val)
+		case functions[t.val] && p.isPunct("("):
+			return p.call(t.val)
+		}
+		return p.selector(t.val)
+	}
+	return nil, errorAt(t.pos, "unexpected "+t.String())
+}
+
+func (p *parser) aggregate(op string) (Expr, error) {
+	agg := &Aggregate{Op: op}
+	var err error
+	if t := p.peek(); t.typ == tokIdent && t.val == "by" {
+		if agg.By, err = p.by(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expect("("); err != nil {
+		return nil, err
+	}
+	if agg.Expr, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if err = p.expect(")"); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ == tokIdent && t.val == "by" {
+		if agg.By != nil {
+			return nil, errorAt(t.pos, "by is given twice")
+		}
+		if agg.By, err = p.by(); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+func (p *parser) by() ([]string, error) {
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0)
+	for !p.isPunct(")") {
+		if len(labels) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		t := p.next()
+		if t.typ != tokIdent {
+			return nil, errorAt(t.pos, "label name expected, got "+t.String())
+		}
+		labels = append(labels, t.val)
+	}
+	p.next()
+	return labels, nil
+}
+
+func (p *parser) call(name string) (Expr, error) {
+	p.next()
+	t := p.peek()
+	var arg Expr
+	var err error
+	switch {
+	case p.isPunct("{"):
+		arg, err = p.selector("")
+	case t.typ == tokIdent:
+		p.next()
+		arg, err = p.selector(t.val)
+	default:
+		return nil, errorAt(t.pos, name+" expects a range selector")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := arg.(*VectorSelector)
+	if s.Range == 0 {
+		return nil, errorAt(t.pos, name+" expects a range selector like "+s.String()+"[5m]")
+	}
+	return &Call{Func: name, Arg: s}, p.expect(")")
+}
+
+func (p *parser) selector(name string) (Expr, error) {
+	s := &VectorSelector{}
+	if len(name) > 0 {
+		m, _ := NewMatcher(MatchEqual, NameLabel, name)
+		s.Matchers = append(s.Matchers, m)
+	}
+
+	if p.isPunct("{") {
+		start := p.next()
+		for i := 0; !p.isPunct("}"); i++ {
+			if i > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			m, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			s.Matchers = append(s.Matchers, m)
+		}
+		p.next()
+		if len(s.Matchers) == 0 {
+			return nil, errorAt(start.pos, "a selector must have a name or a matcher")
+		}
+	}
+
+	if p.isPunct("[") {
+		p.next()
+		t := p.next()
+		d, err := parseDuration(t.val)
+		if t.typ != tokDuration || err != nil {
+			return nil, errorAt(t.pos, "invalid range "+t.String())
+		}
+		s.Range = d
+		if err = p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) matcher() (*Matcher, error) {
+	name := p.next()
+	if name.typ != tokIdent {
+		return nil, errorAt(name.pos, "label name expected, got "+name.String())
+	}
+	op := p.next()
+	switch MatchType(op.val) {
+	case MatchEqual, MatchNotEqual, MatchRegexp, MatchNotRegexp:
+	default:
+		return nil, errorAt(op.pos, "label matcher expected, got "+op.String())
+	}
+	value := p.next()
+	if value.typ != tokString {
+		return nil, errorAt(value.pos, "string expected, got "+value.String())
+	}
+	m, err := NewMatcher(MatchType(op.val), name.val, value.val)
+	if err != nil {
+		return nil, errorAt(value.pos, err.Error())
+	}
+	return m, nil
+}
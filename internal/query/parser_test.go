@@ -0,0 +1,76 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`PollCount`, `PollCount`},
+		{`{__name__=~"CPU.*", type="gauge"}`, `{__name__=~"CPU.*",type="gauge"}`},
+		{`probe_success{target!='db'}`, `probe_success{target!="db"}`},
+		{`rate(PollCount[1m30s])`, `rate(PollCount[1m30s])`},
+		{`avg_over_time({type="gauge"}[1h])`, `avg_over_time({type="gauge"}[1h])`},
+		{`sum by (type) (Alloc)`, `sum by (type) (Alloc)`},
+		{`max(CPUutilization1) by (host, type)`, `max by (host, type) (CPUutilization1)`},
+		{`min(Alloc)`, `min(Alloc)`},
+		{`1 + 2 * 3`, `(1 + (2 * 3))`},
+		{`(1 + 2) * 3`, `((1 + 2) * 3)`},
+		{`TotalMemory - FreeMemory / TotalMemory`, `(TotalMemory - (FreeMemory / TotalMemory))`},
+		{`-Alloc`, `(-1 * Alloc)`},
+		{`- 2.5e3`, `-2500`},
+		{`sum`, `sum`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			expr, err := Parse(tt.input)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, expr.String())
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, input := range []string{
+		``,
+		`Alloc +`,
+		`rate(Alloc)`,
+		`rate(1)`,
+		`Alloc[5x]`,
+		`Alloc[5s1m]`,
+		`{}`,
+		`Alloc{type}`,
+		`Alloc{type=gauge}`,
+		`Alloc{type="gauge"`,
+		`Alloc{type=~"("}`,
+		`sum by (type) (Alloc) by (type)`,
+		`"unterminated`,
+		`Alloc # comment`,
+		`(Alloc`,
+	} {
+		_, err := Parse(input)
+		assert.ErrorIs(t, err, ErrInvalidQuery, "query %q", input)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	d, err := parseDuration("1d12h")
+	require.NoError(t, err)
+	assert.Equal(t, 36*time.Hour, d)
+
+	d, err = parseDuration("1w500ms")
+	require.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour+500*time.Millisecond, d)
+
+	for _, s := range []string{"", "5", "m", "0s", "1m1h", "1s1s"} {
+		_, err = parseDuration(s)
+		assert.Error(t, err, "duration %q", s)
+	}
+}
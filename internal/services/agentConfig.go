@@ -0,0 +1,88 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+var (
+	ErrNoAgentConfig      = errors.New("there is no config for the agent")
+	ErrInvalidAgentConfig = errors.New("invalid agent config")
+)
+
+// ValidateAgentConfigRule checks that the rule has an ID, selects agents and has valid intervals.
+func ValidateAgentConfigRule(rule models.AgentConfigRule) error {
+	if len(rule.ID) == 0 {
+		return fmt.Errorf("%w: the rule has no id", ErrInvalidAgentConfig)
+	}
+	for _, interval := range []string{rule.Config.PollInterval, rule.Config.ReportInterval} {
+		if len(interval) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%w: interval %q", ErrInvalidAgentConfig, interval)
+		}
+	}
+	return nil
+}
+
+// matchAgentConfig chooses the rule for the agent. A rule for the agent ID wins over label selectors,
+// among the selectors the one with more labels wins. A rule without agent and labels matches every agent.
+func matchAgentConfig(rules []models.AgentConfigRule, agentID string, labels map[string]string) (*models.AgentConfig, error) {
+	sorted := make([]models.AgentConfigRule, len(rules))
+	copy(sorted, rules)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	var best *models.AgentConfigRule
+	bestScore := -1
+	for i := range sorted {
+		rule := &sorted[i]
+		score := len(rule.Labels)
+		if len(rule.Agent) > 0 {
+			if rule.Agent != agentID {
+				continue
+			}
+			score = 1 << 30
+		}
+
+		matches := true
+		for k, v := range rule.Labels {
+			if labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches && score > bestScore {
+			best = rule
+			bestScore = score
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoAgentConfig
+	}
+	return &best.Config, nil
+}
+
+// ParseLabels parses labels written as "key=value,key=value".
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || len(strings.TrimSpace(k)) == 0 {
+			return nil, fmt.Errorf("label %q must look like key=value", pair)
+		}
+		labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAgentConfigRules() []models.AgentConfigRule {
+	return []models.AgentConfigRule{
+		{ID: "default", Config: models.AgentConfig{PollInterval: "5s"}},
+		{ID: "web", Labels: map[string]string{"role": "web"}, Config: models.AgentConfig{PollInterval: "2s"}},
+		{ID: "web-eu", Labels: map[string]string{"role": "web", "region": "eu"}, Config: models.AgentConfig{PollInterval: "1s"}},
+		{ID: "web-01", Agent: "web-01", Config: models.AgentConfig{PollInterval: "500ms"}},
+	}
+}
+
+func TestMatchAgentConfig(t *testing.T) {
+	rules := testAgentConfigRules()
+
+	testCases := []struct {
+		name     string
+		agentID  string
+		labels   map[string]string
+		expected string
+	}{
+		{"agent rule wins", "web-01", map[string]string{"role": "web", "region": "eu"}, "500ms"},
+		{"more labels win", "web-02", map[string]string{"role": "web", "region": "eu"}, "1s"},
+		{"one label", "web-03", map[string]string{"role": "web", "region": "us"}, "2s"},
+		{"default rule", "db-01", map[string]string{"role": "db"}, "5s"},
+		{"no labels", "db-02", nil, "5s"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := matchAgentConfig(rules, tc.agentID, tc.labels)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, config.PollInterval)
+		})
+	}
+
+	_, err := matchAgentConfig(rules[1:2], "db-01", nil)
+	assert.ErrorIs(t, err, ErrNoAgentConfig)
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels(" role=web, region = eu ,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"role": "web", "region": "eu"}, labels)
+
+	_, err = ParseLabels("role")
+	assert.Error(t, err)
+}
+
+func TestValidateAgentConfigRule(t *testing.T) {
+	assert.NoError(t, ValidateAgentConfigRule(models.AgentConfigRule{ID: "web"}))
+	assert.ErrorIs(t, ValidateAgentConfigRule(models.AgentConfigRule{}), ErrInvalidAgentConfig)
+	assert.ErrorIs(t, ValidateAgentConfigRule(models.AgentConfigRule{
+		ID: "web", Config: models.AgentConfig{ReportInterval: "soon"},
+	}), ErrInvalidAgentConfig)
+	assert.ErrorIs(t, ValidateAgentConfigRule(models.AgentConfigRule{
+		ID: "web", Config: models.AgentConfig{PollInterval: "-1s"},
+	}), ErrInvalidAgentConfig)
+}
+
+func TestFileRepository_AgentConfig(t *testing.T) {
+	storeFile := filepath.Join(t.TempDir(), "metrics.json")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	repo := NewFileRepository(storeFile, time.Second, "")
+	for _, rule := range testAgentConfigRules() {
+		require.NoError(t, repo.SetAgentConfig(ctx, rule))
+	}
+	require.NoError(t, repo.SetAgentConfig(ctx, models.AgentConfigRule{
+		ID: "default", Config: models.AgentConfig{PollInterval: "10s"},
+	}))
+
+	// the rules are read back by a new repository
+	repo = NewFileRepository(storeFile, time.Second, "")
+	config, err := repo.GetAgentConfig(ctx, "db-01", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10s", config.PollInterval)
+
+	config, err = repo.GetAgentConfig(ctx, "web-01", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "500ms", config.PollInterval)
+}
+
+func TestDBRepository_AgentConfig(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	repo := &dbRepository{db: db}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mock.ExpectExec("insert into agent_configs(.+)").
+		WithArgs("web", "", `{"role":"web"}`, `{"poll_interval":"2s"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	err = repo.SetAgentConfig(ctx, models.AgentConfigRule{
+		ID: "web", Labels: map[string]string{"role": "web"}, Config: models.AgentConfig{PollInterval: "2s"},
+	})
+	require.NoError(t, err)
+
+	rows := sqlmock.NewRows([]string{"id", "agent", "labels", "config"}).
+		AddRow("default", "", `{}`, `{"poll_interval":"5s"}`).
+		AddRow("web", "", `{"role":"web"}`, `{"poll_interval":"2s","collectors":["runtime"]}`)
+	mock.ExpectQuery("^select (.+) from agent_configs$").WillReturnRows(rows)
+
+	config, err := repo.GetAgentConfig(ctx, "web-01", map[string]string{"role": "web"})
+	require.NoError(t, err)
+	assert.Equal(t, "2s", config.PollInterval)
+	assert.Equal(t, []string{"runtime"}, config.Collectors)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
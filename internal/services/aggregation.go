@@ -0,0 +1,152 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+// aggregationRule selects the gauges whose ID fully matches the pattern and the statistics sent for them.
+type aggregationRule struct {
+	pattern *regexp.Regexp
+	stats   []string
+}
+
+// aggregator keeps the gauge values polled during the report window
+// and replaces the last polled value with the statistics over the window.
+type aggregator struct {
+	rules   []aggregationRule
+	samples map[string][]float64
+}
+
+// newAggregator parses aggregation rules of the form "pattern=stat,stat;pattern=stat".
+// Supported statistics are min, max, avg, last and percentiles like p50 or p99.9.
+func newAggregator(rules string) (*aggregator, error) {
+	a := &aggregator{
+		rules:   make([]aggregationRule, 0),
+		samples: make(map[string][]float64),
+	}
+
+	for _, rule := range strings.Split(rules, ";") {
+		rule = strings.TrimSpace(rule)
+		if len(rule) == 0 {
+			continue
+		}
+
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("aggregation rule %q must look like pattern=stat,stat", rule)
+		}
+
+		pattern, err := regexp.Compile("^(?:" + rule[:i] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("aggregation rule %q: %w", rule, err)
+		}
+
+		stats := strings.Split(rule[i+1:], ",")
+		for j := range stats {
+			stats[j] = strings.TrimSpace(stats[j])
+			if _, err = statistic(stats[j], []float64{0}); err != nil {
+				return nil, fmt.Errorf("aggregation rule %q: %w", rule, err)
+			}
+		}
+
+		a.rules = append(a.rules, aggregationRule{pattern: pattern, stats: stats})
+	}
+	return a, nil
+}
+
+// observe saves the values of the gauges matched by the rules.
+func (a *aggregator) observe(metrics []models.Metric) {
+	for _, m := range metrics {
+		if m.MType != Gauge || m.Value == nil || a.rule(m.ID) == nil {
+			continue
+		}
+		a.samples[m.ID] = append(a.samples[m.ID], *m.Value)
+	}
+}
+
+// apply replaces every matched gauge with its statistics over the window and starts a new window.
+// The last value keeps the name of the gauge, the others get the statistic as a suffix, e.g. Alloc_max.
+func (a *aggregator) apply(metrics []models.Metric) []models.Metric {
+	if len(a.rules) == 0 {
+		return metrics
+	}
+
+	result := make([]models.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		rule := a.rule(m.ID)
+		samples := a.samples[m.ID]
+		if m.MType != Gauge || rule == nil || len(samples) == 0 {
+			result = append(result, m)
+			continue
+		}
+
+		for _, stat := range rule.stats {
+			value, _ := statistic(stat, samples)
+			id := m.ID
+			if stat != "last" {
+				id += "_" + stat
+			}
+			result = append(result, models.Metric{ID: id, MType: Gauge, Value: &value})
+		}
+	}
+
+	a.samples = make(map[string][]float64)
+	return result
+}
+
+func (a *aggregator) rule(id string) *aggregationRule {
+	for i := range a.rules {
+		if a.rules[i].pattern.MatchString(id) {
+			return &a.rules[i]
+		}
+	}
+	return nil
+}
+
+// statistic calculates the named statistic over non-empty samples.
+func statistic(stat string, samples []float64) (float64, error) {
+	switch stat {
+	case "last":
+		return samples[len(samples)-1], nil
+	case "min":
+		min := samples[0]
+		for _, v := range samples {
+			min = math.Min(min, v)
+		}
+		return min, nil
+	case "max":
+		max := samples[0]
+		for _, v := range samples {
+			max = math.Max(max, v)
+		}
+		return max, nil
+	case "avg":
+		sum := 0.0
+		for _, v := range samples {
+			sum += v
+		}
+		return sum / float64(len(samples)), nil
+	}
+
+	if !strings.HasPrefix(stat, "p") {
+		return 0, fmt.Errorf("unknown statistic %q", stat)
+	}
+	q, err := strconv.ParseFloat(stat[1:], 64)
+	if err != nil || !(q > 0 && q <= 100) {
+		return 0, fmt.Errorf("percentile %q must be in (p0, p100]", stat)
+	}
+
+	sorted := make([]float64, len(samples))
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+	// nearest-rank method
+	rank := int(math.Ceil(q / 100 * float64(len(sorted))))
+	return sorted[rank-1], nil
+}
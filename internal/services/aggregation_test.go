@@ -0,0 +1,76 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAggregator(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{name: "empty", rules: ""},
+		{name: "valid", rules: `CPUutilization\d+=max,avg; Alloc=p50,p99.9,last`},
+		{name: "invalid regex", rules: `CPU(=max`, wantErr: true},
+		{name: "unknown statistic", rules: `Alloc=median`, wantErr: true},
+		{name: "invalid percentile", rules: `Alloc=p101`, wantErr: true},
+		{name: "zero percentile", rules: `Alloc=p0`, wantErr: true},
+		{name: "NaN percentile", rules: `Alloc=pNaN`, wantErr: true},
+		{name: "no statistics", rules: `Alloc`, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newAggregator(tc.rules)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAggregator_Apply(t *testing.T) {
+	a, err := newAggregator(`CPUutilization\d+=min,max,avg,p50,last`)
+	require.NoError(t, err)
+
+	gauge := func(id string, v float64) models.Metric {
+		return models.Metric{ID: id, MType: Gauge, Value: &v}
+	}
+	for _, v := range []float64{10, 90, 20, 40} {
+		a.observe([]models.Metric{gauge("CPUutilization1", v), gauge("Alloc", v)})
+	}
+
+	delta := int64(3)
+	metrics := a.apply([]models.Metric{
+		gauge("CPUutilization1", 40),
+		gauge("Alloc", 40),
+		{ID: "PollCount", MType: Counter, Delta: &delta},
+	})
+
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		if m.MType == Gauge {
+			values[m.ID] = *m.Value
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"CPUutilization1_min": 10,
+		"CPUutilization1_max": 90,
+		"CPUutilization1_avg": 40,
+		"CPUutilization1_p50": 20,
+		"CPUutilization1":     40,
+		"Alloc":               40,
+	}, values)
+	assert.Len(t, metrics, 7)
+
+	metrics = a.apply([]models.Metric{gauge("CPUutilization1", 5)})
+	assert.Equal(t, []models.Metric{gauge("CPUutilization1", 5)}, metrics, "the window was expected to be reset")
+}
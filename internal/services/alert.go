@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/query"
+)
+
+// States of an alert.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+var ErrInvalidAlertRule = errors.New("invalid alert rule")
+
+// AlertRule fires for every sample of the query result whose value stays above or below the thresholds
+// for the duration For. A scalar result is a single sample without labels.
+type AlertRule struct {
+	Query string
+	Above *float64
+	Below *float64
+	For   time.Duration
+}
+
+// AlertChange is a change of the state of the alert of a sample. Since is when the value crossed the threshold,
+// Value is the last value beyond the threshold.
+type AlertChange struct {
+	State  string
+	Labels query.Labels
+	Value  float64
+	Since  time.Time
+}
+
+// Alert keeps the state of a rule for every sample of its query between the evaluations.
+type Alert struct {
+	rule   AlertRule
+	expr   query.Expr
+	active map[string]*alertSample
+}
+
+type alertSample struct {
+	labels query.Labels
+	value  float64
+	since  time.Time
+	firing bool
+}
+
+// NewAlert checks the rule and returns an alert with no active samples.
+func NewAlert(rule AlertRule) (*Alert, error) {
+	if rule.Above == nil && rule.Below == nil {
+		return nil, fmt.Errorf("%w: a threshold above or below is required", ErrInvalidAlertRule)
+	}
+	if rule.For < 0 {
+		return nil, fmt.Errorf("%w: negative duration %s", ErrInvalidAlertRule, rule.For)
+	}
+	expr, err := query.Parse(rule.Query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAlertRule, err.Error())
+	}
+	return &Alert{rule: rule, expr: expr, active: make(map[string]*alertSample)}, nil
+}
+
+// Eval evaluates the query at the time t and returns the samples that started firing and the firing samples
+// that are no longer beyond the threshold or are gone, sorted by their labels.
+func (a *Alert) Eval(ctx context.Context, s query.Storage, t time.Time) ([]AlertChange, error) {
+	v, err := query.Eval(ctx, s, a.expr, t)
+	if err != nil {
+		return nil, err
+	}
+	var samples query.Vector
+	switch v := v.(type) {
+	case query.Scalar:
+		samples = query.Vector{{Labels: query.Labels{}, V: float64(v)}}
+	case query.Vector:
+		samples = v
+	}
+
+	var changes []AlertChange
+	breached := make(map[string]bool)
+	for _, sample := range samples {
+		if !a.breached(sample.V) {
+			continue
+		}
+		key := sample.Labels.String()
+		breached[key] = true
+		as, ok := a.active[key]
+		if !ok {
+			as = &alertSample{labels: sample.Labels, since: t}
+			a.active[key] = as
+		}
+		as.value = sample.V
+		if !as.firing && t.Sub(as.since) >= a.rule.For {
+			as.firing = true
+			changes = append(changes, AlertChange{State: AlertFiring, Labels: as.labels, Value: as.value, Since: as.since})
+		}
+	}
+	for key, as := range a.active {
+		if breached[key] {
+			continue
+		}
+		delete(a.active, key)
+		if as.firing {
+			changes = append(changes, AlertChange{State: AlertResolved, Labels: as.labels, Value: as.value, Since: as.since})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Labels.String() < changes[j].Labels.String() })
+	return changes, nil
+}
+
+func (a *Alert) breached(v float64) bool {
+	if math.IsNaN(v) {
+		return false
+	}
+	return a.rule.Above != nil && v > *a.rule.Above || a.rule.Below != nil && v < *a.rule.Below
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/query"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlert(t *testing.T) {
+	ctx := context.Background()
+	repo := NewFileRepository("", time.Second, "")
+	storage := NewQueryStorage(repo, nil)
+	set := func(id string, v float64) {
+		t.Helper()
+		_, err := repo.Set(ctx, models.Metric{ID: id, MType: Gauge, Value: &v})
+		require.NoError(t, err)
+	}
+
+	above := 50.0
+	alert, err := NewAlert(AlertRule{Query: `{__name__=~"CPU.*"}`, Above: &above, For: time.Minute})
+	require.NoError(t, err)
+
+	set("CPU1", 60)
+	set("CPU2", 10)
+	start := time.Now()
+	changes, err := alert.Eval(ctx, storage, start)
+	require.NoError(t, err)
+	assert.Empty(t, changes, "the alert was expected to be pending for a minute")
+
+	changes, err = alert.Eval(ctx, storage, start.Add(time.Minute))
+	require.NoError(t, err)
+	cpu1 := query.Labels{query.NameLabel: "CPU1", TypeLabel: Gauge}
+	assert.Equal(t, []AlertChange{{State: AlertFiring, Labels: cpu1, Value: 60, Since: start}}, changes)
+
+	changes, err = alert.Eval(ctx, storage, start.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, changes, "a firing alert was expected to be reported once")
+
+	set("CPU1", 20)
+	changes, err = alert.Eval(ctx, storage, start.Add(3*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []AlertChange{{State: AlertResolved, Labels: cpu1, Value: 60, Since: start}}, changes)
+
+	// a sample that drops below the threshold while pending never fires
+	set("CPU2", 70)
+	_, err = alert.Eval(ctx, storage, start.Add(4*time.Minute))
+	require.NoError(t, err)
+	set("CPU2", 10)
+	changes, err = alert.Eval(ctx, storage, start.Add(5*time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	below := 15.0
+	alert, err = NewAlert(AlertRule{Query: `min({__name__=~"CPU.*"})`, Below: &below})
+	require.NoError(t, err)
+	now := time.Now()
+	changes, err = alert.Eval(ctx, storage, now)
+	require.NoError(t, err)
+	assert.Equal(t, []AlertChange{{State: AlertFiring, Labels: query.Labels{}, Value: 10, Since: now}}, changes,
+		"an alert without a duration was expected to fire at once")
+
+	_, err = NewAlert(AlertRule{Query: `CPU1`})
+	assert.ErrorIs(t, err, ErrInvalidAlertRule)
+	_, err = NewAlert(AlertRule{Query: `rate(`, Above: &above})
+	assert.ErrorIs(t, err, ErrInvalidAlertRule)
+	_, err = NewAlert(AlertRule{Query: `CPU1`, Above: &above, For: -time.Second})
+	assert.ErrorIs(t, err, ErrInvalidAlertRule)
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrRetriable means a batch was not sent but can be sent again later.
+var ErrRetriable = errors.New("temporary sending error")
+
+// retryDelays are the pauses between attempts to send a batch that failed with a retriable error.
+var retryDelays = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
+
+// splitBatch splits metrics into batches of at most maxCount metrics whose JSON array encoding
+// does not exceed maxBytes. A zero or negative limit is not applied. A metric that alone is larger
+// than maxBytes is sent in a batch of its own.
+func splitBatch(metrics []models.Metric, maxCount int, maxBytes int) [][]models.Metric {
+	if maxCount <= 0 && maxBytes <= 0 {
+		return [][]models.Metric{metrics}
+	}
+
+	batches := make([][]models.Metric, 0, 1)
+	batch := make([]models.Metric, 0, len(metrics))
+	// the size of the enclosing brackets of the JSON array
+	size := 2
+
+	for _, m := range metrics {
+		mSize := 0
+		if maxBytes > 0 {
+			b, err := json.Marshal(m)
+			if err != nil {
+				log.Error().Err(err).Msgf("error marshalling metric %s, it will not be sent", m.ID)
+				continue
+			}
+			mSize = len(b)
+			if len(batch) > 0 {
+				// the comma separating the metric from the previous one
+				mSize++
+			}
+		}
+
+		isFull := maxCount > 0 && len(batch) >= maxCount
+		isTooBig := maxBytes > 0 && len(batch) > 0 && size+mSize > maxBytes
+		if isFull || isTooBig {
+			batches = append(batches, batch)
+			batch = nil
+			size = 2
+			if mSize > 0 {
+				mSize--
+			}
+		}
+
+		if maxBytes > 0 && size+mSize > maxBytes {
+			log.Warn().Msgf("metric %s is larger than the batch size limit of %d bytes", m.ID, maxBytes)
+		}
+		batch = append(batch, m)
+		size += mSize
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// sendWithRetry calls send until it succeeds, fails with a non-retriable error or the retries run out.
+func sendWithRetry(ctx context.Context, send func() error) error {
+	err := send()
+	for _, delay := range retryDelays {
+		if err == nil || !isRetriable(err) {
+			return err
+		}
+		log.Warn().Err(err).Msgf("sending failed, retry in %s", delay)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		err = send()
+	}
+	return err
+}
+
+// isRetriable reports whether sending can be tried again after the error.
+func isRetriable(err error) bool {
+	return errors.Is(err, ErrRetriable)
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMetrics(n int) []models.Metric {
+	metrics := make([]models.Metric, 0, n)
+	for i := 0; i < n; i++ {
+		delta := int64(i)
+		metrics = append(metrics, models.Metric{ID: fmt.Sprintf("metric%d", i), MType: Counter, Delta: &delta})
+	}
+	return metrics
+}
+
+func TestSplitBatch(t *testing.T) {
+	metrics := testMetrics(10)
+
+	batches := splitBatch(metrics, 0, 0)
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0], 10)
+
+	batches = splitBatch(metrics, 3, 0)
+	require.Len(t, batches, 4)
+	assert.Len(t, batches[0], 3)
+	assert.Len(t, batches[3], 1)
+
+	maxBytes := 100
+	batches = splitBatch(metrics, 0, maxBytes)
+	total := 0
+	for _, batch := range batches {
+		b, err := json.Marshal(batch)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(b), maxBytes)
+		total += len(batch)
+	}
+	assert.Equal(t, len(metrics), total)
+	assert.Greater(t, len(batches), 1)
+
+	batches = splitBatch(metrics, 0, 10)
+	assert.Len(t, batches, len(metrics), "oversized metrics are expected to be sent one by one")
+}
+
+func TestSendWithRetry(t *testing.T) {
+	defer func(delays []time.Duration) { retryDelays = delays }(retryDelays)
+	retryDelays = []time.Duration{time.Millisecond, time.Millisecond}
+
+	calls := 0
+	err := sendWithRetry(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return ErrRetriable
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	err = sendWithRetry(context.Background(), func() error {
+		calls++
+		return errors.New("bad request")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = sendWithRetry(context.Background(), func() error {
+		calls++
+		return ErrRetriable
+	})
+	assert.ErrorIs(t, err, ErrRetriable)
+	assert.Equal(t, 3, calls)
+}
+
+func TestMetricService_SendPartialFailure(t *testing.T) {
+	defer func(delays []time.Duration) { retryDelays = delays }(retryDelays)
+	retryDelays = []time.Duration{time.Millisecond}
+
+	mu := sync.Mutex{}
+	received := make(map[string]int)
+	failed := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metric
+		// FailNow must not be called outside the test goroutine
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&metrics)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if metrics[0].ID == "metric2" && !failed {
+			failed = true
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, m := range metrics {
+			received[m.ID]++
+		}
+	}))
+	defer ts.Close()
+
+	ms, err := NewMetricsService(&configs.AgentCfg{RateLimit: 5})
+	require.NoError(t, err)
+	for _, batch := range splitBatch(testMetrics(5), 2, 0) {
+		ms.ch <- batch
+	}
+	close(ms.ch)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	ms.Send(context.Background(), wg, newHTTPSink(&http.Client{}, strings.TrimPrefix(ts.URL, "http://")))
+
+	assert.True(t, failed)
+	assert.Len(t, received, 5)
+	for id, n := range received {
+		assert.Equalf(t, 1, n, "metric %s was expected to be counted once", id)
+	}
+}
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+const (
+	// CgroupAuto detects the cgroup of the agent under the default cgroup v2 mount point.
+	CgroupAuto = "auto"
+
+	cgroupMount          = "/sys/fs/cgroup"
+	procSelfCgroup       = "/proc/self/cgroup"
+	cgroupUnlimited      = "max"
+	microsecondsInSecond = 1e6
+)
+
+// cgroupCollector reads the resource usage and limits of a cgroup v2 directory.
+type cgroupCollector struct {
+	dir       string
+	lastUsage float64
+	lastPoll  time.Time
+}
+
+// newCgroupCollector finds the cgroup directory of the agent. The root is either CgroupAuto,
+// which means the default mount point, or the directory the cgroup v2 hierarchy is mounted at.
+// The own cgroup is taken from the proc file, if it is not found under the root, the root itself is used.
+func newCgroupCollector(root string, procCgroup string) (*cgroupCollector, error) {
+	if root == CgroupAuto {
+		root = cgroupMount
+	}
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 hierarchy: %w", root, err)
+	}
+
+	dir := root
+	if own, err := ownCgroup(procCgroup); err == nil {
+		candidate := filepath.Join(root, own)
+		if _, err = os.Stat(filepath.Join(candidate, "cgroup.controllers")); err == nil {
+			dir = candidate
+		}
+	}
+	return &cgroupCollector{dir: dir}, nil
+}
+
+// ownCgroup returns the cgroup v2 path from the "0::/path" line of the proc file.
+func ownCgroup(procCgroup string) (string, error) {
+	file, err := os.Open(procCgroup)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("the process is not in a cgroup v2 hierarchy")
+}
+
+// CollectCgroup collects the metrics of the agent cgroup every poll interval until the context is done.
+func (ms *MetricsService) CollectCgroup(ctx context.Context) {
+	if ms.cgroup == nil {
+		return
+	}
+	ms.runCollector(ctx, "cgroup", ms.getPollInterval, ms.cgroup.collect)
+}
+
+// collect reads the cgroup files. Files of controllers that are not enabled are skipped,
+// other errors are returned together with the metrics read successfully.
+func (c *cgroupCollector) collect(_ context.Context) ([]models.Metric, error) {
+	metrics := make([]models.Metric, 0, 16)
+	gauge := func(id string, v float64) {
+		metrics = append(metrics, models.Metric{ID: id, MType: Gauge, Value: &v})
+	}
+	var errs []error
+	check := func(err error) bool {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+		return err == nil
+	}
+
+	if v, finite, err := c.readValue("memory.current"); check(err) && finite {
+		gauge("CgroupMemoryUsage", v)
+	}
+	if v, finite, err := c.readValue("memory.max"); check(err) && finite {
+		gauge("CgroupMemoryLimit", v)
+	}
+	if v, finite, err := c.readValue("pids.current"); check(err) && finite {
+		gauge("CgroupPids", v)
+	}
+	if v, finite, err := c.readValue("pids.max"); check(err) && finite {
+		gauge("CgroupPidsLimit", v)
+	}
+
+	if stat, err := c.readKeyValues("cpu.stat"); check(err) {
+		usage := stat["usage_usec"] / microsecondsInSecond
+		gauge("CgroupCPUUsageSeconds", usage)
+		gauge("CgroupCPUThrottledPeriods", stat["nr_throttled"])
+		gauge("CgroupCPUThrottledSeconds", stat["throttled_usec"]/microsecondsInSecond)
+
+		now := time.Now()
+		if !c.lastPoll.IsZero() && usage >= c.lastUsage {
+			gauge("CgroupCPUUtilization", (usage-c.lastUsage)/now.Sub(c.lastPoll).Seconds()*100)
+		}
+		c.lastUsage = usage
+		c.lastPoll = now
+	}
+
+	if fields, err := c.readFields("cpu.max"); check(err) && len(fields) == 2 && fields[0] != cgroupUnlimited {
+		quota, err := strconv.ParseFloat(fields[0], 64)
+		if check(err) {
+			period, err := strconv.ParseFloat(fields[1], 64)
+			if check(err) && period > 0 {
+				gauge("CgroupCPULimit", quota/period)
+			}
+		}
+	}
+
+	if pressure, err := c.readPressure("io.pressure"); check(err) {
+		gauge("CgroupIOPressureSome10", pressure["some avg10"])
+		gauge("CgroupIOPressureSomeSeconds", pressure["some total"]/microsecondsInSecond)
+		gauge("CgroupIOPressureFull10", pressure["full avg10"])
+		gauge("CgroupIOPressureFullSeconds", pressure["full total"]/microsecondsInSecond)
+	}
+
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("cgroup %s: %w", c.dir, errs[0])
+	}
+	return metrics, nil
+}
+
+// readValue reads a file with a single number. The second result is false if the value is "max", i.e. not a number.
+func (c *cgroupCollector) readValue(name string) (float64, bool, error) {
+	fields, err := c.readFields(name)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(fields) != 1 {
+		return 0, false, fmt.Errorf("%s: unexpected content %q", name, fields)
+	}
+	if fields[0] == cgroupUnlimited {
+		return 0, false, nil
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	return v, err == nil, err
+}
+
+func (c *cgroupCollector) readFields(name string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// readKeyValues reads a flat keyed file with "key value" lines like cpu.stat.
+func (c *cgroupCollector) readKeyValues(name string) (map[string]float64, error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		values[fields[0]] = v
+	}
+	return values, nil
+}
+
+// readPressure reads a PSI file with lines like "some avg10=0.00 avg60=0.00 avg300=0.00 total=0".
+// The keys of the result are the line kind and the field name, e.g. "some avg10".
+func (c *cgroupCollector) readPressure(name string) (map[string]float64, error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			values[fields[0]+" "+key] = v
+		}
+	}
+	return values, nil
+}
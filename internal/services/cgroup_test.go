@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCgroupFiles(t *testing.T, dir string, files map[string]string) {
+	require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+}
+
+func TestNewCgroupCollector(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{"cgroup.controllers": "cpu memory pids io\n"})
+	own := filepath.Join(root, "system.slice", "agent.service")
+	writeCgroupFiles(t, own, map[string]string{"cgroup.controllers": "cpu memory\n"})
+
+	procCgroup := filepath.Join(t.TempDir(), "cgroup")
+	require.NoError(t, os.WriteFile(procCgroup, []byte("0::/system.slice/agent.service\n"), 0o600))
+
+	c, err := newCgroupCollector(root, procCgroup)
+	require.NoError(t, err)
+	assert.Equal(t, own, c.dir)
+
+	c, err = newCgroupCollector(root, filepath.Join(t.TempDir(), "missing"))
+	require.NoError(t, err)
+	assert.Equal(t, root, c.dir, "the root was expected to be used when the own cgroup is unknown")
+
+	_, err = newCgroupCollector(t.TempDir(), procCgroup)
+	assert.Error(t, err)
+}
+
+func TestCgroupCollector_Collect(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"cgroup.controllers": "cpu memory pids io\n",
+		"memory.current":     "104857600\n",
+		"memory.max":         "536870912\n",
+		"pids.current":       "12\n",
+		"pids.max":           "max\n",
+		"cpu.max":            "50000 100000\n",
+		"cpu.stat": "usage_usec 2000000\nuser_usec 1500000\nsystem_usec 500000\n" +
+			"nr_periods 100\nnr_throttled 7\nthrottled_usec 350000\n",
+		"io.pressure": "some avg10=1.50 avg60=0.80 avg300=0.10 total=3000000\n" +
+			"full avg10=0.50 avg60=0.20 avg300=0.00 total=1000000\n",
+	})
+
+	c, err := newCgroupCollector(root, filepath.Join(root, "missing"))
+	require.NoError(t, err)
+
+	metrics, err := c.collect(context.Background())
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		values[m.ID] = *m.Value
+	}
+	assert.Equal(t, map[string]float64{
+		"CgroupMemoryUsage":           104857600,
+		"CgroupMemoryLimit":           536870912,
+		"CgroupPids":                  12,
+		"CgroupCPUUsageSeconds":       2,
+		"CgroupCPUThrottledPeriods":   7,
+		"CgroupCPUThrottledSeconds":   0.35,
+		"CgroupCPULimit":              0.5,
+		"CgroupIOPressureSome10":      1.5,
+		"CgroupIOPressureSomeSeconds": 3,
+		"CgroupIOPressureFull10":      0.5,
+		"CgroupIOPressureFullSeconds": 1,
+	}, values, "unlimited pids and the first CPU utilization were expected to be skipped")
+
+	writeCgroupFiles(t, root, map[string]string{"cpu.stat": "usage_usec 2500000\n"})
+	require.NoError(t, os.Remove(filepath.Join(root, "io.pressure")))
+	metrics, err = c.collect(context.Background())
+	require.NoError(t, err, "missing controller files were expected to be skipped")
+	assert.NotNil(t, findMetric(metrics, "CgroupCPUUtilization"))
+	assert.Nil(t, findMetric(metrics, "CgroupIOPressureSome10"))
+
+	writeCgroupFiles(t, root, map[string]string{"memory.current": "garbage\n"})
+	metrics, err = c.collect(context.Background())
+	assert.Error(t, err)
+	assert.NotNil(t, findMetric(metrics, "CgroupMemoryLimit"), "the other metrics were expected to be collected")
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+// collectFunc polls one source of metrics.
+type collectFunc func(ctx context.Context) ([]models.Metric, error)
+
+// runCollector calls collect every interval until the context is done and stores its metrics under the name.
+// The metrics collected before an error are still stored, the values it has not reported again are forgotten.
+// The interval is read on every tick, so it can change while the collector runs.
+func (ms *MetricsService) runCollector(ctx context.Context, name string, interval func() time.Duration, collect collectFunc) {
+	schedule := newSchedule(ms.clock, interval(), 0, false)
+
+	for {
+		schedule.interval = interval()
+		select {
+		case <-ctx.Done():
+			return
+		case <-schedule.next():
+			if !ms.collectorEnabled(name) {
+				ms.Lock()
+				delete(ms.collected, name)
+				ms.Unlock()
+				continue
+			}
+
+			start := time.Now()
+			metrics, err := collect(ctx)
+			// a run interrupted by the shutdown says nothing about the source
+			ms.store(name, metrics, err != nil && ctx.Err() == nil)
+			ms.telemetry.observeCollector(name, time.Since(start), err)
+		}
+	}
+}
+
+// store saves the metrics of the named collector until the next report.
+// Gauges keep the last value, counter deltas are added up and sent once.
+// After a failed run only the values reported by it are kept, the counter deltas are sent anyway.
+func (ms *MetricsService) store(name string, metrics []models.Metric, failed bool) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	stored, ok := ms.collected[name]
+	if !ok {
+		stored = make(map[string]models.Metric)
+		ms.collected[name] = stored
+	}
+	if failed {
+		for key, m := range stored {
+			if m.MType != Counter {
+				delete(stored, key)
+			}
+		}
+	}
+
+	for _, m := range metrics {
+		key := m.MType + ":" + m.ID
+		if prev, ok := stored[key]; ok && m.MType == Counter && prev.Delta != nil && m.Delta != nil {
+			delta := *prev.Delta + *m.Delta
+			m.Delta = &delta
+		}
+		stored[key] = m
+	}
+	ms.aggregator.observe(metrics)
+}
+
+// drainCollected returns the metrics stored by the collectors and forgets the counters
+// so that their deltas are not sent twice. It must be called with the lock held.
+func (ms *MetricsService) drainCollected() []models.Metric {
+	names := make([]string, 0, len(ms.collected))
+	for name := range ms.collected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := make([]models.Metric, 0)
+	for _, name := range names {
+		stored := ms.collected[name]
+		keys := make([]string, 0, len(stored))
+		for key := range stored {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			metrics = append(metrics, stored[key])
+			if stored[key].MType == Counter {
+				delete(stored, key)
+			}
+		}
+	}
+	return metrics
+}
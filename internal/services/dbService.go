@@ -2,13 +2,16 @@ package services
 
 import (
 	"context"
-	"crypto/hmac"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/dbulyk/metrics-alerting-service/internal/storages"
 
+	"github.com/dbulyk/metrics-alerting-service/internal/hub"
 	"github.com/dbulyk/metrics-alerting-service/internal/models"
 	"github.com/dbulyk/metrics-alerting-service/internal/utils"
 	"github.com/golang-migrate/migrate/v4"
@@ -18,9 +21,19 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// insertMetric writes a metric replacing the stored one, the merge with the stored value is done before.
+const insertMetric = "insert into metrics(id, mtype, delta, value, hash, histogram, summary, registers, info, updated_at) " +
+	"values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) " +
+	"on conflict (id) do update set delta = $3, value = $4, hash = $5, histogram = $6, summary = $7, registers = $8, " +
+	"info = $9, updated_at = $10"
+
+// selectMetric is the list of columns scanned by scanMetric.
+const selectMetric = "select id, mtype, delta, value, hash, histogram, summary, registers, info, updated_at from metrics"
+
 type dbRepository struct {
 	db  *sql.DB
 	key string
+	hub *hub.Hub
 }
 
 // NewDBRepository creates a new repository for working with the database and returns a pointer to it.
@@ -39,6 +52,7 @@ func NewDBRepository(db *sql.DB, dsn string, key string) storages.IRepository {
 	return &dbRepository{
 		db:  db,
 		key: key,
+		hub: hub.New(),
 	}
 }
 
@@ -50,44 +64,174 @@ func (dr *dbRepository) Set(ctx context.Context, metric models.Metric) (*models.
 		return nil, err
 	}
 
-	_, err = dr.db.ExecContext(ctx,
-		"insert into metrics(id, mtype, delta, value, hash) values($1, $2, $3, $4, $5) "+
-			"on conflict (id) do update set delta = $3, value = $4, hash = $5",
-		metric.ID, metric.MType, metric.Delta, metric.Value, metric.Hash)
+	histogram, summary, info, err := encodeColumns(metric)
+	if err != nil {
+		return nil, err
+	}
+	_, err = dr.db.ExecContext(ctx, insertMetric,
+		metric.ID, metric.MType, metric.Delta, metric.Value, metric.Hash, histogram, summary, setRegisters(metric), info,
+		metric.UpdatedAt)
 	if err != nil {
 		log.Error().Err(err).Msg("error of writing metrics to the database")
 		return nil, err
 	}
+	publishMetric(dr.hub, &metric)
 	return &metric, nil
 }
 
 // Get returns a metric from the database by name and type and check hash.
 func (dr *dbRepository) Get(ctx context.Context, mName string, mType string) (*models.Metric, error) {
-	rows := dr.db.QueryRowContext(ctx, "select id, mtype, delta, value, hash from metrics "+
-		"where id = $1 and mtype = $2", mName, mType)
-	var m models.Metric
-	err := rows.Scan(&m.ID, &m.MType, &m.Delta, &m.Value, &m.Hash)
+	row := dr.db.QueryRowContext(ctx, selectMetric+" where id = $1 and mtype = $2", mName, mType)
+	m, err := scanMetric(row)
 	if err != nil {
 		log.Error().Err(err).Msg("metric scanning error from database")
 		return nil, ErrInvalidMetric
 	}
 
 	if len(dr.key) > 0 {
-		if m.MType == Gauge {
-			m.Hash = utils.Hash(fmt.Sprintf("%s:%s:%f", m.ID, m.MType, *m.Value), dr.key)
-		} else {
-			m.Hash = utils.Hash(fmt.Sprintf("%s:%s:%d", m.ID, m.MType, *m.Delta), dr.key)
-		}
+		m.Hash = utils.Hash(hashSource(*m), dr.key)
 	}
 
-	return &m, nil
+	return m, nil
 }
 
 // GetAll returns all metrics from the database.
 func (dr *dbRepository) GetAll(ctx context.Context) ([]*models.Metric, error) {
+	return dr.queryMetrics(ctx, selectMetric+" order by id")
+}
+
+// List returns the metrics selected by the filter. The filter, the sort order and the page are applied
+// by the database, names are compared byte by byte like in the file repository. The regular expression
+// is matched by Postgres, validateFilter allows only the syntax meaning the same there and in Go.
+func (dr *dbRepository) List(ctx context.Context, filter models.MetricFilter) ([]*models.Metric, error) {
+	if err := validateFilter(filter); err != nil {
+		return nil, err
+	}
+
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := filterConditions(filter, arg)
+
+	less, order := ">", "asc"
+	if filter.Desc {
+		less, order = "<", "desc"
+	}
+	const value = "coalesce(value, delta::double precision)"
+	const name = `id collate "C", mtype collate "C"`
+	orderBy := fmt.Sprintf(`id collate "C" %s, mtype collate "C" %s`, order, order)
+	switch filter.Sort {
+	case models.SortByValue:
+		orderBy = fmt.Sprintf("%s %s nulls last, %s", value, order, orderBy)
+	case models.SortByUpdated:
+		orderBy = fmt.Sprintf("updated_at %s, %s", order, orderBy)
+	}
+
+	if c := filter.After; c != nil {
+		after := fmt.Sprintf("(%s) %s (%s, %s)", name, less, arg(c.ID), arg(c.MType))
+		switch filter.Sort {
+		case models.SortByValue:
+			// metrics without a value go last in both orders
+			if c.Value == nil {
+				after = fmt.Sprintf("%s is null and %s", value, after)
+			} else {
+				v := arg(*c.Value)
+				after = fmt.Sprintf("(%s %s %s or %s = %s and %s or %s is null)", value, less, v, value, v, after, value)
+			}
+		case models.SortByUpdated:
+			u := arg(c.UpdatedAt)
+			after = fmt.Sprintf("(updated_at %s %s or updated_at = %s and %s)", less, u, u, after)
+		}
+		where = append(where, after)
+	}
+
+	q := selectMetric
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	q += " order by " + orderBy
+	if filter.Limit > 0 {
+		q += " limit " + arg(filter.Limit)
+	}
+
+	metrics, err := dr.queryMetrics(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(dr.key) > 0 {
+		for _, m := range metrics {
+			m.Hash = utils.Hash(hashSource(*m), dr.key)
+		}
+	}
+	return metrics, nil
+}
+
+// filterConditions returns the conditions selecting the metrics by the prefix, the regular expression and
+// the type of the filter, arg adds a query argument and returns its placeholder.
+func filterConditions(filter models.MetricFilter, arg func(v any) string) []string {
+	var where []string
+	if len(filter.Prefix) > 0 {
+		p := arg(filter.Prefix)
+		where = append(where, "left(id, char_length("+p+")) = "+p)
+	}
+	if len(filter.Regexp) > 0 {
+		where = append(where, "id ~ "+arg(filter.Regexp))
+	}
+	if len(filter.Type) > 0 {
+		where = append(where, "mtype = "+arg(filter.Type))
+	}
+	return where
+}
+
+// Delete removes a metric by name and type.
+func (dr *dbRepository) Delete(ctx context.Context, mName string, mType string) error {
+	res, err := dr.db.ExecContext(ctx, "delete from metrics where id = $1 and mtype = $2", mName, mType)
+	if err != nil {
+		log.Error().Err(err).Msg("error of deleting the metric from the database")
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrInvalidMetric
+	}
+	return nil
+}
+
+// DeleteMatching removes the metrics selected by the prefix, the regular expression and the type of the filter
+// and returns their number.
+func (dr *dbRepository) DeleteMatching(ctx context.Context, filter models.MetricFilter) (int, error) {
+	if err := validateDeleteFilter(filter); err != nil {
+		return 0, err
+	}
+
+	var args []any
+	where := filterConditions(filter, func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	})
+	res, err := dr.db.ExecContext(ctx, "delete from metrics where "+strings.Join(where, " and "), args...)
+	if err != nil {
+		log.Error().Err(err).Msg("error of deleting metrics from the database")
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// queryMetrics returns the metrics selected by the query starting with selectMetric.
+func (dr *dbRepository) queryMetrics(ctx context.Context, query string, args ...any) ([]*models.Metric, error) {
 	var metrics []*models.Metric
 
-	rows, err := dr.db.QueryContext(ctx, "select id, mtype, delta, value from metrics order by id")
+	rows, err := dr.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Error().Err(err).Msg("error of getting metrics from the database")
 		return nil, err
@@ -100,13 +244,12 @@ func (dr *dbRepository) GetAll(ctx context.Context) ([]*models.Metric, error) {
 	}(rows)
 
 	for rows.Next() {
-		var m models.Metric
-		err = rows.Scan(&m.ID, &m.MType, &m.Delta, &m.Value)
+		m, err := scanMetric(rows)
 		if err != nil {
 			log.Error().Err(err).Msg("error of scanning metrics from the database")
 			return nil, err
 		}
-		metrics = append(metrics, &m)
+		metrics = append(metrics, m)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -117,6 +260,27 @@ func (dr *dbRepository) GetAll(ctx context.Context) ([]*models.Metric, error) {
 	return metrics, nil
 }
 
+// scanMetric scans a row of the columns of selectMetric.
+func scanMetric(row interface{ Scan(dest ...any) error }) (*models.Metric, error) {
+	var m models.Metric
+	var hash sql.NullString
+	var histogram, summary, registers, info []byte
+	var updatedAt sql.NullTime
+	err := row.Scan(&m.ID, &m.MType, &m.Delta, &m.Value, &hash, &histogram, &summary, &registers, &info, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err = decodeColumns(&m, histogram, summary, registers, info); err != nil {
+		return nil, err
+	}
+	m.Hash = hash.String
+	if updatedAt.Valid {
+		t := updatedAt.Time.UTC()
+		m.UpdatedAt = &t
+	}
+	return &m, nil
+}
+
 // Updates adds a slice of metrics to the database or updates existing ones, check hash
 // and add delta to existing counter.
 func (dr *dbRepository) Updates(ctx context.Context, metrics []models.Metric) ([]models.Metric, error) {
@@ -128,14 +292,19 @@ func (dr *dbRepository) Updates(ctx context.Context, metrics []models.Metric) ([
 			return nil, err
 		}
 
+		histogram, summary, info, err := encodeColumns(metrics[i])
+		if err != nil {
+			return nil, err
+		}
+
 		tx, err := dr.db.Begin()
 		if err != nil {
 			log.Error().Err(err).Msg("transaction opening error")
 			return nil, err
 		}
-		_, err = tx.ExecContext(ctx, "insert into metrics(id, mtype, delta, value, hash) values($1, $2, $3, $4, $5) "+
-			"on conflict (id) do update set delta = $3, value = $4, hash = $5",
-			metrics[i].ID, metrics[i].MType, metrics[i].Delta, metrics[i].Value, metrics[i].Hash)
+		_, err = tx.ExecContext(ctx, insertMetric,
+			metrics[i].ID, metrics[i].MType, metrics[i].Delta, metrics[i].Value, metrics[i].Hash, histogram, summary,
+			setRegisters(metrics[i]), info, metrics[i].UpdatedAt)
 		if err != nil {
 			log.Error().Err(err).Msg("error of writing the metric to the database. Roll back the transaction")
 			err = tx.Rollback()
@@ -151,53 +320,187 @@ func (dr *dbRepository) Updates(ctx context.Context, metrics []models.Metric) ([
 			log.Error().Err(err).Msg("transaction commit error")
 			return nil, err
 		}
+		publishMetric(dr.hub, &metrics[i])
 	}
 
 	return metrics, nil
 }
 
+// Hub returns the hub publishing the accepted metrics.
+func (dr *dbRepository) Hub() *hub.Hub {
+	return dr.hub
+}
+
 // Ping checks the connection to the database.
 func (dr *dbRepository) Ping() error {
 	return dr.db.Ping()
 }
 
-func checkHashAndAddDelta(ctx context.Context, db *sql.DB, metric *models.Metric, key string) error {
-	var mHash, s string
+// SetAgentConfig adds a new agent config rule to the database or replaces the rule with the same ID.
+func (dr *dbRepository) SetAgentConfig(ctx context.Context, rule models.AgentConfigRule) error {
+	labels, err := json.Marshal(rule.Labels)
+	if err != nil {
+		return err
+	}
+	config, err := json.Marshal(rule.Config)
+	if err != nil {
+		return err
+	}
 
-	if len(key) > 0 {
-		switch metric.MType {
-		case Gauge:
-			s = fmt.Sprintf("%s:%s:%f", metric.ID, metric.MType, *metric.Value)
-		case Counter:
-			s = fmt.Sprintf("%s:%s:%d", metric.ID, metric.MType, *metric.Delta)
+	_, err = dr.db.ExecContext(ctx, "insert into agent_configs(id, agent, labels, config) values($1, $2, $3, $4) "+
+		"on conflict (id) do update set agent = $2, labels = $3, config = $4",
+		rule.ID, rule.Agent, string(labels), string(config))
+	if err != nil {
+		log.Error().Err(err).Msg("error of writing the agent config to the database")
+		return err
+	}
+	return nil
+}
+
+// GetAgentConfig returns the config chosen for the agent by its ID and labels.
+func (dr *dbRepository) GetAgentConfig(ctx context.Context, agentID string, labels map[string]string) (*models.AgentConfig, error) {
+	rows, err := dr.db.QueryContext(ctx, "select id, agent, labels, config from agent_configs")
+	if err != nil {
+		log.Error().Err(err).Msg("error of getting the agent configs from the database")
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("error of closing rows")
 		}
+	}(rows)
 
-		mHash = utils.Hash(s, key)
-		if !hmac.Equal([]byte(mHash), []byte(metric.Hash)) {
-			log.Error().Msgf("the incoming hash does not match the calculated hash. Metric %s will not be added",
-				metric.ID)
-			return ErrInvalidHash
+	var rules []models.AgentConfigRule
+	for rows.Next() {
+		var rule models.AgentConfigRule
+		var ruleLabels, config []byte
+		err = rows.Scan(&rule.ID, &rule.Agent, &ruleLabels, &config)
+		if err != nil {
+			log.Error().Err(err).Msg("error of scanning the agent configs from the database")
+			return nil, err
+		}
+		if err = json.Unmarshal(ruleLabels, &rule.Labels); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(config, &rule.Config); err != nil {
+			return nil, err
 		}
+		rules = append(rules, rule)
 	}
+	if err = rows.Err(); err != nil {
+		log.Error().Err(err).Msg("error of getting the agent configs from the database")
+		return nil, err
+	}
+
+	return matchAgentConfig(rules, agentID, labels)
+}
 
-	if metric.MType == Counter {
+func checkHashAndAddDelta(ctx context.Context, db *sql.DB, metric *models.Metric, key string) error {
+	if err := prepareMetric(metric, key); err != nil {
+		return err
+	}
+
+	switch metric.MType {
+	case Counter:
 		res := db.QueryRowContext(ctx, "select delta from metrics where id = $1 and mtype = $2",
 			metric.ID, metric.MType)
-		if res != nil {
-			var delta int64
-			err := res.Scan(&delta)
-			if err == nil {
-				del := delta + *metric.Delta
-				metric.Delta = &del
-				if len(key) > 0 {
-					s = fmt.Sprintf("%s:%s:%d", metric.ID, metric.MType, *metric.Delta)
-					metric.Hash = utils.Hash(s, key)
-				}
-			} else if !errors.Is(err, sql.ErrNoRows) {
+		var delta int64
+		err := res.Scan(&delta)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
 				log.Error().Err(err).Msg("metric scanning error from database")
 				return err
 			}
+			return nil
 		}
+		del := delta + *metric.Delta
+		metric.Delta = &del
+	case Histogram, Summary, Set:
+		res := db.QueryRowContext(ctx, "select histogram, summary, registers from metrics where id = $1 and mtype = $2",
+			metric.ID, metric.MType)
+		var histogram, summary, registers []byte
+		err := res.Scan(&histogram, &summary, &registers)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				log.Error().Err(err).Msg("metric scanning error from database")
+				return err
+			}
+			return nil
+		}
+		stored := models.Metric{ID: metric.ID, MType: metric.MType}
+		if err = decodeColumns(&stored, histogram, summary, registers, nil); err != nil {
+			return err
+		}
+		if stored.Histogram != nil || stored.Summary != nil || stored.Set != nil {
+			if err = mergeMetric(&stored, *metric); err != nil {
+				return err
+			}
+			metric.Histogram, metric.Summary, metric.Set = stored.Histogram, stored.Summary, stored.Set
+		}
+	default:
+		return nil
+	}
+
+	if len(key) > 0 {
+		metric.Hash = utils.Hash(hashSource(*metric), key)
 	}
 	return nil
 }
+
+// encodeColumns encodes the histogram, the summary and the info of the metric for their jsonb columns.
+func encodeColumns(m models.Metric) (histogram any, summary any, info any, err error) {
+	if histogram, err = marshalColumn(m.Histogram); err != nil {
+		return nil, nil, nil, err
+	}
+	if summary, err = marshalColumn(m.Summary); err != nil {
+		return nil, nil, nil, err
+	}
+	if info, err = marshalColumn(m.Info); err != nil {
+		return nil, nil, nil, err
+	}
+	return histogram, summary, info, nil
+}
+
+// decodeColumns decodes the histogram, the summary, the set registers and the info columns into the metric.
+func decodeColumns(m *models.Metric, histogram, summary, registers, info []byte) error {
+	if err := unmarshalColumn(histogram, &m.Histogram); err != nil {
+		return err
+	}
+	if len(registers) > 0 {
+		m.Set = &models.Set{Registers: registers}
+	}
+	if err := unmarshalColumn(info, &m.Info); err != nil {
+		return err
+	}
+	return unmarshalColumn(summary, &m.Summary)
+}
+
+// setRegisters returns the registers of a set for the bytea column, other metrics get NULL.
+func setRegisters(m models.Metric) any {
+	if m.Set == nil {
+		return nil
+	}
+	return m.Set.Registers
+}
+
+// marshalColumn encodes a value stored in a jsonb column, nil becomes NULL.
+func marshalColumn[T any](v *T) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// unmarshalColumn decodes a jsonb column, NULL leaves the value nil.
+func unmarshalColumn[T any](data []byte, v **T) error {
+	if len(data) == 0 {
+		return nil
+	}
+	*v = new(T)
+	return json.Unmarshal(data, *v)
+}
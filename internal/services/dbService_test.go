@@ -29,7 +29,7 @@ func TestSet(t *testing.T) {
 	mock.ExpectQuery("select (.+)").WithArgs(metric.ID, metric.MType).WillReturnRows(rows)
 
 	mock.ExpectExec("insert (.+)").
-		WithArgs(metric.ID, metric.MType, metric.Delta, metric.Value, metric.Hash).
+		WithArgs(metric.ID, metric.MType, metric.Delta, metric.Value, metric.Hash, nil, nil, nil, nil, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -111,8 +111,8 @@ func TestGet(t *testing.T) {
 		Hash:  "",
 	}
 
-	rows := sqlmock.NewRows([]string{"id", "mtype", "delta", "value", "hash"}).
-		AddRow(mockMetric.ID, mockMetric.MType, mockMetric.Delta, mockMetric.Value, mockMetric.Hash)
+	rows := sqlmock.NewRows([]string{"id", "mtype", "delta", "value", "hash", "histogram", "summary", "registers", "info", "updated_at"}).
+		AddRow(mockMetric.ID, mockMetric.MType, mockMetric.Delta, mockMetric.Value, mockMetric.Hash, nil, nil, nil, nil, nil)
 	mock.ExpectQuery("^select (.+) from metrics where (.+)").
 		WithArgs(mockMetric.ID, mockMetric.MType).
 		WillReturnRows(rows)
@@ -141,13 +141,13 @@ func TestDBRepository_GetAll(t *testing.T) {
 
 	del := int64(12)
 	val := 2.2
-	rows := sqlmock.NewRows([]string{"id", "mtype", "delta", "value"}).
-		AddRow(1, Gauge, &del, nil).
-		AddRow(2, Counter, nil, &val)
+	rows := sqlmock.NewRows([]string{"id", "mtype", "delta", "value", "hash", "histogram", "summary", "registers", "info", "updated_at"}).
+		AddRow(1, Gauge, &del, nil, "", nil, nil, nil, nil, nil).
+		AddRow(2, Counter, nil, &val, "", nil, nil, nil, nil, nil)
 
 	mock.ExpectQuery("^select (.+) from metrics order by id$").WillReturnRows(rows)
 
-	repo := &dbRepository{db, ""}
+	repo := &dbRepository{db: db}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -0,0 +1,355 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Modes of sending to several servers.
+const (
+	ModeFailover = "failover"
+	ModeFanout   = "fanout"
+)
+
+// probeInterval is how often a failed server is pinged before it gets batches again.
+var probeInterval = 5 * time.Second
+
+// newHTTPSinks creates a sink for the comma-separated list of servers in the config.
+func newHTTPSinks(client *http.Client, cfg *configs.AgentCfg) (Sink, error) {
+	sinks := make([]*httpSink, 0)
+	for _, address := range strings.Split(cfg.Address, ",") {
+		address = strings.TrimSpace(address)
+		if len(address) > 0 {
+			sinks = append(sinks, newHTTPSink(client, address))
+		}
+	}
+
+	switch {
+	case len(sinks) == 0:
+		return nil, fmt.Errorf("no server address")
+	case len(sinks) == 1:
+		return sinks[0], nil
+	case cfg.DestinationMode == ModeFailover || cfg.DestinationMode == "":
+		return newFailoverSink(sinks), nil
+	case cfg.DestinationMode == ModeFanout:
+		return newFanoutSink(sinks, cfg), nil
+	}
+	return nil, fmt.Errorf("unknown destination mode %q", cfg.DestinationMode)
+}
+
+// destination is a server of the failover sink with its health state.
+type destination struct {
+	sink      *httpSink
+	healthy   bool
+	checkedAt time.Time
+}
+
+// failoverSink sends every batch to the first healthy server in the list. A server that fails with
+// a retriable error is skipped until its /ping succeeds, pings are sent at most once per probeInterval.
+type failoverSink struct {
+	sync.Mutex
+	destinations []*destination
+}
+
+func newFailoverSink(sinks []*httpSink) *failoverSink {
+	s := &failoverSink{destinations: make([]*destination, 0, len(sinks))}
+	for _, sink := range sinks {
+		s.destinations = append(s.destinations, &destination{sink: sink, healthy: true})
+	}
+	return s
+}
+
+func (s *failoverSink) Write(ctx context.Context, metrics []models.Metric) error {
+	var lastErr error
+	for _, d := range s.destinations {
+		if !s.available(ctx, d) {
+			continue
+		}
+
+		err := d.sink.Write(ctx, metrics)
+		if err == nil || !isRetriable(err) {
+			return err
+		}
+
+		log.Warn().Err(err).Msgf("server %s is unavailable, switching to the next one", d.sink.address)
+		s.Lock()
+		d.healthy = false
+		d.checkedAt = time.Now()
+		s.Unlock()
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%w: all servers are unavailable", ErrRetriable)
+	}
+	return lastErr
+}
+
+// available reports whether the server may get the batch, probing it if it has failed before.
+func (s *failoverSink) available(ctx context.Context, d *destination) bool {
+	s.Lock()
+	if d.healthy {
+		s.Unlock()
+		return true
+	}
+	if time.Since(d.checkedAt) < probeInterval {
+		s.Unlock()
+		return false
+	}
+	d.checkedAt = time.Now()
+	s.Unlock()
+
+	if err := d.sink.Ping(ctx); err != nil {
+		log.Debug().Err(err).Msgf("server %s is still unavailable", d.sink.address)
+		return false
+	}
+
+	log.Info().Msgf("server %s is available again", d.sink.address)
+	s.Lock()
+	d.healthy = true
+	s.Unlock()
+	return true
+}
+
+func (s *failoverSink) Close() error {
+	return nil
+}
+
+// fanoutBacklog is the number of batches a server may fall behind before its backlog is merged.
+const fanoutBacklog = 100
+
+// fanoutSink sends every batch to all servers. Every server has its own backlog and sender, so a slow
+// or failed server neither holds up the others nor gets a batch twice. A server that is down keeps its
+// batches until it is back, on shutdown the rest of its backlog goes to its own spool file.
+type fanoutSink struct {
+	destinations []*fanoutDestination
+	key          string
+	timeout      time.Duration
+	cancel       context.CancelFunc
+	closing      chan struct{}
+	wg           sync.WaitGroup
+	// rejected counts the batches rejected by the servers, unreported those not taken by takeRejected yet.
+	rejected   atomic.Int64
+	unreported atomic.Int64
+}
+
+// fanoutDestination is a server of the fanout sink with the batches it has not accepted yet.
+type fanoutDestination struct {
+	sync.Mutex
+	sink    *httpSink
+	spool   *spool
+	backlog [][]models.Metric
+	wake    chan struct{}
+}
+
+// newFanoutSink starts a sender for every server. The batches spooled for a server during
+// the previous shutdown are restored to its backlog.
+func newFanoutSink(sinks []*httpSink, cfg *configs.AgentCfg) *fanoutSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &fanoutSink{
+		destinations: make([]*fanoutDestination, 0, len(sinks)),
+		key:          cfg.Key,
+		timeout:      cfg.ShutdownTimeout,
+		cancel:       cancel,
+		closing:      make(chan struct{}),
+	}
+
+	for _, sink := range sinks {
+		d := &fanoutDestination{
+			sink:    sink,
+			spool:   &spool{path: destinationSpoolPath(cfg.SpoolFile, sink.address)},
+			backlog: make([][]models.Metric, 0),
+			wake:    make(chan struct{}, 1),
+		}
+		batches, err := d.spool.load()
+		if err != nil {
+			log.Error().Err(err).Msgf("error reading the spool file %s", d.spool.path)
+		}
+		if len(batches) > 0 {
+			log.Info().Msgf("%d batches for %s restored from %s", len(batches), sink.address, d.spool.path)
+			d.backlog = append(d.backlog, batches...)
+		}
+		s.destinations = append(s.destinations, d)
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.run(ctx, d)
+		}()
+	}
+	return s
+}
+
+// destinationSpoolPath returns the spool file of a server next to the spool file of the agent,
+// e.g. tmp/agent-spool.localhost_8080.ndjson.
+func destinationSpoolPath(path string, address string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	name := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(address)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// Write adds the batch to the backlog of every server and returns without waiting for them.
+func (s *fanoutSink) Write(_ context.Context, metrics []models.Metric) error {
+	select {
+	case <-s.closing:
+		return errors.New("the fanout sink is closed")
+	default:
+	}
+
+	for _, d := range s.destinations {
+		d.push(metrics, s.key)
+	}
+	return nil
+}
+
+// run sends the backlog of the server until the context is done or the sink is closed and the backlog is empty.
+// A batch rejected by the server is dropped and counted as lost, after a retriable failure the server is given a pause.
+func (s *fanoutSink) run(ctx context.Context, d *fanoutDestination) {
+	for {
+		batch, ok := d.pop()
+		if !ok {
+			select {
+			case <-d.wake:
+				continue
+			case <-s.closing:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := sendWithRetry(ctx, func() error {
+			return d.sink.Write(ctx, batch)
+		})
+		switch {
+		case err == nil:
+			continue
+		case !isRetriable(err):
+			log.Error().Err(err).Msgf("batch of %d metrics was rejected by %s and is lost", len(batch), d.sink.address)
+			s.rejected.Add(1)
+			s.unreported.Add(1)
+			continue
+		}
+
+		d.pushFront(batch)
+		log.Warn().Err(err).Msgf("server %s is unavailable, %d batches are waiting for it", d.sink.address, d.pending())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(probeInterval):
+		}
+	}
+}
+
+// push adds the batch to the backlog. A full backlog is merged, so that a server that is down
+// for long gets the counter deltas added up instead of losing them.
+func (d *fanoutDestination) push(batch []models.Metric, key string) {
+	d.Lock()
+	if len(d.backlog) >= fanoutBacklog {
+		merged := mergeBatches(append(d.backlog, batch))
+		signMetrics(merged, key)
+		d.backlog = [][]models.Metric{merged}
+		log.Warn().Msgf("the backlog of %s is full, %d batches merged into one", d.sink.address, fanoutBacklog+1)
+	} else {
+		d.backlog = append(d.backlog, batch)
+	}
+	d.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *fanoutDestination) pop() ([]models.Metric, bool) {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.backlog) == 0 {
+		return nil, false
+	}
+	batch := d.backlog[0]
+	d.backlog = d.backlog[1:]
+	return batch, true
+}
+
+// pushFront returns a batch that failed to the head of the backlog.
+func (d *fanoutDestination) pushFront(batch []models.Metric) {
+	d.Lock()
+	defer d.Unlock()
+	d.backlog = append([][]models.Metric{batch}, d.backlog...)
+}
+
+// takeRejected returns the number of batches rejected since the previous call.
+func (s *fanoutSink) takeRejected() int64 {
+	return s.unreported.Swap(0)
+}
+
+func (d *fanoutDestination) pending() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.backlog)
+}
+
+// Close gives the servers the shutdown timeout to take their backlogs and saves the rest to their spool files.
+// It returns ErrSpooled if some batches were saved and another error if some were lost or rejected by a server.
+func (s *fanoutSink) Close() error {
+	close(s.closing)
+	for _, d := range s.destinations {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.timeout):
+		log.Warn().Msgf("the servers did not take their backlogs in %s, saving the rest", s.timeout)
+		s.cancel()
+		<-done
+	}
+	s.cancel()
+
+	spooled, lost := 0, int(s.rejected.Load())
+	for _, d := range s.destinations {
+		for _, batch := range d.backlog {
+			if err := d.spool.save(batch); err != nil {
+				log.Error().Err(err).Msgf("batch of %d metrics for %s is lost", len(batch), d.sink.address)
+				lost++
+				continue
+			}
+			spooled++
+		}
+		if len(d.backlog) > 0 {
+			log.Warn().Msgf("%d batches for %s saved to %s", len(d.backlog), d.sink.address, d.spool.path)
+		}
+	}
+
+	switch {
+	case lost > 0:
+		return fmt.Errorf("%d batches were rejected or neither sent nor saved", lost)
+	case spooled > 0:
+		return fmt.Errorf("%w: %d batches", ErrSpooled, spooled)
+	}
+	return nil
+}
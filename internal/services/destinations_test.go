@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer counts the counter deltas it receives, fails while down is set and rejects the batches while reject is set.
+type testServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	deltas map[string]int64
+	down   atomic.Bool
+	reject atomic.Bool
+	failN  atomic.Int64
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{deltas: make(map[string]int64)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.down.Load() || s.failN.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path == "/ping" {
+			return
+		}
+		if s.reject.Load() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var metrics []models.Metric
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&metrics))
+		s.mu.Lock()
+		for _, m := range metrics {
+			s.deltas[m.ID] += *m.Delta
+		}
+		s.mu.Unlock()
+	}))
+	return s
+}
+
+func (s *testServer) address() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func (s *testServer) total() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := int64(0)
+	for _, d := range s.deltas {
+		total += d
+	}
+	return total
+}
+
+func TestNewHTTPSinks(t *testing.T) {
+	sink, err := newHTTPSinks(http.DefaultClient, &configs.AgentCfg{Address: "localhost:8080", DestinationMode: ModeFanout})
+	require.NoError(t, err)
+	assert.IsType(t, &httpSink{}, sink)
+
+	sink, err = newHTTPSinks(http.DefaultClient, &configs.AgentCfg{Address: "localhost:8080, localhost:8081"})
+	require.NoError(t, err)
+	assert.IsType(t, &failoverSink{}, sink)
+
+	sink, err = newHTTPSinks(http.DefaultClient, &configs.AgentCfg{Address: "localhost:8080,localhost:8081",
+		DestinationMode: ModeFanout})
+	require.NoError(t, err)
+	assert.IsType(t, &fanoutSink{}, sink)
+	assert.NoError(t, sink.Close())
+
+	_, err = newHTTPSinks(http.DefaultClient, &configs.AgentCfg{Address: "localhost:8080,localhost:8081",
+		DestinationMode: "random"})
+	assert.Error(t, err)
+	_, err = newHTTPSinks(http.DefaultClient, &configs.AgentCfg{Address: " , ", DestinationMode: ModeFailover})
+	assert.Error(t, err)
+
+	assert.Equal(t, "tmp/agent-spool.localhost_8080.ndjson", destinationSpoolPath("tmp/agent-spool.ndjson", "localhost:8080"))
+	assert.Equal(t, "", destinationSpoolPath("", "localhost:8080"))
+}
+
+func TestFailoverSink(t *testing.T) {
+	defer func(interval time.Duration) { probeInterval = interval }(probeInterval)
+	probeInterval = 50 * time.Millisecond
+
+	primary, secondary := newTestServer(t), newTestServer(t)
+	defer primary.Close()
+	defer secondary.Close()
+
+	sink, err := newHTTPSinks(http.DefaultClient, &configs.AgentCfg{Address: primary.address() + "," + secondary.address(),
+		DestinationMode: ModeFailover})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, sink.Write(ctx, testMetrics(2)))
+	assert.Equal(t, int64(1), primary.total())
+
+	primary.down.Store(true)
+	require.NoError(t, sink.Write(ctx, testMetrics(3)))
+	require.NoError(t, sink.Write(ctx, testMetrics(3)))
+	assert.Equal(t, int64(1), primary.total())
+	assert.Equal(t, int64(6), secondary.total())
+
+	primary.down.Store(false)
+	time.Sleep(2 * probeInterval)
+	require.NoError(t, sink.Write(ctx, testMetrics(2)))
+	assert.Equal(t, int64(2), primary.total(), "the primary server was expected to be used again after a successful ping")
+	assert.Equal(t, int64(6), secondary.total())
+
+	primary.down.Store(true)
+	secondary.down.Store(true)
+	err = sink.Write(ctx, testMetrics(2))
+	assert.ErrorIs(t, err, ErrRetriable)
+}
+
+func TestFanoutSink(t *testing.T) {
+	defer func(delays []time.Duration, interval time.Duration) {
+		retryDelays, probeInterval = delays, interval
+	}(retryDelays, probeInterval)
+	retryDelays = []time.Duration{time.Millisecond, time.Millisecond}
+	probeInterval = 10 * time.Millisecond
+
+	first, second := newTestServer(t), newTestServer(t)
+	defer first.Close()
+	defer second.Close()
+
+	cfg := &configs.AgentCfg{Address: first.address() + "," + second.address(), DestinationMode: ModeFanout,
+		ShutdownTimeout: time.Second, SpoolFile: filepath.Join(t.TempDir(), "spool.ndjson")}
+	sink, err := newHTTPSinks(http.DefaultClient, cfg)
+	require.NoError(t, err)
+	ctx := context.Background()
+	delivered := func(s *testServer, total int64) func() bool {
+		return func() bool { return s.total() == total }
+	}
+
+	second.failN.Store(1)
+	require.NoError(t, sink.Write(ctx, testMetrics(4)))
+	assert.Eventually(t, delivered(first, 6), time.Second, time.Millisecond, "the batch was expected to be sent once to the healthy server")
+	assert.Eventually(t, delivered(second, 6), time.Second, time.Millisecond, "the batch was expected to be retried on the failed server")
+
+	second.down.Store(true)
+	start := time.Now()
+	require.NoError(t, sink.Write(ctx, testMetrics(4)))
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "the write was not expected to wait for the failed server")
+	assert.Eventually(t, delivered(first, 12), time.Second, time.Millisecond)
+	second.down.Store(false)
+	assert.Eventually(t, delivered(second, 12), time.Second, time.Millisecond, "the failed server was expected to get the batch when it is back")
+
+	second.down.Store(true)
+	require.NoError(t, sink.Write(ctx, testMetrics(4)))
+	assert.Eventually(t, delivered(first, 18), time.Second, time.Millisecond)
+	sink.(*fanoutSink).timeout = 50 * time.Millisecond
+	assert.ErrorIs(t, sink.Close(), ErrSpooled)
+
+	// a request cancelled by the shutdown may still reach the server, so the restart goes to another one
+	third := newTestServer(t)
+	defer third.Close()
+	require.NoError(t, os.Rename(destinationSpoolPath(cfg.SpoolFile, second.address()),
+		destinationSpoolPath(cfg.SpoolFile, third.address())))
+	cfg.Address = first.address() + "," + third.address()
+	sink, err = newHTTPSinks(http.DefaultClient, cfg)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	assert.Equal(t, int64(18), first.total(), "the spooled batch was not expected to be sent again to the server that had it")
+	assert.Equal(t, int64(6), third.total(), "the spooled batch was expected to be sent after the restart")
+}
+
+func TestFanoutSink_Rejected(t *testing.T) {
+	first, second := newTestServer(t), newTestServer(t)
+	defer first.Close()
+	defer second.Close()
+
+	cfg := &configs.AgentCfg{Address: first.address() + "," + second.address(), DestinationMode: ModeFanout,
+		ShutdownTimeout: time.Second, SpoolFile: filepath.Join(t.TempDir(), "spool.ndjson")}
+	sink, err := newHTTPSinks(http.DefaultClient, cfg)
+	require.NoError(t, err)
+	fanout := sink.(*fanoutSink)
+
+	second.reject.Store(true)
+	require.NoError(t, sink.Write(context.Background(), testMetrics(4)))
+	assert.Eventually(t, func() bool { return first.total() == 6 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return fanout.rejected.Load() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(1), fanout.takeRejected())
+	assert.Equal(t, int64(0), fanout.takeRejected(), "a rejected batch was expected to be reported once")
+
+	err = sink.Close()
+	assert.Error(t, err, "the rejected batch was expected to be counted as lost")
+	assert.NotErrorIs(t, err, ErrSpooled)
+	assert.Equal(t, int64(0), second.total())
+}
@@ -0,0 +1,325 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxPluginOutput limits the stdout of a plugin kept in memory.
+const maxPluginOutput = 1 << 20
+
+// pluginWaitDelay is how long the output of a plugin is read after it exits.
+const pluginWaitDelay = time.Second
+
+var (
+	ErrPluginTimeout = errors.New("plugin did not finish in time and was killed")
+	ErrPluginOutput  = errors.New("plugin output contains invalid lines")
+)
+
+// execPlugin is an executable whose stdout is parsed into metrics.
+type execPlugin struct {
+	Name     string           `json:"name"`
+	Command  []string         `json:"command"`
+	Interval configs.Duration `json:"interval"`
+	Timeout  configs.Duration `json:"timeout"`
+}
+
+// loadExecPlugins reads the plugin list from a JSON file. An empty path means no plugins.
+func loadExecPlugins(path string) ([]execPlugin, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var plugins []execPlugin
+	if err = json.Unmarshal(data, &plugins); err != nil {
+		return nil, fmt.Errorf("exec plugins file %s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range plugins {
+		p := &plugins[i]
+		if len(p.Name) == 0 || len(p.Command) == 0 {
+			return nil, fmt.Errorf("exec plugin #%d must have a name and a command", i+1)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("exec plugin %s is defined twice", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Interval <= 0 {
+			p.Interval = configs.Duration(10 * time.Second)
+		}
+		if p.Timeout <= 0 || p.Timeout > p.Interval {
+			p.Timeout = p.Interval
+		}
+	}
+	return plugins, nil
+}
+
+// CollectExec runs every exec plugin on its own interval until the context is done.
+func (ms *MetricsService) CollectExec(ctx context.Context) {
+	wg := &sync.WaitGroup{}
+	for i := range ms.execPlugins {
+		p := ms.execPlugins[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			interval := func() time.Duration { return time.Duration(p.Interval) }
+			ms.runCollector(ctx, "exec_"+p.Name, interval, func(ctx context.Context) ([]models.Metric, error) {
+				return ms.runPlugin(ctx, p)
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+// runPlugin runs the plugin once and parses its output.
+// The exit code, timeouts and parse errors are reported in the agent telemetry.
+func (ms *MetricsService) runPlugin(ctx context.Context, p execPlugin) ([]models.Metric, error) {
+	out, exitCode, err := runCommand(ctx, p.Command, time.Duration(p.Timeout))
+	ms.telemetry.set("exec_exit_code_"+p.Name, float64(exitCode))
+	if errors.Is(err, ErrPluginTimeout) {
+		ms.telemetry.add("exec_timeouts_"+p.Name, 1)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("exec plugin %s failed", p.Name)
+		return nil, err
+	}
+
+	metrics, invalid := parsePluginOutput(out)
+	if invalid > 0 {
+		ms.telemetry.add("exec_parse_errors_"+p.Name, int64(invalid))
+		log.Warn().Msgf("exec plugin %s printed %d invalid lines", p.Name, invalid)
+		return metrics, ErrPluginOutput
+	}
+	return metrics, nil
+}
+
+// runCommand runs the command and returns its stdout and exit code. If the command does not finish
+// before the timeout, it is killed together with the processes it has started.
+func runCommand(ctx context.Context, command []string, timeout time.Duration) ([]byte, int, error) {
+	stdout := &limitedBuffer{limit: maxPluginOutput}
+	stderr := &limitedBuffer{limit: 4096}
+
+	stdoutPipe, err := newOutputPipe(stdout)
+	if err != nil {
+		return nil, -1, err
+	}
+	stderrPipe, err := newOutputPipe(stderr)
+	if err != nil {
+		stdoutPipe.close()
+		return nil, -1, err
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = stdoutPipe.w
+	cmd.Stderr = stderrPipe.w
+	setProcessGroup(cmd)
+
+	err = cmd.Start()
+	// the command holds its own copies of the write ends
+	_ = stdoutPipe.w.Close()
+	_ = stderrPipe.w.Close()
+	if err != nil {
+		stdoutPipe.close()
+		stderrPipe.close()
+		return nil, -1, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-done:
+	case <-timer.C:
+		killProcessGroup(cmd)
+		<-done
+		stdoutPipe.close()
+		stderrPipe.close()
+		return nil, -1, ErrPluginTimeout
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		stdoutPipe.close()
+		stderrPipe.close()
+		return nil, -1, ctx.Err()
+	}
+
+	// The children of the plugin may still hold the pipes, their output is not waited for long.
+	deadline := time.Now().Add(pluginWaitDelay)
+	stdoutRead := stdoutPipe.wait(time.Until(deadline))
+	stderrRead := stderrPipe.wait(time.Until(deadline))
+	if !stdoutRead || !stderrRead {
+		killProcessGroup(cmd)
+	}
+	stdoutPipe.close()
+	stderrPipe.close()
+
+	exitCode := cmd.ProcessState.ExitCode()
+	if err != nil {
+		return nil, exitCode, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), exitCode, nil
+}
+
+// outputPipe copies the output of a command into a buffer. Unlike a writer set as the output of exec.Cmd,
+// it does not make cmd.Wait wait for every process holding the pipe, so the children left by a plugin
+// can't block the collector.
+type outputPipe struct {
+	r, w *os.File
+	done chan struct{}
+}
+
+func newOutputPipe(buf *limitedBuffer) (*outputPipe, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &outputPipe{r: r, w: w, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		_, _ = io.Copy(buf, r)
+	}()
+	return p, nil
+}
+
+// wait reports whether the output has been read to the end within the delay.
+func (p *outputPipe) wait(delay time.Duration) bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-p.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// close stops the copying and waits for it to return, the output read so far is kept in the buffer.
+// It must be called on every path once the command has been started, closing twice does no harm.
+func (p *outputPipe) close() {
+	_ = p.w.Close()
+	_ = p.r.Close()
+	<-p.done
+}
+
+// parsePluginOutput parses a JSON array of metrics or lines of the form "name type value".
+// Info metrics can only be printed in JSON.
+// Empty lines and lines starting with # are skipped. It returns the valid metrics and the number of invalid ones.
+func parsePluginOutput(out []byte) ([]models.Metric, int) {
+	out = bytes.TrimSpace(out)
+	if bytes.HasPrefix(out, []byte("[")) {
+		var metrics []models.Metric
+		if err := json.Unmarshal(out, &metrics); err != nil {
+			return nil, 1
+		}
+
+		valid := make([]models.Metric, 0, len(metrics))
+		for _, m := range metrics {
+			if len(m.ID) == 0 || isReserved(m.ID) || m.MType == Gauge && m.Value == nil || m.MType == Counter && m.Delta == nil ||
+				m.MType == Info && validateInfo(m.Info) != nil || m.MType != Gauge && m.MType != Counter && m.MType != Info {
+				continue
+			}
+			m.Hash = ""
+			valid = append(valid, m)
+		}
+		return valid, len(metrics) - len(valid)
+	}
+
+	metrics := make([]models.Metric, 0)
+	invalid := 0
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		m, err := parsePluginLine(line)
+		if err != nil {
+			invalid++
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, invalid
+}
+
+func parsePluginLine(line string) (models.Metric, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return models.Metric{}, fmt.Errorf("line %q must look like: name type value", line)
+	}
+
+	m := models.Metric{ID: fields[0], MType: fields[1]}
+	if isReserved(m.ID) {
+		return m, fmt.Errorf("metric %s: the prefix %s is reserved", m.ID, TelemetryPrefix)
+	}
+	switch m.MType {
+	case Gauge:
+		v, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return m, err
+		}
+		m.Value = &v
+	case Counter:
+		d, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return m, err
+		}
+		m.Delta = &d
+	default:
+		return m, ErrInvalidMetricType
+	}
+	return m, nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and silently discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePluginOutput(t *testing.T) {
+	metrics, invalid := parsePluginOutput([]byte("# queue lengths\nqueue_len gauge 12.5\n\nretries counter 3\nbroken\nx histogram 1\n"))
+	assert.Equal(t, 2, invalid)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, 12.5, *metrics[0].Value)
+	assert.Equal(t, int64(3), *metrics[1].Delta)
+
+	metrics, invalid = parsePluginOutput([]byte(`[{"id":"cert_days","type":"gauge","value":30},{"id":"bad","type":"counter"},
+		{"id":"openssl","type":"info","info":{"text":"3.0.2"}},{"id":"empty","type":"info"}]`))
+	assert.Equal(t, 2, invalid)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "cert_days", metrics[0].ID)
+	assert.Equal(t, "3.0.2", metrics[1].Info.Text)
+
+	_, invalid = parsePluginOutput([]byte(`[{"id":`))
+	assert.Equal(t, 1, invalid)
+
+	metrics, invalid = parsePluginOutput([]byte("agent_batches_sent counter 1\nok gauge 1\n"))
+	assert.Equal(t, 1, invalid, "the telemetry prefix was expected to be rejected")
+	assert.Len(t, metrics, 1)
+	metrics, invalid = parsePluginOutput([]byte(`[{"id":"agent_queue_depth","type":"gauge","value":0}]`))
+	assert.Equal(t, 1, invalid)
+	assert.Empty(t, metrics)
+}
+
+func TestRunCommand(t *testing.T) {
+	ctx := context.Background()
+
+	out, exitCode, err := runCommand(ctx, []string{"sh", "-c", "echo 'up gauge 1'"}, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "up gauge 1\n", string(out))
+
+	_, exitCode, err = runCommand(ctx, []string{"sh", "-c", "echo failed >&2; exit 3"}, time.Second)
+	assert.ErrorContains(t, err, "failed")
+	assert.Equal(t, 3, exitCode)
+
+	start := time.Now()
+	_, _, err = runCommand(ctx, []string{"sh", "-c", "sleep 10 & sleep 10"}, 100*time.Millisecond)
+	assert.ErrorIs(t, err, ErrPluginTimeout)
+	assert.Less(t, time.Since(start), 5*time.Second, "the plugin and its children were expected to be killed")
+
+	start = time.Now()
+	out, _, err = runCommand(ctx, []string{"sh", "-c", "echo 'up gauge 1'; sleep 10 &"}, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "up gauge 1\n", string(out))
+	assert.Less(t, time.Since(start), 5*time.Second, "the children holding the output were not expected to be waited for")
+
+	// the pipes are closed after every run
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		for i := 0; i < 20; i++ {
+			_, _, err = runCommand(ctx, []string{"sh", "-c", "echo 'up gauge 1'"}, time.Second)
+			require.NoError(t, err)
+		}
+		after, err := os.ReadDir("/proc/self/fd")
+		require.NoError(t, err)
+		assert.Less(t, len(after)-len(fds), 5, "the plugin runs were not expected to leak file descriptors")
+	}
+}
+
+func TestLoadExecPlugins(t *testing.T) {
+	plugins, err := loadExecPlugins("")
+	assert.NoError(t, err)
+	assert.Empty(t, plugins)
+
+	path := filepath.Join(t.TempDir(), "plugins.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "queues", "command": ["/bin/queues.sh"], "interval": "30s", "timeout": "5s"},
+		{"name": "certs", "command": ["/bin/certs.sh", "-v"]}
+	]`), 0o600))
+
+	plugins, err = loadExecPlugins(path)
+	require.NoError(t, err)
+	require.Len(t, plugins, 2)
+	assert.Equal(t, configs.Duration(30*time.Second), plugins[0].Interval)
+	assert.Equal(t, configs.Duration(5*time.Second), plugins[0].Timeout)
+	assert.Equal(t, configs.Duration(10*time.Second), plugins[1].Timeout)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name": "queues"}]`), 0o600))
+	_, err = loadExecPlugins(path)
+	assert.Error(t, err)
+}
+
+func TestMetricService_RunPlugin(t *testing.T) {
+	ms, err := NewMetricsService(&configs.AgentCfg{RateLimit: 1})
+	require.NoError(t, err)
+
+	p := execPlugin{Name: "test", Command: []string{"sh", "-c", "echo 'jobs counter 2'; echo garbage"},
+		Timeout: configs.Duration(time.Second)}
+	for i := 0; i < 2; i++ {
+		metrics, err := ms.runPlugin(context.Background(), p)
+		assert.ErrorIs(t, err, ErrPluginOutput)
+		ms.store("exec_test", metrics, err != nil)
+	}
+
+	ms.Lock()
+	metrics := ms.drainCollected()
+	ms.Unlock()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(4), *metrics[0].Delta, "counter deltas were expected to add up until the report")
+
+	ms.Lock()
+	assert.Empty(t, ms.drainCollected(), "counters were expected to be sent once")
+	ms.Unlock()
+
+	p.Command = []string{"sh", "-c", "echo 'up gauge 1'"}
+	metrics, err = ms.runPlugin(context.Background(), p)
+	require.NoError(t, err)
+	ms.store("exec_test", metrics, false)
+	p.Command = []string{"sh", "-c", "exit 1"}
+	metrics, err = ms.runPlugin(context.Background(), p)
+	assert.Error(t, err)
+	ms.store("exec_test", metrics, true)
+
+	ms.Lock()
+	assert.Empty(t, ms.drainCollected(), "the gauges of a failed plugin were expected to be forgotten")
+	ms.Unlock()
+
+	status := ms.telemetry.collect(0, false)
+	assert.Equal(t, int64(2), *findMetric(status, "agent_exec_parse_errors_test").Delta)
+	assert.Equal(t, 1.0, *findMetric(status, "agent_exec_exit_code_test").Value)
+}
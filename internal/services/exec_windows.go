@@ -0,0 +1,14 @@
+//go:build windows
+
+package services
+
+import "os/exec"
+
+// setProcessGroup does nothing on Windows.
+func setProcessGroup(_ *exec.Cmd) {}
+
+// killProcessGroup kills the command, the processes it has started are left alone on Windows.
+// They can't hold up runCommand, the output pipes are closed after a short delay.
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
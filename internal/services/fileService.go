@@ -2,13 +2,15 @@ package services
 
 import (
 	"context"
-	"crypto/hmac"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"os"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/dbulyk/metrics-alerting-service/internal/fileio"
+	"github.com/dbulyk/metrics-alerting-service/internal/hub"
 	"github.com/dbulyk/metrics-alerting-service/internal/storages"
 
 	"github.com/dbulyk/metrics-alerting-service/internal/models"
@@ -18,8 +20,12 @@ import (
 )
 
 const (
-	Counter = "counter"
-	Gauge   = "gauge"
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+	Summary   = "summary"
+	Set       = "set"
+	Info      = "info"
 )
 
 var (
@@ -31,42 +37,71 @@ var (
 type fileRepository struct {
 	sync.Mutex
 	metrics       []*models.Metric
+	agentConfigs  []models.AgentConfigRule
 	storeInterval time.Duration
 	storeFile     string
 	key           string
+	hub           *hub.Hub
 }
 
 // NewFileRepository creates a new repository for working with the file and returns a pointer to it.
+// Agent configs are kept next to the store file and loaded from it right away.
 func NewFileRepository(storeFile string, storeInterval time.Duration, key string) storages.IRepository {
-	return &fileRepository{
+	fr := &fileRepository{
 		metrics:       make([]*models.Metric, 0, 50),
 		Mutex:         sync.Mutex{},
 		storeFile:     storeFile,
 		storeInterval: storeInterval,
 		key:           key,
+		hub:           hub.New(),
 	}
+
+	if len(storeFile) != 0 {
+		data, err := os.ReadFile(fr.agentConfigsFile())
+		if err == nil {
+			err = json.Unmarshal(data, &fr.agentConfigs)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error().Err(err).Msg("error of reading the agent configs")
+		}
+	}
+	return fr
 }
 
-// GetAll returns all metrics from the file.
+// GetAll returns the copies of all metrics from the file, so they can be read while the metrics are updated.
+// The updates replace the fields of a stored metric, a shallow copy is enough.
 func (fr *fileRepository) GetAll(_ context.Context) ([]*models.Metric, error) {
 	fr.Lock()
-	var m = make([]*models.Metric, len(fr.metrics))
-	copy(m, fr.metrics)
+	var m = make([]*models.Metric, 0, len(fr.metrics))
+	for _, stored := range fr.metrics {
+		c := *stored
+		m = append(m, &c)
+	}
 	fr.Unlock()
 	return m, nil
 }
 
+// List returns the metrics selected by the filter.
+func (fr *fileRepository) List(_ context.Context, filter models.MetricFilter) ([]*models.Metric, error) {
+	if err := validateFilter(filter); err != nil {
+		return nil, err
+	}
+	fr.Lock()
+	defer fr.Unlock()
+	return listMetrics(fr.metrics, filter), nil
+}
+
 // Set adds a new metric to the file or updates an existing one, check hash and add delta to existing counter.
 func (fr *fileRepository) Set(ctx context.Context, metric models.Metric) (*models.Metric, error) {
 	fr.Lock()
 	defer fr.Unlock()
 
-	m, err := addToStorage(&fr.metrics, metric, fr.key)
+	stored, err := addToStorage(&fr.metrics, metric, fr.key)
 	if err != nil {
 		log.Error().Err(err).Msgf("an error occurred in saving metric %s, it will not be added", metric.ID)
 		return nil, err
 	}
-	fr.metrics = m
+	publishMetric(fr.hub, stored)
 
 	if len(fr.storeFile) != 0 && fr.storeInterval == 0 {
 		producer, err := fileio.NewProducer(fr.storeFile)
@@ -102,11 +137,12 @@ func (fr *fileRepository) Updates(ctx context.Context, metrics []models.Metric)
 	defer fr.Unlock()
 
 	for _, metric := range metrics {
-		_, err := addToStorage(&fr.metrics, metric, fr.key)
+		stored, err := addToStorage(&fr.metrics, metric, fr.key)
 		if err != nil {
 			log.Error().Err(err).Msgf("an error occurred in saving metric %s, it will not be added", metric.ID)
 			continue
 		}
+		publishMetric(fr.hub, stored)
 	}
 
 	if len(fr.storeFile) != 0 && fr.storeInterval == 0 {
@@ -124,55 +160,140 @@ func (fr *fileRepository) Updates(ctx context.Context, metrics []models.Metric)
 	return metrics, nil
 }
 
+// Delete removes a metric by name and type.
+func (fr *fileRepository) Delete(ctx context.Context, mName string, mType string) error {
+	fr.Lock()
+	deleted := fr.remove(func(m *models.Metric) bool { return m.ID == mName && m.MType == mType })
+	fr.Unlock()
+	if deleted == 0 {
+		return ErrInvalidMetric
+	}
+	return fr.storeNow(ctx)
+}
+
+// DeleteMatching removes the metrics selected by the prefix, the regular expression and the type of the filter
+// and returns their number.
+func (fr *fileRepository) DeleteMatching(ctx context.Context, filter models.MetricFilter) (int, error) {
+	if err := validateDeleteFilter(filter); err != nil {
+		return 0, err
+	}
+	var re *regexp.Regexp
+	if len(filter.Regexp) > 0 {
+		re = regexp.MustCompile(filter.Regexp)
+	}
+
+	fr.Lock()
+	deleted := fr.remove(func(m *models.Metric) bool { return matchFilter(m.ID, m.MType, filter, re) })
+	fr.Unlock()
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, fr.storeNow(ctx)
+}
+
+// remove removes the metrics for which the function returns true, it must be called with the lock held.
+func (fr *fileRepository) remove(match func(m *models.Metric) bool) int {
+	kept := make([]*models.Metric, 0, len(fr.metrics))
+	for _, m := range fr.metrics {
+		if !match(m) {
+			kept = append(kept, m)
+		}
+	}
+	deleted := len(fr.metrics) - len(kept)
+	fr.metrics = kept
+	return deleted
+}
+
+// storeNow writes the metrics to the file right away if the store interval is 0.
+// It must be called without the lock, because the producer reads the metrics with GetAll.
+func (fr *fileRepository) storeNow(ctx context.Context) error {
+	if len(fr.storeFile) == 0 || fr.storeInterval != 0 {
+		return nil
+	}
+	producer, err := fileio.NewProducer(fr.storeFile)
+	if err != nil {
+		return err
+	}
+	if err = producer.Save(ctx, fr, fr.storeFile); err != nil {
+		log.Error().Err(err).Msg("error saving metrics to file")
+		return err
+	}
+	return nil
+}
+
+// Hub returns the hub publishing the accepted metrics.
+func (fr *fileRepository) Hub() *hub.Hub {
+	return fr.hub
+}
+
 // Ping return nil.
 func (fr *fileRepository) Ping() error {
 	return nil
 }
 
-func addToStorage(metrics *[]*models.Metric, metric models.Metric, key string) ([]*models.Metric, error) {
-	if metric.MType != Counter && metric.MType != Gauge {
-		log.Error().Msgf("like metric %s doesn't exist", metric.MType)
-		return nil, ErrInvalidMetricType
-	}
+// SetAgentConfig adds a new agent config rule or replaces the rule with the same ID.
+func (fr *fileRepository) SetAgentConfig(_ context.Context, rule models.AgentConfigRule) error {
+	fr.Lock()
+	defer fr.Unlock()
 
-	var mHash, s string
-	if len(key) > 0 {
-		switch metric.MType {
-		case Gauge:
-			s = fmt.Sprintf("%s:%s:%f", metric.ID, metric.MType, *metric.Value)
-		case Counter:
-			s = fmt.Sprintf("%s:%s:%d", metric.ID, metric.MType, *metric.Delta)
+	replaced := false
+	for i := range fr.agentConfigs {
+		if fr.agentConfigs[i].ID == rule.ID {
+			fr.agentConfigs[i] = rule
+			replaced = true
 		}
+	}
+	if !replaced {
+		fr.agentConfigs = append(fr.agentConfigs, rule)
+	}
 
-		mHash = utils.Hash(s, key)
-		if !hmac.Equal([]byte(mHash), []byte(metric.Hash)) {
-			log.Error().Msgf("the incoming hash does not match the calculated hash. Metric %s will not be added",
-				metric.ID)
-			return nil, ErrInvalidHash
-		}
+	if len(fr.storeFile) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(fr.agentConfigs)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(fr.agentConfigsFile(), data, 0644)
+	if err != nil {
+		log.Error().Err(err).Msg("error of saving the agent configs")
+		return err
+	}
+	return nil
+}
+
+// GetAgentConfig returns the config chosen for the agent by its ID and labels.
+func (fr *fileRepository) GetAgentConfig(_ context.Context, agentID string, labels map[string]string) (*models.AgentConfig, error) {
+	fr.Lock()
+	defer fr.Unlock()
+	return matchAgentConfig(fr.agentConfigs, agentID, labels)
+}
+
+func (fr *fileRepository) agentConfigsFile() string {
+	return fr.storeFile + ".agents"
+}
+
+// addToStorage adds the metric to the storage or merges it into the stored one and returns the stored metric.
+func addToStorage(metrics *[]*models.Metric, metric models.Metric, key string) (*models.Metric, error) {
+	if err := prepareMetric(&metric, key); err != nil {
+		log.Error().Err(err).Msgf("metric %s of type %s is rejected", metric.ID, metric.MType)
+		return nil, err
 	}
 
-	isNotFound := true
 	for _, m := range *metrics {
 		if m.ID == metric.ID && m.MType == metric.MType {
-			isNotFound = false
-			if m.MType == Counter {
-				d := *m.Delta + *metric.Delta
-				m.Delta = &d
-				if len(key) > 0 {
-					s = fmt.Sprintf("%s:%s:%d", m.ID, m.MType, *m.Delta)
-					mHash = utils.Hash(s, key)
-				}
-			} else {
-				m.Value = metric.Value
+			if err := mergeMetric(m, metric); err != nil {
+				return nil, err
 			}
-			m.Hash = mHash
-		}
-	}
 
-	if isNotFound {
-		*metrics = append(*metrics, &metric)
+			m.Hash = ""
+			if len(key) > 0 {
+				m.Hash = utils.Hash(hashSource(*m), key)
+			}
+			return m, nil
+		}
 	}
 
-	return *metrics, nil
+	*metrics = append(*metrics, &metric)
+	return &metric, nil
 }
@@ -274,3 +274,26 @@ func TestRestoreMetricsFromFile(t *testing.T) {
 		assert.Equal(t, expectedMetric, metric)
 	}
 }
+
+func TestFileRepository_Publish(t *testing.T) {
+	storage := NewFileRepository("", time.Second, "test")
+	ctx := context.Background()
+	sub := storage.Hub().Subscribe(10, nil)
+	defer sub.Close()
+
+	delta := int64(3)
+	m := models.Metric{ID: "PollCount", MType: Counter, Delta: &delta}
+	m.Hash = utils.Hash(hashSource(m), "test")
+	_, err := storage.Updates(ctx, []models.Metric{m, {ID: "Alloc", MType: Gauge, Hash: "wrong"}, m})
+	require.NoError(t, err)
+
+	for _, want := range []int64{3, 6} {
+		u := <-sub.Updates()
+		var published models.Metric
+		require.NoError(t, json.Unmarshal(u.Data, &published))
+		assert.Equal(t, "PollCount", u.ID)
+		assert.Equal(t, want, *published.Delta)
+		assert.NotNil(t, published.UpdatedAt)
+	}
+	assert.Empty(t, sub.Updates(), "the rejected metric was not expected to be published")
+}
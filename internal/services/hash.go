@@ -0,0 +1,29 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+// hashSource returns the string signed by the hash of the metric: id:type:value for gauges,
+// id:type:delta for counters, id:type:bounds:counts:count:sum for histograms and
+// id:type:accuracy:negative bins:positive bins:zero:count:sum for summaries,
+// id:type:items:sha256 of registers for sets and id:type:text:labels for info, see infoHashSource.
+func hashSource(m models.Metric) string {
+	switch {
+	case m.MType == Gauge && m.Value != nil:
+		return fmt.Sprintf("%s:%s:%f", m.ID, m.MType, *m.Value)
+	case m.MType == Counter && m.Delta != nil:
+		return fmt.Sprintf("%s:%s:%d", m.ID, m.MType, *m.Delta)
+	case m.MType == Histogram:
+		return fmt.Sprintf("%s:%s:%s", m.ID, m.MType, histogramHashSource(m.Histogram))
+	case m.MType == Summary:
+		return fmt.Sprintf("%s:%s:%s", m.ID, m.MType, summaryHashSource(m.Summary))
+	case m.MType == Set:
+		return fmt.Sprintf("%s:%s:%s", m.ID, m.MType, setHashSource(m.Set))
+	case m.MType == Info:
+		return fmt.Sprintf("%s:%s:%s", m.ID, m.MType, infoHashSource(m.Info))
+	}
+	return fmt.Sprintf("%s:%s:", m.ID, m.MType)
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+// DefaultHistogramBounds are the bucket bounds of the histograms created from single observations.
+var DefaultHistogramBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ReadQuantiles are the quantiles added to the histograms and the summaries on read.
+var ReadQuantiles = []float64{0.5, 0.9, 0.99}
+
+var (
+	ErrInvalidHistogram = errors.New("invalid histogram")
+	ErrHistogramBounds  = errors.New("histogram bounds do not match the stored ones")
+)
+
+// NewHistogram returns a histogram with the given bounds holding one observation.
+func NewHistogram(bounds []float64, value float64) *models.Histogram {
+	h := &models.Histogram{
+		Bounds: append([]float64(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+		Sum:    value,
+		Count:  1,
+	}
+	h.Counts[sort.SearchFloat64s(bounds, value)]++
+	return h
+}
+
+// validateHistogram checks that the bounds increase and the counts agree with them and with the total count.
+func validateHistogram(h *models.Histogram) error {
+	if h == nil {
+		return fmt.Errorf("%w: no buckets", ErrInvalidHistogram)
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: %d bounds need %d counts including +Inf, got %d",
+			ErrInvalidHistogram, len(h.Bounds), len(h.Bounds)+1, len(h.Counts))
+	}
+	for i, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) || i > 0 && b <= h.Bounds[i-1] {
+			return fmt.Errorf("%w: bounds must be finite and increase", ErrInvalidHistogram)
+		}
+	}
+	var count uint64
+	for _, c := range h.Counts {
+		count += c
+	}
+	if count != h.Count {
+		return fmt.Errorf("%w: count %d differs from the sum of the buckets %d", ErrInvalidHistogram, h.Count, count)
+	}
+	return nil
+}
+
+// mergeHistograms adds the bucket counts, the sums and the counts of two histograms with the same bounds.
+// The result is a new histogram, the arguments are not changed.
+func mergeHistograms(stored, incoming *models.Histogram) (*models.Histogram, error) {
+	if len(stored.Bounds) != len(incoming.Bounds) {
+		return nil, ErrHistogramBounds
+	}
+	for i := range stored.Bounds {
+		if stored.Bounds[i] != incoming.Bounds[i] {
+			return nil, ErrHistogramBounds
+		}
+	}
+
+	merged := &models.Histogram{
+		Bounds: append([]float64(nil), stored.Bounds...),
+		Counts: make([]uint64, len(stored.Counts)),
+		Sum:    stored.Sum + incoming.Sum,
+		Count:  stored.Count + incoming.Count,
+	}
+	for i := range stored.Counts {
+		merged.Counts[i] = stored.Counts[i] + incoming.Counts[i]
+	}
+	return merged, nil
+}
+
+// HistogramQuantile estimates the quantile by linear interpolation inside the bucket it falls in.
+// The lower bound of the first bucket is 0 unless its upper bound is negative, the +Inf bucket
+// returns the highest finite bound.
+func HistogramQuantile(h *models.Histogram, q float64) float64 {
+	if h == nil || h.Count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+
+	rank := q * float64(h.Count)
+	var cumulative uint64
+	for i, c := range h.Counts {
+		if float64(cumulative+c) < rank || c == 0 {
+			cumulative += c
+			continue
+		}
+		if i == len(h.Bounds) {
+			if len(h.Bounds) == 0 {
+				return math.NaN()
+			}
+			return h.Bounds[len(h.Bounds)-1]
+		}
+
+		upper := h.Bounds[i]
+		lower := 0.0
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		} else if upper < 0 {
+			return upper
+		}
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(c)
+	}
+	return math.NaN()
+}
+
+// QuantileName returns the name of the quantile like p50 or p99.9.
+func QuantileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'f', -1, 64)
+}
+
+// histogramHashSource is the part of the signed string describing the histogram. The bounds are signed
+// as well, the quantiles computed from the counts depend on them.
+func histogramHashSource(h *models.Histogram) string {
+	if h == nil {
+		return ""
+	}
+	bounds := make([]string, len(h.Bounds))
+	for i, b := range h.Bounds {
+		bounds[i] = strconv.FormatFloat(b, 'g', -1, 64)
+	}
+	counts := make([]string, len(h.Counts))
+	for i, c := range h.Counts {
+		counts[i] = strconv.FormatUint(c, 10)
+	}
+	return fmt.Sprintf("%s:%s:%d:%f", strings.Join(bounds, ","), strings.Join(counts, ","), h.Count, h.Sum)
+}
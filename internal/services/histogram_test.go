@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testHistogram() *models.Histogram {
+	return &models.Histogram{
+		Bounds: []float64{0.1, 0.5, 1},
+		Counts: []uint64{2, 6, 2, 0},
+		Sum:    4.2,
+		Count:  10,
+	}
+}
+
+func TestNewHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 0.5, 1}, 0.5)
+	assert.Equal(t, []uint64{0, 1, 0, 0}, h.Counts)
+	assert.NoError(t, validateHistogram(h))
+
+	h = NewHistogram([]float64{0.1, 0.5, 1}, 7)
+	assert.Equal(t, []uint64{0, 0, 0, 1}, h.Counts)
+}
+
+func TestValidateHistogram(t *testing.T) {
+	assert.NoError(t, validateHistogram(testHistogram()))
+	assert.ErrorIs(t, validateHistogram(nil), ErrInvalidHistogram)
+
+	h := testHistogram()
+	h.Counts = h.Counts[:3]
+	assert.ErrorIs(t, validateHistogram(h), ErrInvalidHistogram)
+
+	h = testHistogram()
+	h.Bounds[1] = 0.05
+	assert.ErrorIs(t, validateHistogram(h), ErrInvalidHistogram)
+
+	h = testHistogram()
+	h.Count = 11
+	assert.ErrorIs(t, validateHistogram(h), ErrInvalidHistogram)
+}
+
+func TestMergeHistograms(t *testing.T) {
+	stored, incoming := testHistogram(), testHistogram()
+	merged, err := mergeHistograms(stored, incoming)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{4, 12, 4, 0}, merged.Counts)
+	assert.Equal(t, uint64(20), merged.Count)
+	assert.InDelta(t, 8.4, merged.Sum, 1e-9)
+	assert.Equal(t, testHistogram(), stored, "the stored histogram was not expected to change")
+
+	incoming.Bounds = []float64{0.1, 0.5, 2}
+	_, err = mergeHistograms(stored, incoming)
+	assert.ErrorIs(t, err, ErrHistogramBounds)
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := testHistogram()
+	assert.InDelta(t, 0.05, HistogramQuantile(h, 0.1), 1e-9)
+	assert.InDelta(t, 0.3, HistogramQuantile(h, 0.5), 1e-9)
+	assert.InDelta(t, 0.75, HistogramQuantile(h, 0.9), 1e-9)
+	assert.InDelta(t, 1, HistogramQuantile(h, 1), 1e-9)
+
+	h.Counts = []uint64{0, 0, 0, 10}
+	assert.Equal(t, 1.0, HistogramQuantile(h, 0.5), "the +Inf bucket returns the highest bound")
+	assert.True(t, math.IsNaN(HistogramQuantile(&models.Histogram{Counts: []uint64{0}}, 0.5)))
+
+	m := &models.Metric{ID: "latency", MType: Histogram, Histogram: testHistogram()}
+	m = WithEstimates(m)
+	assert.Equal(t, map[string]float64{"p50": 0.3, "p90": 0.75, "p99": 0.975}, roundQuantiles(m.Histogram.Quantiles))
+}
+
+func roundQuantiles(quantiles map[string]float64) map[string]float64 {
+	for k, v := range quantiles {
+		quantiles[k] = math.Round(v*1e6) / 1e6
+	}
+	return quantiles
+}
+
+func TestFileRepository_Histogram(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	repo := NewFileRepository("", time.Second, "test")
+
+	m := models.Metric{ID: "latency", MType: Histogram, Histogram: testHistogram()}
+	m.Hash = utils.Hash("latency:histogram:0.1,0.5,1:2,6,2,0:10:4.200000", "test")
+	for i := 0; i < 2; i++ {
+		_, err := repo.Set(ctx, m)
+		require.NoError(t, err)
+	}
+
+	stored, err := repo.Get(ctx, "latency", Histogram)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{4, 12, 4, 0}, stored.Histogram.Counts)
+	assert.Equal(t, utils.Hash(hashSource(*stored), "test"), stored.Hash)
+
+	m.Histogram = &models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 1, Count: 1}
+	m.Hash = utils.Hash(hashSource(m), "test")
+	updated := *stored.UpdatedAt
+	later := updated.Add(time.Hour)
+	m.UpdatedAt = &later
+	_, err = repo.Set(ctx, m)
+	assert.ErrorIs(t, err, ErrHistogramBounds)
+	rejected, err := repo.Get(ctx, "latency", Histogram)
+	require.NoError(t, err)
+	assert.Equal(t, updated, *rejected.UpdatedAt, "a rejected update was not expected to move the update time")
+	m.UpdatedAt = nil
+
+	m.Hash = "wrong"
+	_, err = repo.Set(ctx, m)
+	assert.ErrorIs(t, err, ErrInvalidHash)
+}
+
+func TestDBRepository_Histogram(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	repo := &dbRepository{db: db}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mock.ExpectQuery("select histogram, summary, registers from metrics (.+)").WithArgs("latency", Histogram).
+		WillReturnRows(sqlmock.NewRows([]string{"histogram", "summary", "registers"}).
+			AddRow(`{"bounds":[0.1,0.5,1],"counts":[2,6,2,0],"sum":4.2,"count":10}`, nil, nil))
+	mock.ExpectExec("insert into metrics(.+)").
+		WithArgs("latency", Histogram, nil, nil, "",
+			`{"bounds":[0.1,0.5,1],"counts":[4,12,4,0],"sum":8.4,"count":20}`, nil, nil, nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	m, err := repo.Set(ctx, models.Metric{ID: "latency", MType: Histogram, Histogram: testHistogram()})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), m.Histogram.Count)
+
+	mock.ExpectQuery("^select (.+) from metrics where (.+)").WithArgs("latency", Histogram).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "mtype", "delta", "value", "hash", "histogram", "summary", "registers", "info", "updated_at"}).
+			AddRow("latency", Histogram, nil, nil, "", `{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}`, nil, nil, nil, nil))
+	m, err = repo.Get(ctx, "latency", Histogram)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 0}, m.Histogram.Counts)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/hub"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// HistorySize is the number of recent values kept for every metric.
+const HistorySize = 60
+
+// historyBuffer is the number of updates the history may lag behind before it is dropped and resubscribes.
+const historyBuffer = 1024
+
+// historyRemovedTTL is how long the deletion of a metric is remembered, much longer than the history lags behind.
+const historyRemovedTTL = time.Minute
+
+// HistoryPoint is a value of a metric at the time of its update.
+type HistoryPoint struct {
+	T time.Time `json:"t"`
+	V float64   `json:"v"`
+}
+
+type historyKey struct {
+	id    string
+	mType string
+}
+
+// History keeps the recent values of the metrics in memory. The repositories keep only the current values,
+// so the history starts empty with the server and is fed by the updates published to the hub.
+type History struct {
+	sync.Mutex
+	size   int
+	points map[historyKey][]HistoryPoint
+	// removed keeps the time the metrics were deleted at for historyRemovedTTL or until they are updated again.
+	removed map[historyKey]time.Time
+}
+
+// NewHistory creates a new history keeping size values of every metric and returns a pointer to it.
+func NewHistory(size int) *History {
+	return &History{size: size, points: make(map[historyKey][]HistoryPoint), removed: make(map[historyKey]time.Time)}
+}
+
+// Follow records the updates published to the hub until it is closed.
+func (h *History) Follow(updates *hub.Hub) {
+	for {
+		sub := updates.Subscribe(historyBuffer, nil)
+		for u := range sub.Updates() {
+			var m models.Metric
+			if err := json.Unmarshal(u.Data, &m); err != nil {
+				log.Error().Err(err).Msgf("metric %s decoding error", u.ID)
+				continue
+			}
+			h.Add(&m)
+		}
+		if err := sub.Err(); !errors.Is(err, hub.ErrSlowSubscriber) {
+			return
+		}
+		log.Warn().Msg("the metric history fell behind the updates, some values are missed")
+	}
+}
+
+// Add records the value of the metric at its update time, the oldest value is dropped when the history is full.
+// Info metrics have no value and are not recorded.
+func (h *History) Add(m *models.Metric) {
+	v, ok := MetricValue(m)
+	if !ok {
+		return
+	}
+	t := time.Now()
+	if m.UpdatedAt != nil {
+		t = *m.UpdatedAt
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	key := historyKey{id: m.ID, mType: m.MType}
+	if removed, ok := h.removed[key]; ok {
+		if !t.After(removed) {
+			return
+		}
+		delete(h.removed, key)
+	}
+	points := append(h.points[key], HistoryPoint{T: t, V: v})
+	if len(points) > h.size {
+		points = points[len(points)-h.size:]
+	}
+	h.points[key] = points
+}
+
+// Remove forgets the values of a deleted metric. The updates made before the deletion that reach the history
+// later are ignored, so the metric does not come back with its old values.
+func (h *History) Remove(id string, mType string) {
+	h.Lock()
+	defer h.Unlock()
+	h.remove(historyKey{id: id, mType: mType}, time.Now())
+}
+
+// RemoveMatching forgets the values of the deleted metrics the function returns true for.
+func (h *History) RemoveMatching(match func(id string, mType string) bool) {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now()
+	for key := range h.points {
+		if match(key.id, key.mType) {
+			h.remove(key, now)
+		}
+	}
+}
+
+// remove must be called with the lock held.
+func (h *History) remove(key historyKey, now time.Time) {
+	for k, removed := range h.removed {
+		if now.Sub(removed) > historyRemovedTTL {
+			delete(h.removed, k)
+		}
+	}
+	delete(h.points, key)
+	h.removed[key] = now
+}
+
+// Get returns the recorded values of the metric from the oldest to the latest.
+func (h *History) Get(id string, mType string) []HistoryPoint {
+	h.Lock()
+	defer h.Unlock()
+	points := h.points[historyKey{id: id, mType: mType}]
+	result := make([]HistoryPoint, len(points))
+	copy(result, points)
+	return result
+}
+
+// MetricValue returns the value of a gauge, the delta of a counter, the count of a histogram or a summary
+// and the cardinality estimate of a set.
+func MetricValue(m *models.Metric) (float64, bool) {
+	switch {
+	case m.MType == Gauge && m.Value != nil:
+		return *m.Value, true
+	case m.MType == Counter && m.Delta != nil:
+		return float64(*m.Delta), true
+	case m.MType == Histogram && m.Histogram != nil:
+		return float64(m.Histogram.Count), true
+	case m.MType == Summary && m.Summary != nil:
+		return float64(m.Summary.Count), true
+	case m.MType == Set && m.Set != nil:
+		return float64(SetCardinality(m.Set)), true
+	}
+	return 0, false
+}
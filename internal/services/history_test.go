@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(3)
+	start := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		v := float64(i)
+		at := start.Add(time.Duration(i) * time.Second)
+		h.Add(&models.Metric{ID: "Alloc", MType: Gauge, Value: &v, UpdatedAt: &at})
+	}
+	h.Add(&models.Metric{ID: "version", MType: Info, Info: &models.Info{Text: "1.0"}})
+
+	points := h.Get("Alloc", Gauge)
+	require.Len(t, points, 3, "the oldest values were expected to be dropped")
+	assert.Equal(t, HistoryPoint{T: start.Add(2 * time.Second), V: 2}, points[0])
+	assert.Equal(t, 4.0, points[2].V)
+	assert.Empty(t, h.Get("Alloc", Counter))
+	assert.Empty(t, h.Get("version", Info))
+
+	h.Add(&models.Metric{ID: "Alloc", MType: Counter, Delta: new(int64)})
+	h.Add(&models.Metric{ID: "Frees", MType: Gauge, Value: new(float64)})
+	h.RemoveMatching(func(id string, mType string) bool { return mType == Gauge })
+	assert.Empty(t, h.Get("Alloc", Gauge))
+	assert.Empty(t, h.Get("Frees", Gauge))
+	assert.Len(t, h.Get("Alloc", Counter), 1)
+
+	// an update made before the deletion and received after it does not bring the metric back
+	v := 5.0
+	h.Add(&models.Metric{ID: "Alloc", MType: Gauge, Value: &v, UpdatedAt: &start})
+	assert.Empty(t, h.Get("Alloc", Gauge))
+	h.Remove("Alloc", Counter)
+	assert.Empty(t, h.Get("Alloc", Counter))
+	h.Add(&models.Metric{ID: "Alloc", MType: Counter, Delta: new(int64)})
+	assert.Len(t, h.Get("Alloc", Counter), 1, "a later update was expected to be recorded")
+}
+
+func TestHistory_Follow(t *testing.T) {
+	storage := NewFileRepository("", time.Second, "")
+	h := NewHistory(HistorySize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Follow(storage.Hub())
+	}()
+	require.Eventually(t, storage.Hub().Active, time.Second, time.Millisecond)
+
+	delta := int64(2)
+	for i := 0; i < 2; i++ {
+		_, err := storage.Set(context.Background(), models.Metric{ID: "PollCount", MType: Counter, Delta: &delta})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return len(h.Get("PollCount", Counter)) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, 4.0, h.Get("PollCount", Counter)[1].V)
+
+	storage.Hub().Close()
+	<-done
+}
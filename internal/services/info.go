@@ -0,0 +1,120 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/rs/zerolog/log"
+	"github.com/shirou/gopsutil/v3/host"
+)
+
+// MaxInfoSize limits the total length of the text, the label names and the label values of an info metric.
+const MaxInfoSize = 4096
+
+var ErrInvalidInfo = errors.New("invalid info")
+
+// validateInfo checks that the info has a text or labels, is valid UTF-8 and is not larger than MaxInfoSize.
+func validateInfo(i *models.Info) error {
+	if i == nil || len(i.Text) == 0 && len(i.Labels) == 0 {
+		return fmt.Errorf("%w: no text or labels", ErrInvalidInfo)
+	}
+
+	size := len(i.Text)
+	valid := utf8.ValidString(i.Text)
+	for name, value := range i.Labels {
+		if len(name) == 0 {
+			return fmt.Errorf("%w: empty label name", ErrInvalidInfo)
+		}
+		size += len(name) + len(value)
+		valid = valid && utf8.ValidString(name) && utf8.ValidString(value)
+	}
+	if !valid {
+		return fmt.Errorf("%w: not valid UTF-8", ErrInvalidInfo)
+	}
+	if size > MaxInfoSize {
+		return fmt.Errorf("%w: %d bytes, at most %d are allowed", ErrInvalidInfo, size, MaxInfoSize)
+	}
+	return nil
+}
+
+// copyInfo returns a copy of the info, so that the stored labels do not share the map of the request.
+func copyInfo(i *models.Info) *models.Info {
+	c := &models.Info{Text: i.Text}
+	if len(i.Labels) > 0 {
+		c.Labels = make(map[string]string, len(i.Labels))
+		for name, value := range i.Labels {
+			c.Labels[name] = value
+		}
+	}
+	return c
+}
+
+// infoHashSource returns the text and the labels as query escaped text:labels, the labels are
+// encoded like a URL query sorted by name, e.g. "1.4.2:go=go1.19&revision=4f2a9c1".
+func infoHashSource(i *models.Info) string {
+	if i == nil {
+		return ""
+	}
+	labels := make(url.Values, len(i.Labels))
+	for name, value := range i.Labels {
+		labels.Set(name, value)
+	}
+	return url.QueryEscape(i.Text) + ":" + labels.Encode()
+}
+
+// InfoString returns the text followed by the labels sorted by name, e.g. `1.4.2 go="go1.19" revision="4f2a9c1"`.
+func InfoString(i *models.Info) string {
+	if i == nil {
+		return ""
+	}
+	names := make([]string, 0, len(i.Labels))
+	for name := range i.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names)+1)
+	if len(i.Text) > 0 {
+		parts = append(parts, i.Text)
+	}
+	for _, name := range names {
+		parts = append(parts, name+"="+strconv.Quote(i.Labels[name]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// agentInfo returns the version of the agent with its build metadata and the kernel version of the host.
+func agentInfo() []models.Metric {
+	build := &models.Info{Text: "(unknown)", Labels: map[string]string{
+		"go":   runtime.Version(),
+		"os":   runtime.GOOS,
+		"arch": runtime.GOARCH,
+	}}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if len(bi.Main.Version) > 0 {
+			build.Text = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				build.Labels["revision"] = s.Value
+			}
+		}
+	}
+	metrics := []models.Metric{{ID: "AgentBuild", MType: Info, Info: build}}
+
+	kernel, err := host.KernelVersion()
+	if err != nil || len(kernel) == 0 {
+		log.Warn().Err(err).Msg("kernel version is unknown")
+		return metrics
+	}
+	return append(metrics, models.Metric{ID: "KernelVersion", MType: Info, Info: &models.Info{Text: kernel}})
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateInfo(t *testing.T) {
+	assert.NoError(t, validateInfo(&models.Info{Text: "1.4.2"}))
+	assert.NoError(t, validateInfo(&models.Info{Labels: map[string]string{"revision": "4f2a9c1"}}))
+
+	for _, i := range []*models.Info{
+		nil,
+		{},
+		{Labels: map[string]string{"": "x"}},
+		{Text: "\xff"},
+		{Text: strings.Repeat("x", MaxInfoSize+1)},
+	} {
+		assert.ErrorIs(t, validateInfo(i), ErrInvalidInfo)
+	}
+}
+
+func TestInfoHashSource(t *testing.T) {
+	m := models.Metric{ID: "AgentBuild", MType: Info,
+		Info: &models.Info{Text: "1.4 beta", Labels: map[string]string{"revision": "4f2a9c1", "go": "go1.19"}}}
+	assert.Equal(t, "AgentBuild:info:1.4+beta:go=go1.19&revision=4f2a9c1", hashSource(m))
+
+	// a separator inside the text must not make two infos sign the same string
+	a := models.Metric{ID: "v", MType: Info, Info: &models.Info{Text: "a:b=c"}}
+	b := models.Metric{ID: "v", MType: Info, Info: &models.Info{Text: "a", Labels: map[string]string{"b": "c"}}}
+	assert.NotEqual(t, hashSource(a), hashSource(b))
+}
+
+func TestInfoString(t *testing.T) {
+	assert.Equal(t, "1.4.2", InfoString(&models.Info{Text: "1.4.2"}))
+	assert.Equal(t, `1.4.2 go="go1.19" revision="4f2a9c1"`,
+		InfoString(&models.Info{Text: "1.4.2", Labels: map[string]string{"revision": "4f2a9c1", "go": "go1.19"}}))
+}
+
+func TestFileRepository_Info(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	repo := NewFileRepository("", time.Second, "test")
+
+	labels := map[string]string{"revision": "4f2a9c1"}
+	m := models.Metric{ID: "AgentBuild", MType: Info, Info: &models.Info{Text: "1.4.2", Labels: labels}}
+	m.Hash = utils.Hash(hashSource(m), "test")
+	_, err := repo.Set(ctx, m)
+	require.NoError(t, err)
+	labels["revision"] = "changed"
+
+	m = models.Metric{ID: "AgentBuild", MType: Info, Info: &models.Info{Text: "1.5.0"}}
+	m.Hash = utils.Hash(hashSource(m), "test")
+	_, err = repo.Set(ctx, m)
+	require.NoError(t, err)
+
+	stored, err := repo.Get(ctx, "AgentBuild", Info)
+	require.NoError(t, err)
+	assert.Equal(t, &models.Info{Text: "1.5.0"}, stored.Info, "an update was expected to replace the info")
+	assert.Equal(t, m.Hash, stored.Hash)
+}
+
+func TestDBRepository_Info(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	repo := &dbRepository{db: db}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mock.ExpectExec("insert into metrics(.+)").
+		WithArgs("KernelVersion", Info, nil, nil, "", nil, nil, nil, `{"text":"6.1.0"}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	_, err = repo.Set(ctx, models.Metric{ID: "KernelVersion", MType: Info, Info: &models.Info{Text: "6.1.0"}})
+	require.NoError(t, err)
+
+	mock.ExpectQuery("^select (.+) from metrics where (.+)").WithArgs("KernelVersion", Info).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "mtype", "delta", "value", "hash", "histogram", "summary", "registers", "info", "updated_at"}).
+			AddRow("KernelVersion", Info, nil, nil, "", nil, nil, nil, `{"text":"6.1.0"}`, nil))
+	m, err := repo.Get(ctx, "KernelVersion", Info)
+	require.NoError(t, err)
+	assert.Equal(t, "6.1.0", m.Info.Text)
+
+	_, err = repo.Set(ctx, models.Metric{ID: "KernelVersion", MType: Info})
+	assert.ErrorIs(t, err, ErrInvalidInfo)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+var ErrInvalidFilter = errors.New("invalid metric filter")
+
+// validateFilter checks the sort order, the type and the regular expression of the filter.
+func validateFilter(f models.MetricFilter) error {
+	switch f.Sort {
+	case "", models.SortByName, models.SortByValue, models.SortByUpdated:
+	default:
+		return fmt.Errorf("%w: unknown sort order %s", ErrInvalidFilter, f.Sort)
+	}
+	switch f.Type {
+	case "", Counter, Gauge, Histogram, Summary, Set, Info:
+	default:
+		return fmt.Errorf("%w: %v", ErrInvalidFilter, ErrInvalidMetricType)
+	}
+	if len(f.Regexp) > 0 {
+		if _, err := regexp.Compile(f.Regexp); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+		}
+		if err := checkPortableRegexp(f.Regexp); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+		}
+	}
+	if f.Limit < 0 {
+		return fmt.Errorf("%w: negative limit", ErrInvalidFilter)
+	}
+	return nil
+}
+
+// maxRepeat is the largest repetition count Postgres accepts.
+const maxRepeat = 255
+
+var repeatBound = regexp.MustCompile(`^\{(\d+)(,(\d*))?\}`)
+
+// checkPortableRegexp checks that a regular expression valid in Go means the same in Postgres, which matches
+// the filters of the database repository. Both share the common syntax, but some escapes differ, e.g. \b is
+// a word boundary in Go and a backspace in Postgres, so only the escapes of digits, spaces, word characters,
+// tabs and line breaks and of punctuation are allowed. Flags are allowed only as a leading (?i), groups only
+// as plain or (?:...) ones, and classes only in the POSIX bracket form without [:word:].
+func checkPortableRegexp(expr string) error {
+	s := strings.TrimPrefix(expr, "(?i)")
+	inClass := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(s) {
+				return errors.New("trailing backslash")
+			}
+			i++
+			e := s[i]
+			if isAlphanumeric(e) && strings.IndexByte("dDsSwWtnrfv", e) < 0 {
+				return fmt.Errorf("escape \\%c is not supported", e)
+			}
+			if inClass && strings.IndexByte("DSW", e) >= 0 {
+				return fmt.Errorf("escape \\%c is not supported in brackets", e)
+			}
+		case inClass:
+			switch {
+			case c == '[' && i+1 < len(s) && s[i+1] == ':':
+				end := strings.Index(s[i:], ":]")
+				if end < 0 {
+					return errors.New("unterminated character class")
+				}
+				if s[i+2:i+end] == "word" {
+					return errors.New("character class [:word:] is not supported")
+				}
+				i += end + 1
+			case c == '[' && i+1 < len(s) && (s[i+1] == '.' || s[i+1] == '='):
+				return errors.New("collating elements are not supported")
+			case c == ']':
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+			// a leading ] is a literal
+			if i+1 < len(s) && s[i+1] == '^' {
+				i++
+			}
+			if i+1 < len(s) && s[i+1] == ']' {
+				i++
+			}
+		case c == '(' && strings.HasPrefix(s[i:], "(?") && !strings.HasPrefix(s[i:], "(?:"):
+			return errors.New("flags and named groups are not supported, except (?i) at the start")
+		case c == '{':
+			bound := repeatBound.FindStringSubmatch(s[i:])
+			if bound == nil {
+				return errors.New("a literal { must be escaped")
+			}
+			for _, n := range []string{bound[1], bound[3]} {
+				if v, err := strconv.Atoi(n); err == nil && v > maxRepeat {
+					return fmt.Errorf("repetition count %d is above %d", v, maxRepeat)
+				}
+			}
+			i += len(bound[0]) - 1
+		}
+	}
+	return nil
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Cursor returns the position of the metric in the sort order.
+func Cursor(m *models.Metric) *models.MetricCursor {
+	c := &models.MetricCursor{ID: m.ID, MType: m.MType, Value: sortValue(m)}
+	if m.UpdatedAt != nil {
+		c.UpdatedAt = *m.UpdatedAt
+	}
+	return c
+}
+
+// sortValue returns the value of a gauge or the delta of a counter, other metrics have no value to sort by.
+func sortValue(m *models.Metric) *float64 {
+	switch {
+	case m.MType == Gauge && m.Value != nil:
+		return m.Value
+	case m.MType == Counter && m.Delta != nil:
+		v := float64(*m.Delta)
+		return &v
+	}
+	return nil
+}
+
+// compareCursors compares the positions of two metrics in the sort order of the filter.
+func compareCursors(a, b *models.MetricCursor, f models.MetricFilter) int {
+	var c int
+	switch f.Sort {
+	case models.SortByValue:
+		switch {
+		case a.Value == nil && b.Value == nil:
+		case a.Value == nil:
+			return 1
+		case b.Value == nil:
+			return -1
+		case *a.Value < *b.Value:
+			c = -1
+		case *a.Value > *b.Value:
+			c = 1
+		}
+	case models.SortByUpdated:
+		c = compareTimes(a.UpdatedAt, b.UpdatedAt)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	if c == 0 {
+		c = strings.Compare(a.MType, b.MType)
+	}
+	if f.Desc {
+		return -c
+	}
+	return c
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// matchFilter reports whether the metric has the prefix, the type and matches the regular expression of the filter.
+func matchFilter(id string, mType string, f models.MetricFilter, re *regexp.Regexp) bool {
+	return strings.HasPrefix(id, f.Prefix) && (len(f.Type) == 0 || mType == f.Type) && (re == nil || re.MatchString(id))
+}
+
+// NewMetricMatcher returns a function reporting whether the metric with the name and the type is selected
+// by the prefix, the regular expression and the type of the filter.
+func NewMetricMatcher(f models.MetricFilter) (func(id string, mType string) bool, error) {
+	if err := validateFilter(f); err != nil {
+		return nil, err
+	}
+	var re *regexp.Regexp
+	if len(f.Regexp) > 0 {
+		re = regexp.MustCompile(f.Regexp)
+	}
+	return func(id string, mType string) bool { return matchFilter(id, mType, f, re) }, nil
+}
+
+// validateDeleteFilter checks the filter of a bulk delete, which must select by something.
+func validateDeleteFilter(f models.MetricFilter) error {
+	if err := validateFilter(f); err != nil {
+		return err
+	}
+	if len(f.Prefix) == 0 && len(f.Regexp) == 0 && len(f.Type) == 0 {
+		return fmt.Errorf("%w: a prefix, a regular expression or a type is required to delete metrics", ErrInvalidFilter)
+	}
+	return nil
+}
+
+// listMetrics filters, sorts and pages the metrics in memory, the way dbRepository.List does it in SQL.
+// It returns copies of the metrics like fileRepository.GetAll.
+func listMetrics(metrics []*models.Metric, f models.MetricFilter) []*models.Metric {
+	var re *regexp.Regexp
+	if len(f.Regexp) > 0 {
+		re = regexp.MustCompile(f.Regexp)
+	}
+
+	type entry struct {
+		metric *models.Metric
+		cursor *models.MetricCursor
+	}
+	entries := make([]entry, 0, len(metrics))
+	for _, m := range metrics {
+		if !matchFilter(m.ID, m.MType, f, re) {
+			continue
+		}
+		c := Cursor(m)
+		if f.After != nil && compareCursors(c, f.After, f) <= 0 {
+			continue
+		}
+		entries = append(entries, entry{metric: m, cursor: c})
+	}
+	sort.Slice(entries, func(i, j int) bool { return compareCursors(entries[i].cursor, entries[j].cursor, f) < 0 })
+
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[:f.Limit]
+	}
+	result := make([]*models.Metric, 0, len(entries))
+	for _, e := range entries {
+		c := *e.metric
+		result = append(result, &c)
+	}
+	return result
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/storages"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listTestRepository(t *testing.T) storages.IRepository {
+	repo := NewFileRepository("", time.Second, "")
+	updated := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	g := func(v float64) *float64 { return &v }
+	c := func(d int64) *int64 { return &d }
+	for _, m := range []models.Metric{
+		{ID: "Alloc", MType: Gauge, Value: g(300)},
+		{ID: "CPUutilization1", MType: Gauge, Value: g(20)},
+		{ID: "CPUutilization2", MType: Gauge, Value: g(40)},
+		{ID: "PollCount", MType: Counter, Delta: c(20)},
+		{ID: "users", MType: Set, Set: NewSet("alice")},
+		{ID: "AgentBuild", MType: Info, Info: &models.Info{Text: "1.4.2"}},
+	} {
+		// metrics restored from the store file keep their update time
+		updated = updated.Add(time.Second)
+		u := updated
+		m.UpdatedAt = &u
+		_, err := repo.Set(context.Background(), m)
+		require.NoError(t, err)
+	}
+	return repo
+}
+
+func ids(metrics []*models.Metric) []string {
+	result := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		result = append(result, m.ID)
+	}
+	return result
+}
+
+func TestFileRepository_List(t *testing.T) {
+	ctx := context.Background()
+	repo := listTestRepository(t)
+
+	tests := []struct {
+		name   string
+		filter models.MetricFilter
+		want   []string
+	}{
+		{"all", models.MetricFilter{}, []string{"AgentBuild", "Alloc", "CPUutilization1", "CPUutilization2", "PollCount", "users"}},
+		{"prefix", models.MetricFilter{Prefix: "CPU"}, []string{"CPUutilization1", "CPUutilization2"}},
+		{"regexp", models.MetricFilter{Regexp: "[0-9]$"}, []string{"CPUutilization1", "CPUutilization2"}},
+		{"type", models.MetricFilter{Type: Gauge, Desc: true}, []string{"CPUutilization2", "CPUutilization1", "Alloc"}},
+		{"value", models.MetricFilter{Sort: models.SortByValue},
+			[]string{"CPUutilization1", "PollCount", "CPUutilization2", "Alloc", "AgentBuild", "users"}},
+		{"value desc", models.MetricFilter{Sort: models.SortByValue, Desc: true},
+			[]string{"Alloc", "CPUutilization2", "PollCount", "CPUutilization1", "users", "AgentBuild"}},
+		{"updated", models.MetricFilter{Sort: models.SortByUpdated, Desc: true, Limit: 2}, []string{"AgentBuild", "users"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := repo.List(ctx, tt.filter)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ids(metrics))
+		})
+	}
+
+	for _, f := range []models.MetricFilter{{Sort: "size"}, {Type: "float"}, {Regexp: "("}, {Limit: -1}} {
+		_, err := repo.List(ctx, f)
+		assert.ErrorIs(t, err, ErrInvalidFilter)
+	}
+}
+
+func TestFileRepository_ListPages(t *testing.T) {
+	ctx := context.Background()
+	repo := listTestRepository(t)
+
+	for _, sort := range []string{models.SortByName, models.SortByValue, models.SortByUpdated} {
+		for _, desc := range []bool{false, true} {
+			all, err := repo.List(ctx, models.MetricFilter{Sort: sort, Desc: desc})
+			require.NoError(t, err)
+
+			// pages of two metrics put together must give the whole list
+			var paged []*models.Metric
+			filter := models.MetricFilter{Sort: sort, Desc: desc, Limit: 2}
+			for i := 0; i < 10; i++ {
+				page, err := repo.List(ctx, filter)
+				require.NoError(t, err)
+				if len(page) == 0 {
+					break
+				}
+				paged = append(paged, page...)
+				filter.After = Cursor(page[len(page)-1])
+			}
+			assert.Equal(t, ids(all), ids(paged), "sort %s desc %v", sort, desc)
+		}
+	}
+}
+
+func TestDBRepository_List(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	repo := &dbRepository{db: db}
+
+	updated := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	value := 20.0
+	columns := []string{"id", "mtype", "delta", "value", "hash", "histogram", "summary", "registers", "info", "updated_at"}
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectMetric+` where left(id, char_length($1)) = $1 and id ~ $2 and mtype = $3 `+
+		`and (coalesce(value, delta::double precision) < $6 or coalesce(value, delta::double precision) = $6 `+
+		`and (id collate "C", mtype collate "C") < ($4, $5) or coalesce(value, delta::double precision) is null) `+
+		`order by coalesce(value, delta::double precision) desc nulls last, id collate "C" desc, mtype collate "C" desc `+
+		`limit $7`)).
+		WithArgs("CPU", "[0-9]$", Gauge, "CPUutilization2", Gauge, 40.0, 10).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("CPUutilization1", Gauge, nil, &value, "", nil, nil, nil, nil, updated))
+
+	metrics, err := repo.List(context.Background(), models.MetricFilter{Prefix: "CPU", Regexp: "[0-9]$", Type: Gauge,
+		Sort: models.SortByValue, Desc: true, Limit: 10,
+		After: &models.MetricCursor{ID: "CPUutilization2", MType: Gauge, Value: func() *float64 { v := 40.0; return &v }()}})
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, updated, *metrics[0].UpdatedAt)
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectMetric+` where (updated_at > $3 or updated_at = $3 `+
+		`and (id collate "C", mtype collate "C") > ($1, $2)) order by updated_at asc, id collate "C" asc, mtype collate "C" asc`)).
+		WithArgs("Alloc", Gauge, updated).
+		WillReturnRows(sqlmock.NewRows(columns))
+	metrics, err = repo.List(context.Background(), models.MetricFilter{Sort: models.SortByUpdated,
+		After: &models.MetricCursor{ID: "Alloc", MType: Gauge, UpdatedAt: updated}})
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+
+	_, err = repo.List(context.Background(), models.MetricFilter{Regexp: "("})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+	_, err = repo.List(context.Background(), models.MetricFilter{Regexp: `\bAlloc`})
+	assert.ErrorIs(t, err, ErrInvalidFilter, "a regexp meaning another thing in Postgres was not expected to be sent")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCheckPortableRegexp(t *testing.T) {
+	for _, expr := range []string{`[0-9]$`, `(?i)^cpu`, `^(?:Heap|Stack)\w+\d{1,3}$`, `[]a]`, `[^]\d]`,
+		`[[:alpha:]_]+`, `\.\$`, `a{255}`, `\s\S\t`} {
+		assert.NoError(t, checkPortableRegexp(expr), expr)
+	}
+	for _, expr := range []string{`\bAlloc`, `\z`, `\pL`, `\x41`, `\Q.\E`, `(?s).`, `^(?i)cpu`, `(?P<n>a)`,
+		`[\W]`, `[[:word:]]`, `[[=a=]]`, `a{256}`, `a{1,300}`, `a{`} {
+		assert.Error(t, checkPortableRegexp(expr), expr)
+	}
+}
+
+func TestFileRepository_Delete(t *testing.T) {
+	ctx := context.Background()
+	repo := listTestRepository(t)
+
+	require.NoError(t, repo.Delete(ctx, "Alloc", Gauge))
+	assert.ErrorIs(t, repo.Delete(ctx, "Alloc", Gauge), ErrInvalidMetric)
+	assert.ErrorIs(t, repo.Delete(ctx, "PollCount", Gauge), ErrInvalidMetric, "the type was expected to be matched")
+
+	deleted, err := repo.DeleteMatching(ctx, models.MetricFilter{Prefix: "CPU", Regexp: "1$"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	_, err = repo.DeleteMatching(ctx, models.MetricFilter{})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+
+	metrics, err := repo.List(ctx, models.MetricFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AgentBuild", "CPUutilization2", "PollCount", "users"}, ids(metrics))
+}
+
+func TestDBRepository_Delete(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	repo := &dbRepository{db: db}
+	ctx := context.Background()
+
+	mock.ExpectExec(regexp.QuoteMeta("delete from metrics where id = $1 and mtype = $2")).
+		WithArgs("HeapAllc", Gauge).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("delete from metrics where id = $1 and mtype = $2")).
+		WithArgs("HeapAllc", Gauge).WillReturnResult(sqlmock.NewResult(0, 0))
+	require.NoError(t, repo.Delete(ctx, "HeapAllc", Gauge))
+	assert.ErrorIs(t, repo.Delete(ctx, "HeapAllc", Gauge), ErrInvalidMetric)
+
+	mock.ExpectExec(regexp.QuoteMeta("delete from metrics where left(id, char_length($1)) = $1 and mtype = $2")).
+		WithArgs("test_", Counter).WillReturnResult(sqlmock.NewResult(0, 3))
+	deleted, err := repo.DeleteMatching(ctx, models.MetricFilter{Prefix: "test_", Type: Counter})
+	require.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+
+	mock.ExpectExec(regexp.QuoteMeta("delete from metrics where id ~ $1")).
+		WithArgs("^Heap").WillReturnResult(sqlmock.NewResult(0, 2))
+	deleted, err = repo.DeleteMatching(ctx, models.MetricFilter{Regexp: "^Heap"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	_, err = repo.DeleteMatching(ctx, models.MetricFilter{Sort: models.SortByValue})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+	_, err = repo.DeleteMatching(ctx, models.MetricFilter{Regexp: `\bHeap`})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
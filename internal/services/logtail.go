@@ -0,0 +1,345 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// logTailChunk is the size of one read from a tailed file, longer lines are split.
+const logTailChunk = 64 * 1024
+
+// logTailConfig describes one tailed file and the counters of lines matching the patterns.
+type logTailConfig struct {
+	Path string `json:"path"`
+	// Patterns maps a counter name to the regular expression of the lines it counts.
+	Patterns map[string]string `json:"patterns"`
+}
+
+// logTailState is the persisted read position in a file.
+type logTailState struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+type namedPattern struct {
+	name   string
+	regexp *regexp.Regexp
+}
+
+type tailedFile struct {
+	path     string
+	patterns []namedPattern
+	file     *os.File
+	inode    uint64
+	offset   int64
+	// polled is set after the first poll, files appearing later are read from the beginning
+	polled bool
+}
+
+// logTailer counts the lines matching regular expressions in growing log files.
+// It follows rotation by inode and truncation. The counts are kept until the report takes them,
+// the read offsets are saved in the state file only after the report is delivered, so that a restart
+// neither loses nor counts twice the lines read in between.
+type logTailer struct {
+	sync.Mutex
+	files     []*tailedFile
+	statePath string
+	state     map[string]logTailState
+	counts    map[string]int64
+}
+
+// newLogTailer reads the tailed files from a JSON config. An empty path means no files are tailed.
+func newLogTailer(configPath string, statePath string) (*logTailer, error) {
+	lt := &logTailer{
+		files:     make([]*tailedFile, 0),
+		statePath: statePath,
+		state:     make(map[string]logTailState),
+		counts:    make(map[string]int64),
+	}
+	if len(configPath) == 0 {
+		return lt, nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var cfg []logTailConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("log tail file %s: %w", configPath, err)
+	}
+
+	for _, c := range cfg {
+		if len(c.Path) == 0 || len(c.Patterns) == 0 {
+			return nil, errors.New("every tailed file must have a path and patterns")
+		}
+
+		f := &tailedFile{path: c.Path, patterns: make([]namedPattern, 0, len(c.Patterns))}
+		for name, expr := range c.Patterns {
+			if len(name) == 0 {
+				return nil, fmt.Errorf("a pattern of %s has no name", c.Path)
+			}
+			if isReserved(name) {
+				return nil, fmt.Errorf("pattern %s of %s: the prefix %s is reserved", name, c.Path, TelemetryPrefix)
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("pattern %s of %s: %w", name, c.Path, err)
+			}
+			f.patterns = append(f.patterns, namedPattern{name: name, regexp: re})
+		}
+		sort.Slice(f.patterns, func(i, j int) bool { return f.patterns[i].name < f.patterns[j].name })
+		lt.files = append(lt.files, f)
+	}
+
+	if len(statePath) > 0 {
+		data, err = os.ReadFile(statePath)
+		if err == nil {
+			if err = json.Unmarshal(data, &lt.state); err != nil {
+				log.Warn().Err(err).Msgf("log tail state %s is broken, files will be read from the end", statePath)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return lt, nil
+}
+
+// CollectLogs counts the matching lines of the tailed files every poll interval until the context is done.
+func (ms *MetricsService) CollectLogs(ctx context.Context) {
+	if len(ms.logTailer.files) == 0 {
+		return
+	}
+	defer ms.logTailer.close()
+	ms.runCollector(ctx, "logtail", ms.getPollInterval, ms.logTailer.poll)
+}
+
+// poll reads the lines appended since the previous poll and adds up the matches until the report drains them.
+func (lt *logTailer) poll(_ context.Context) ([]models.Metric, error) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	var errs []error
+	for _, f := range lt.files {
+		counts, err := lt.read(f)
+		if err != nil {
+			log.Error().Err(err).Msgf("error reading %s", f.path)
+			errs = append(errs, err)
+		}
+		for _, p := range f.patterns {
+			lt.counts[p.name] += counts[p.name]
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return nil, nil
+}
+
+// drain returns the matches counted since the previous drain as counters
+// and the read positions they were counted up to.
+func (lt *logTailer) drain() ([]models.Metric, map[string]logTailState) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	if len(lt.files) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(lt.counts))
+	for name := range lt.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]models.Metric, 0, len(names))
+	for _, name := range names {
+		delta := lt.counts[name]
+		metrics = append(metrics, models.Metric{ID: name, MType: Counter, Delta: &delta})
+	}
+	lt.counts = make(map[string]int64)
+
+	positions := make(map[string]logTailState, len(lt.state))
+	for path, state := range lt.state {
+		positions[path] = state
+	}
+	for _, f := range lt.files {
+		if f.file != nil {
+			positions[f.path] = logTailState{Inode: f.inode, Offset: f.offset}
+		}
+	}
+	return metrics, positions
+}
+
+// commit saves the read positions returned by drain once the counts are delivered.
+func (lt *logTailer) commit(positions map[string]logTailState) {
+	if positions == nil {
+		return
+	}
+	if err := lt.saveState(positions); err != nil {
+		log.Error().Err(err).Msgf("error saving log tail state to %s", lt.statePath)
+	}
+}
+
+// read counts the new lines of the file, including the rest of the previous file if it has been rotated.
+func (lt *logTailer) read(f *tailedFile) (map[string]int64, error) {
+	counts := make(map[string]int64)
+
+	if f.file == nil {
+		err := lt.open(f, f.polled)
+		f.polled = true
+		if errors.Is(err, os.ErrNotExist) {
+			return counts, nil
+		}
+		if err != nil {
+			return counts, err
+		}
+	}
+
+	info, err := f.file.Stat()
+	if err != nil {
+		return counts, err
+	}
+	if info.Size() < f.offset {
+		log.Info().Msgf("%s was truncated, reading from the beginning", f.path)
+		f.offset = 0
+	}
+	if err = f.readLines(counts); err != nil {
+		return counts, err
+	}
+
+	current, err := os.Stat(f.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// rotated, the new file is not created yet
+			return counts, nil
+		}
+		return counts, err
+	}
+	if os.SameFile(info, current) {
+		return counts, nil
+	}
+
+	log.Info().Msgf("%s was rotated, reading the new file", f.path)
+	if err = f.file.Close(); err != nil {
+		log.Error().Err(err).Msgf("error closing %s", f.path)
+	}
+	f.file = nil
+	if err = lt.open(f, true); err != nil {
+		return counts, err
+	}
+	return counts, f.readLines(counts)
+}
+
+// open opens the file and continues from the saved offset if it is the same file.
+// A file without saved state is read from the end unless fromStart is set, a replaced file from the beginning.
+func (lt *logTailer) open(f *tailedFile, fromStart bool) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.inode = fileInode(info)
+	state, ok := lt.state[f.path]
+	switch {
+	case fromStart:
+		f.offset = 0
+	case !ok:
+		f.offset = info.Size()
+	case state.Inode == f.inode && state.Offset <= info.Size():
+		f.offset = state.Offset
+	default:
+		f.offset = 0
+	}
+	lt.state[f.path] = logTailState{Inode: f.inode, Offset: f.offset}
+	return nil
+}
+
+// readLines reads complete lines from the offset to the end of the file and counts the matches.
+// An incomplete last line is left for the next read.
+func (f *tailedFile) readLines(counts map[string]int64) error {
+	buf := make([]byte, logTailChunk)
+	for {
+		n, err := f.file.ReadAt(buf, f.offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		chunk := buf[:n]
+		end := bytes.LastIndexByte(chunk, '\n')
+		if end < 0 {
+			if n < len(buf) {
+				return nil
+			}
+			end = n - 1
+		}
+
+		for _, line := range bytes.Split(chunk[:end+1], []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			for _, p := range f.patterns {
+				if p.regexp.Match(line) {
+					counts[p.name]++
+				}
+			}
+		}
+		f.offset += int64(end + 1)
+
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// saveState atomically writes the read positions to the state file.
+func (lt *logTailer) saveState(positions map[string]logTailState) error {
+	if len(lt.statePath) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(lt.statePath), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := lt.statePath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, lt.statePath)
+}
+
+func (lt *logTailer) close() {
+	lt.Lock()
+	defer lt.Unlock()
+	for _, f := range lt.files {
+		if f.file != nil {
+			if err := f.file.Close(); err != nil {
+				log.Error().Err(err).Msgf("error closing %s", f.path)
+			}
+			f.file = nil
+		}
+	}
+}
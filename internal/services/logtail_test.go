@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendLines(t *testing.T, path string, lines ...string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	for _, line := range lines {
+		_, err = fmt.Fprintln(f, line)
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+}
+
+// pollCounts polls the files and drains the counts, the positions are saved as if the counts were delivered.
+func pollCounts(t *testing.T, lt *logTailer) map[string]int64 {
+	_, err := lt.poll(context.Background())
+	require.NoError(t, err)
+	metrics, positions := lt.drain()
+	lt.commit(positions)
+	counts := make(map[string]int64)
+	for _, m := range metrics {
+		require.Equal(t, Counter, m.MType)
+		counts[m.ID] = *m.Delta
+	}
+	return counts
+}
+
+func newTestLogTailer(t *testing.T, dir string, logPath string) *logTailer {
+	configPath := filepath.Join(dir, "logtail.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(
+		`[{"path": %q, "patterns": {"AppErrors": "ERROR", "AppTimeouts": "(?i)timeout"}}]`, logPath)), 0o600))
+
+	lt, err := newLogTailer(configPath, filepath.Join(dir, "state", "logtail-state.json"))
+	require.NoError(t, err)
+	return lt
+}
+
+func TestLogTailer_Poll(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	appendLines(t, logPath, "ERROR before the agent started")
+
+	lt := newTestLogTailer(t, dir, logPath)
+	defer lt.close()
+	assert.Equal(t, map[string]int64{"AppErrors": 0, "AppTimeouts": 0}, pollCounts(t, lt),
+		"the existing lines were expected to be skipped on the first start")
+
+	appendLines(t, logPath, "INFO ok", "ERROR failed", "ERROR request Timeout")
+	assert.Equal(t, map[string]int64{"AppErrors": 2, "AppTimeouts": 1}, pollCounts(t, lt))
+
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString("ERROR incomplete")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, int64(0), pollCounts(t, lt)["AppErrors"], "an incomplete line was expected to wait")
+	appendLines(t, logPath, " line")
+	assert.Equal(t, int64(1), pollCounts(t, lt)["AppErrors"])
+
+	appendLines(t, logPath, "ERROR before rotation")
+	require.NoError(t, os.Rename(logPath, logPath+".1"))
+	appendLines(t, logPath, "ERROR after rotation", "timeout")
+	assert.Equal(t, map[string]int64{"AppErrors": 2, "AppTimeouts": 1}, pollCounts(t, lt),
+		"the rest of the rotated file and the new file were expected to be read")
+
+	require.NoError(t, os.Truncate(logPath, 0))
+	appendLines(t, logPath, "ERROR after truncation")
+	assert.Equal(t, int64(1), pollCounts(t, lt)["AppErrors"])
+}
+
+func TestLogTailer_Restart(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	appendLines(t, logPath, "ERROR old")
+
+	lt := newTestLogTailer(t, dir, logPath)
+	pollCounts(t, lt)
+	appendLines(t, logPath, "ERROR counted before restart")
+	assert.Equal(t, int64(1), pollCounts(t, lt)["AppErrors"])
+	lt.close()
+
+	appendLines(t, logPath, "ERROR written while the agent was down")
+	lt = newTestLogTailer(t, dir, logPath)
+	defer lt.close()
+	assert.Equal(t, int64(1), pollCounts(t, lt)["AppErrors"], "the lines were expected to be neither skipped nor counted twice")
+}
+
+func TestLogTailer_Config(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "logtail.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(`[{"path": "app.log", "patterns": {"Bad": "ERROR("}}]`), 0o600))
+
+	_, err := newLogTailer(configPath, "")
+	assert.Error(t, err)
+
+	for _, patterns := range []string{`{"": "ERROR"}`, `{"` + TelemetryPrefix + `batches_sent": "ERROR"}`} {
+		require.NoError(t, os.WriteFile(configPath, []byte(`[{"path": "app.log", "patterns": `+patterns+`}]`), 0o600))
+		_, err = newLogTailer(configPath, "")
+		assert.Error(t, err, "the pattern names %s were expected to be rejected", patterns)
+	}
+
+	lt, err := newLogTailer("", "")
+	require.NoError(t, err)
+	_, err = lt.poll(context.Background())
+	assert.NoError(t, err)
+	metrics, positions := lt.drain()
+	assert.Empty(t, metrics)
+	assert.Nil(t, positions)
+}
+
+func TestMetricsService_LogOffsetsSavedAfterDelivery(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	appendLines(t, logPath, "ERROR old")
+
+	ms, err := NewMetricsService(&configs.AgentCfg{RateLimit: 5})
+	require.NoError(t, err)
+	ms.logTailer = newTestLogTailer(t, dir, logPath)
+	pollCounts(t, ms.logTailer)
+
+	appendLines(t, logPath, "ERROR reported but not delivered")
+	_, err = ms.logTailer.poll(context.Background())
+	require.NoError(t, err)
+	ms.report("")
+	batch := <-ms.ch
+	assert.Equal(t, int64(1), *findMetric(batch, "AppErrors").Delta)
+	ms.logTailer.close()
+
+	// the agent restarts before the batch is sent
+	ms, err = NewMetricsService(&configs.AgentCfg{RateLimit: 5})
+	require.NoError(t, err)
+	ms.logTailer = newTestLogTailer(t, dir, logPath)
+	assert.Equal(t, int64(1), pollCounts(t, ms.logTailer)["AppErrors"], "the undelivered lines were expected to be read again")
+
+	appendLines(t, logPath, "ERROR delivered")
+	_, err = ms.logTailer.poll(context.Background())
+	require.NoError(t, err)
+	ms.report("")
+	close(ms.ch)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	ms.Send(context.Background(), wg, newHTTPSink(ts.Client(), strings.TrimPrefix(ts.URL, "http://")))
+	ms.logTailer.close()
+
+	ms.logTailer = newTestLogTailer(t, dir, logPath)
+	defer ms.logTailer.close()
+	assert.Equal(t, int64(0), pollCounts(t, ms.logTailer)["AppErrors"], "the delivered lines were not expected to be read again")
+}
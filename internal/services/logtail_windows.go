@@ -0,0 +1,10 @@
+//go:build windows
+
+package services
+
+import "os"
+
+// fileInode returns 0, Windows files have no inode, so the saved offset is trusted if the file is not shorter.
+func fileInode(_ os.FileInfo) uint64 {
+	return 0
+}
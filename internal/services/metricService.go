@@ -1,14 +1,10 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"math"
 	"math/rand"
-	"net/http"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -16,6 +12,7 @@ import (
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
 	"github.com/dbulyk/metrics-alerting-service/internal/models"
 	"github.com/dbulyk/metrics-alerting-service/internal/utils"
 	"github.com/shirou/gopsutil/v3/cpu"
@@ -27,40 +24,152 @@ type MetricsService struct {
 	ch              chan []models.Metric
 	runtimeMetrics  []models.Metric
 	advancedMetrics []models.Metric
+	infoMetrics     []models.Metric
 	pollCount       *atomic.Int64
-	reportInterval  time.Duration
-	pollInterval    time.Duration
+	reportInterval  atomic.Int64
+	pollInterval    atomic.Int64
+	batchSize       int
+	batchBytes      int
+	aggregator      *aggregator
+	telemetry       *telemetry
+	collected       map[string]map[string]models.Metric
+	execPlugins     []execPlugin
+	logTailer       *logTailer
+	cgroup          *cgroupCollector
+	relabeler       *relabeler
+	queuePolicy     string
+	clock           Clock
+	reportJitter    time.Duration
+	reportAlign     bool
+	spool           *spool
+	deliveries      *deliveries
+	shuttingDown    atomic.Bool
+	spooled         atomic.Int64
+	lost            atomic.Int64
+	remote          *remoteConfig
+	collectors      map[string]bool
+	probes          []probe
+	probeWorkers    int
+
+	localReportInterval time.Duration
+	localPollInterval   time.Duration
 }
 
-// NewMetricsService creates a new metrics service and returns a pointer to it.
-func NewMetricsService(reportInterval time.Duration, pollInterval time.Duration, rateLimit int) *MetricsService {
+// NewMetricsService creates a new metrics service from the agent config and returns a pointer to it.
+// It returns an error if the config contains invalid rules.
+func NewMetricsService(cfg *configs.AgentCfg) (*MetricsService, error) {
+	aggregator, err := newAggregator(cfg.Aggregations)
+	if err != nil {
+		return nil, err
+	}
+
+	execPlugins, err := loadExecPlugins(cfg.ExecPlugins)
+	if err != nil {
+		return nil, err
+	}
+
+	logTailer, err := newLogTailer(cfg.LogTail, cfg.LogTailState)
+	if err != nil {
+		return nil, err
+	}
+
+	relabeler, err := newRelabeler(cfg.RelabelRules)
+	if err != nil {
+		return nil, err
+	}
+
+	queuePolicy := cfg.QueuePolicy
+	if len(queuePolicy) == 0 {
+		queuePolicy = QueueBlock
+	}
+	if err = validateQueuePolicy(queuePolicy); err != nil {
+		return nil, err
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = cfg.RateLimit
+	}
+
+	var cgroup *cgroupCollector
+	if len(cfg.CgroupRoot) > 0 {
+		cgroup, err = newCgroupCollector(cfg.CgroupRoot, procSelfCgroup)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	remote, err := newRemoteConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	probes, err := loadProbes(cfg.Probes)
+	if err != nil {
+		return nil, err
+	}
+	probeWorkers := cfg.ProbeWorkers
+	if probeWorkers <= 0 {
+		probeWorkers = 1
+	}
+
 	pollCount := atomic.Int64{}
 	pollCount.Store(1)
 	runtimeMetrics := make([]models.Metric, 0, 50)
 	advancedMetrics := make([]models.Metric, 0, 50)
-	ch := make(chan []models.Metric, rateLimit)
+	ch := make(chan []models.Metric, queueSize)
 
-	return &MetricsService{
+	ms := &MetricsService{
 		Mutex:           sync.Mutex{},
-		reportInterval:  reportInterval,
-		pollInterval:    pollInterval,
+		batchSize:       cfg.BatchSize,
+		batchBytes:      cfg.BatchBytes,
+		aggregator:      aggregator,
+		telemetry:       newTelemetry(),
+		collected:       make(map[string]map[string]models.Metric),
+		execPlugins:     execPlugins,
+		logTailer:       logTailer,
+		cgroup:          cgroup,
+		relabeler:       relabeler,
+		queuePolicy:     queuePolicy,
+		clock:           realClock{},
+		reportJitter:    cfg.ReportJitter,
+		reportAlign:     cfg.ReportAlign,
+		spool:           &spool{path: cfg.SpoolFile},
+		deliveries:      &deliveries{},
 		pollCount:       &pollCount,
 		runtimeMetrics:  runtimeMetrics,
 		advancedMetrics: advancedMetrics,
+		infoMetrics:     agentInfo(),
 		ch:              ch,
+		remote:          remote,
+		probes:          probes,
+		probeWorkers:    probeWorkers,
+
+		localReportInterval: cfg.ReportInterval,
+		localPollInterval:   cfg.PollInterval,
 	}
+	ms.reportInterval.Store(int64(cfg.ReportInterval))
+	ms.pollInterval.Store(int64(cfg.PollInterval))
+	return ms, nil
 }
 
 // CollectRuntime collects runtime metrics.
 func (ms *MetricsService) CollectRuntime(ctx context.Context) {
-	ticker := time.NewTicker(ms.pollInterval)
-	defer ticker.Stop()
+	schedule := newSchedule(ms.clock, ms.getPollInterval(), 0, false)
 
 	for {
+		schedule.interval = ms.getPollInterval()
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-schedule.next():
+			if !ms.collectorEnabled("runtime") {
+				ms.Lock()
+				ms.runtimeMetrics = ms.runtimeMetrics[:0]
+				ms.Unlock()
+				continue
+			}
+
+			start := time.Now()
 			rtm := runtime.MemStats{}
 			runtime.ReadMemStats(&rtm)
 			randomValue := rand.Float64()
@@ -216,30 +325,42 @@ func (ms *MetricsService) CollectRuntime(ctx context.Context) {
 			ms.Lock()
 			ms.pollCount.Add(1)
 			ms.runtimeMetrics = metrics
+			ms.aggregator.observe(metrics)
 			ms.Unlock()
+			ms.telemetry.observeCollector("runtime", time.Since(start), nil)
 		}
 	}
 }
 
 // CollectAdvanced collects advanced metrics.
 func (ms *MetricsService) CollectAdvanced(ctx context.Context) {
-	ticker := time.NewTicker(ms.pollInterval)
-	defer ticker.Stop()
+	schedule := newSchedule(ms.clock, ms.getPollInterval(), 0, false)
 
 	for {
+		schedule.interval = ms.getPollInterval()
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-schedule.next():
+			if !ms.collectorEnabled("advanced") {
+				ms.Lock()
+				ms.advancedMetrics = ms.advancedMetrics[:0]
+				ms.Unlock()
+				continue
+			}
+
+			start := time.Now()
 			memory, err := mem.VirtualMemory()
 			if err != nil {
 				log.Error().Err(err).Msg("error collecting memory metrics")
+				ms.telemetry.observeCollector("advanced", time.Since(start), err)
 				continue
 			}
 
 			cpuUtilization, err := cpu.Percent(0, true)
 			if err != nil {
 				log.Error().Err(err).Msg("error collecting cpu metrics")
+				ms.telemetry.observeCollector("advanced", time.Since(start), err)
 				continue
 			}
 
@@ -265,94 +386,138 @@ func (ms *MetricsService) CollectAdvanced(ctx context.Context) {
 			}
 			ms.Lock()
 			ms.advancedMetrics = metrics
+			ms.aggregator.observe(metrics)
 			ms.Unlock()
+			ms.telemetry.observeCollector("advanced", time.Since(start), nil)
 		}
 	}
 }
 
-// MergeAndPushToQueue hashes and merges metrics and pushes them to the queue.
+// MergeAndPushToQueue hashes and merges metrics, splits them into batches and pushes them to the queue.
+// Reports follow the schedule set by the report interval, jitter and alignment. When the context is done,
+// the metrics collected since the last report are pushed once more and the queue is closed.
 func (ms *MetricsService) MergeAndPushToQueue(ctx context.Context, key string) {
-	ticker := time.NewTicker(ms.reportInterval)
-	defer ticker.Stop()
+	schedule := newSchedule(ms.clock, ms.getReportInterval(), ms.reportJitter, ms.reportAlign)
 
 	for {
+		schedule.interval = ms.getReportInterval()
 		select {
 		case <-ctx.Done():
+			ms.shuttingDown.Store(true)
+			log.Info().Msg("final flush of the collected metrics")
+			ms.report(key)
 			close(ms.ch)
 			return
-		case <-ticker.C:
-			metrics := make([]models.Metric, 0, 100)
+		case <-schedule.next():
+			ms.report(key)
+		}
+	}
+}
 
-			ms.Lock()
-			metrics = append(metrics, ms.runtimeMetrics...)
-			metrics = append(metrics, ms.advancedMetrics...)
-			ms.Unlock()
+// report merges the collected metrics and pushes them to the queue. Counters are sent only once,
+// so a report without a poll after the previous one does not count them twice.
+func (ms *MetricsService) report(key string) {
+	metrics := make([]models.Metric, 0, 100)
 
-			if len(metrics) == 0 {
-				log.Warn().Msg("no metrics to send")
-				continue
-			}
+	ms.Lock()
+	metrics = append(metrics, ms.runtimeMetrics...)
+	metrics = append(metrics, ms.advancedMetrics...)
+	metrics = append(metrics, ms.infoMetrics...)
+	metrics = append(metrics, ms.drainCollected()...)
+	logs, positions := ms.logTailer.drain()
+	metrics = append(metrics, logs...)
+	metrics = ms.aggregator.apply(metrics)
+	gauges := make([]models.Metric, 0, len(ms.runtimeMetrics))
+	for _, m := range ms.runtimeMetrics {
+		if m.MType != Counter {
+			gauges = append(gauges, m)
+		}
+	}
+	ms.runtimeMetrics = gauges
+	ms.Unlock()
+	// the telemetry is appended after relabeling, so that the rules cannot rename or drop it
+	metrics = ms.relabeler.apply(metrics)
+	metrics = append(metrics, ms.telemetry.collect(len(ms.ch), true)...)
 
-			if len(key) != 0 {
-				for i := range metrics {
-					switch metrics[i].MType {
-					case "gauge":
-						metrics[i].Hash = utils.Hash(fmt.Sprintf("%s:%s:%f", metrics[i].ID, metrics[i].MType, *metrics[i].Value), key)
-					case "counter":
-						metrics[i].Hash = utils.Hash(fmt.Sprintf("%s:%s:%d", metrics[i].ID, metrics[i].MType, *metrics[i].Delta), key)
-					}
-				}
-			}
+	// the log offsets are saved once the batches carrying their counts are out of the queue
+	defer ms.deliveries.onDelivered(func() { ms.logTailer.commit(positions) })
 
-			ms.ch <- metrics
-			ms.Lock()
-			ms.pollCount.Swap(1)
-			ms.Unlock()
-			log.Info().Msg("metrics pushed to queue")
-		}
+	if len(metrics) == 0 {
+		log.Warn().Msg("no metrics to send")
+		return
 	}
+
+	signMetrics(metrics, key)
+	batches := splitBatch(metrics, ms.batchSize, ms.batchBytes)
+	ms.enqueue(batches, key)
+	ms.Lock()
+	ms.pollCount.Swap(1)
+	ms.Unlock()
+	log.Info().Msgf("metrics pushed to queue in %d batches", len(batches))
 }
 
-// Send reads metrics from metric service chanel, converts them to JSON,
-// and sends them as HTTP POST requests to the address.
-func (ms *MetricsService) Send(ctx context.Context, wg *sync.WaitGroup, client http.Client, address string) {
-	defer wg.Done()
+// getPollInterval returns the current poll interval, the server config may change it at any time.
+func (ms *MetricsService) getPollInterval() time.Duration {
+	return time.Duration(ms.pollInterval.Load())
+}
 
-	for metrics := range ms.ch {
-		jsonData, err := json.Marshal(metrics)
-		if err != nil {
-			log.Error().Err(err).Msg("error marshalling metrics")
-			continue
-		}
+// getReportInterval returns the current report interval, the server config may change it at any time.
+func (ms *MetricsService) getReportInterval() time.Duration {
+	return time.Duration(ms.reportInterval.Load())
+}
 
-		request, err := http.NewRequestWithContext(ctx,
-			http.MethodPost,
-			"http://"+address+"/updates/",
-			bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Error().Err(err).Msg("error creating request")
-			continue
-		}
-		request.Header.Set("Content-Type", "application/json")
+// signMetrics sets the hash of every metric if the key is set.
+func signMetrics(metrics []models.Metric, key string) {
+	if len(key) == 0 {
+		return
+	}
+	for i := range metrics {
+		metrics[i].Hash = utils.Hash(hashSource(metrics[i]), key)
+	}
+}
 
-		response, err := client.Do(request)
-		if err != nil {
-			log.Error().Err(err).Msg("error sending request")
-			continue
-		}
+// Send reads batches from metric service chanel and writes them to the sink.
+// Every batch is retried on its own, so a failure of one batch never causes the others to be sent twice.
+// The context should outlive the collectors, so that the final flush can still be sent during shutdown.
+// Batches that fail with a retriable error during shutdown are saved to the spool file.
+func (ms *MetricsService) Send(ctx context.Context, wg *sync.WaitGroup, sink Sink) {
+	defer wg.Done()
 
-		_, err = io.ReadAll(response.Body)
-		if err != nil {
-			log.Error().Err(err).Msg("error reading response")
-			continue
+	for metrics := range ms.ch {
+		ms.telemetry.queueMetrics.Add(-int64(len(metrics)))
+		ms.sendBatch(ctx, sink, metrics)
+		ms.deliveries.done(1)
+		if counter, ok := sink.(rejectionCounter); ok {
+			ms.telemetry.add("batches_failed", counter.takeRejected())
 		}
+	}
+}
 
-		err = response.Body.Close()
-		if err != nil {
-			log.Error().Err(err).Msg("error closing response body")
-			continue
+// sendBatch writes the batch to the sink with retries. A batch failing with a retriable error during shutdown
+// is saved to the spool file, a rejected one is counted as lost.
+func (ms *MetricsService) sendBatch(ctx context.Context, sink Sink, metrics []models.Metric) {
+	attempts := 0
+	err := sendWithRetry(ctx, func() error {
+		attempts++
+		start := time.Now()
+		defer func() { ms.telemetry.observeSend(time.Since(start)) }()
+		return sink.Write(ctx, metrics)
+	})
+	ms.telemetry.add("send_retries", int64(attempts-1))
+	if err != nil {
+		ms.telemetry.add("batches_failed", 1)
+		log.Error().Err(err).Msgf("batch of %d metrics was not sent", len(metrics))
+		switch {
+		case !ms.shuttingDown.Load():
+		case isRetriable(err):
+			ms.spoolBatch(metrics)
+		default:
+			// the server has rejected the batch, sending it again on the next start would not help
+			ms.lost.Add(1)
 		}
+		return
 	}
+	ms.telemetry.add("batches_sent", 1)
 }
 
 func convertToPointerToFloat64(par uint64) *float64 {
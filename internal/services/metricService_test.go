@@ -7,72 +7,94 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
 	"github.com/jarcoal/httpmock"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestMetricService_CollectRuntime(t *testing.T) {
-	metrics := NewMetricsService(time.Second*2, time.Second*1, 5)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	go metrics.CollectRuntime(ctx)
-	time.Sleep(time.Second * 5)
+// runCollection starts the collector on a fake clock, lets it poll once and stops it.
+func runCollection(t *testing.T, ms *MetricsService, collect func(ctx context.Context)) {
+	clock := newFakeClock(time.Date(2023, 11, 20, 12, 0, 0, 0, time.UTC))
+	ms.clock = clock
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		collect(ctx)
+		close(done)
+	}()
+
+	clock.waitForWaiter(t)
+	clock.Advance(ms.getPollInterval())
+	// the collector waits for the next tick once it has stored the metrics
+	clock.waitForWaiter(t)
+	cancel()
+	<-done
+}
 
-	metrics.Lock()
-	assert.NotEqual(t, len(metrics.runtimeMetrics), 0, "a set of metrics was expected, but an empty response was received")
-	for _, m := range metrics.runtimeMetrics {
+func checkMetrics(t *testing.T, metrics []models.Metric) {
+	assert.NotEqual(t, len(metrics), 0, "a set of metrics was expected, but an empty response was received")
+	for _, m := range metrics {
 		if m.ID == "" || m.MType == "" || m.Value == nil && m.Delta == nil {
-			t.Errorf("ожидалось что все метрики будут иметь имя, тип и значение, но получено %v", m)
+			t.Errorf("it was expected that all metrics would have name, type and value, but %v was received.", m)
 		}
 	}
-	metrics.Unlock()
 }
 
-func TestMetricService_CollectAdvancedMetrics(t *testing.T) {
-	metrics := NewMetricsService(time.Second*2, time.Second*1, 5)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func TestMetricService_CollectRuntime(t *testing.T) {
+	metrics, err := NewMetricsService(&configs.AgentCfg{ReportInterval: time.Second * 2, PollInterval: time.Second * 1, RateLimit: 5})
+	require.NoError(t, err)
 
-	go metrics.CollectAdvanced(ctx)
-	time.Sleep(time.Second * 5)
+	runCollection(t, metrics, metrics.CollectRuntime)
 
 	metrics.Lock()
-	assert.NotEqual(t, len(metrics.advancedMetrics), 0, "a set of metrics was expected, but an empty response was received")
-	for _, m := range metrics.advancedMetrics {
-		if m.ID == "" || m.MType == "" || m.Value == nil && m.Delta == nil {
-			t.Errorf("ожидалось что все метрики будут иметь имя, тип и значение, но получено %v", m)
-		}
-	}
+	checkMetrics(t, metrics.runtimeMetrics)
 	metrics.Unlock()
 }
 
-func TestMetricService_MergeAndPushToQueue(t *testing.T) {
-	metrics := NewMetricsService(time.Second*3, time.Second*1, 5)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func TestMetricService_CollectAdvancedMetrics(t *testing.T) {
+	metrics, err := NewMetricsService(&configs.AgentCfg{ReportInterval: time.Second * 2, PollInterval: time.Second * 1, RateLimit: 5})
+	require.NoError(t, err)
 
-	go metrics.CollectRuntime(ctx)
-	metrics.MergeAndPushToQueue(ctx, "test")
+	runCollection(t, metrics, metrics.CollectAdvanced)
 
 	metrics.Lock()
-	assert.NotNil(t, metrics.ch, "channel was expected, but nil was received")
+	checkMetrics(t, metrics.advancedMetrics)
+	metrics.Unlock()
+}
+
+func TestMetricService_MergeAndPushToQueue(t *testing.T) {
+	metrics, err := NewMetricsService(&configs.AgentCfg{ReportInterval: time.Second * 3, PollInterval: time.Second * 1, RateLimit: 5})
+	require.NoError(t, err)
+	runCollection(t, metrics, metrics.CollectRuntime)
+
+	clock := metrics.clock.(*fakeClock)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		metrics.MergeAndPushToQueue(ctx, "test")
+		close(done)
+	}()
+
+	clock.waitForWaiter(t)
+	clock.Advance(metrics.getReportInterval())
 	mRtm, ok := <-metrics.ch
 	assert.Truef(t, ok, "channel was expected to be open, but it was closed")
-	assert.NotEqual(t, len(mRtm), 0, "a set of metrics was expected, but an empty response was received")
-	for _, m := range metrics.runtimeMetrics {
-		if m.ID == "" || m.MType == "" || m.Value == nil && m.Delta == nil {
-			t.Errorf("it was expected that all metrics would have name, type and value, but %v was received.", m)
-		}
+	assert.NotNil(t, findMetric(mRtm, "Alloc"), "the collected metrics were expected to be reported")
+	for _, m := range mRtm {
+		assert.NotEmpty(t, m.Hash, "metric %s was expected to be signed", m.ID)
 	}
-	metrics.Unlock()
+
+	cancel()
+	<-done
 }
 
 func TestMetricService_Send(t *testing.T) {
-	metrics := NewMetricsService(time.Second*3, time.Second*1, 5)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	metrics, err := NewMetricsService(&configs.AgentCfg{ReportInterval: time.Second * 3, PollInterval: time.Second * 1, RateLimit: 5})
+	require.NoError(t, err)
 
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
@@ -80,19 +102,15 @@ func TestMetricService_Send(t *testing.T) {
 	httpmock.RegisterResponder("POST", "http://localhost:8080/updates/",
 		httpmock.NewStringResponder(200, ""))
 
-	go metrics.CollectRuntime(ctx)
+	runCollection(t, metrics, metrics.CollectRuntime)
+	metrics.report("test")
+	close(metrics.ch)
 
 	agent := &http.Client{}
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	metrics.MergeAndPushToQueue(ctx, "test")
-	metrics.Send(ctx, wg, *agent, "localhost:8080")
-
-	assert.NotNil(t, metrics.ch, "channel was expected, but nil was received")
+	metrics.Send(context.Background(), wg, newHTTPSink(agent, "localhost:8080"))
 
-	time.Sleep(time.Second * 5)
 	info := httpmock.GetCallCountInfo()
-	if info["POST http://localhost:8080/updates/"] == 0 {
-		t.Error("a request to the server was expected, but it was not received")
-	}
+	assert.Equal(t, 1, info["POST http://localhost:8080/updates/"], "a request to the server was expected")
 }
@@ -0,0 +1,254 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+// Probe types.
+const (
+	ProbeHTTP = "http"
+	ProbeTCP  = "tcp"
+	ProbeDNS  = "dns"
+)
+
+// maxProbeBody limits the part of the response body checked by the body assertion.
+const maxProbeBody = 1 << 20
+
+var ErrProbeFailed = errors.New("probe failed")
+
+// probe is a blackbox check run against a target from the agent host.
+type probe struct {
+	Name     string           `json:"name"`
+	Type     string           `json:"type"`
+	Target   string           `json:"target"`
+	Interval configs.Duration `json:"interval"`
+	Timeout  configs.Duration `json:"timeout"`
+	// Status lists the accepted HTTP status codes, any 2xx is accepted if it is empty.
+	Status []int `json:"status"`
+	// Body is a regular expression the HTTP response body must match.
+	Body string `json:"body"`
+	// Insecure disables the verification of the TLS certificate.
+	Insecure bool `json:"insecure"`
+	// Resolver is the address of the DNS server, the system resolver is used if it is empty.
+	Resolver string `json:"resolver"`
+
+	body *regexp.Regexp
+}
+
+// loadProbes reads the probe list from a JSON file. An empty path means no probes.
+func loadProbes(path string) ([]probe, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var probes []probe
+	if err = json.Unmarshal(data, &probes); err != nil {
+		return nil, fmt.Errorf("probes file %s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range probes {
+		p := &probes[i]
+		if len(p.Name) == 0 || len(p.Target) == 0 {
+			return nil, fmt.Errorf("probe #%d must have a name and a target", i+1)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("probe %s is defined twice", p.Name)
+		}
+		names[p.Name] = true
+
+		switch p.Type {
+		case ProbeHTTP, ProbeTCP, ProbeDNS:
+		default:
+			return nil, fmt.Errorf("probe %s has unknown type %q", p.Name, p.Type)
+		}
+		if len(p.Body) > 0 {
+			if p.body, err = regexp.Compile(p.Body); err != nil {
+				return nil, fmt.Errorf("probe %s: %w", p.Name, err)
+			}
+		}
+
+		if p.Interval <= 0 {
+			p.Interval = configs.Duration(30 * time.Second)
+		}
+		if p.Timeout <= 0 || p.Timeout > p.Interval {
+			p.Timeout = p.Interval
+		}
+	}
+	return probes, nil
+}
+
+// CollectProbes runs every probe on its own interval until the context is done.
+// At most workers probes run at the same time, the others wait for a free worker.
+func (ms *MetricsService) CollectProbes(ctx context.Context) {
+	workers := make(chan struct{}, ms.probeWorkers)
+	wg := &sync.WaitGroup{}
+	for i := range ms.probes {
+		p := ms.probes[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			interval := func() time.Duration { return time.Duration(p.Interval) }
+			ms.runCollector(ctx, "probe_"+p.Name, interval, func(ctx context.Context) ([]models.Metric, error) {
+				select {
+				case workers <- struct{}{}:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				defer func() { <-workers }()
+				return runProbe(ctx, p)
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+// probeResult is what one run of a probe found out.
+type probeResult struct {
+	duration      time.Duration
+	statusCode    int
+	tlsExpiryDays *float64
+}
+
+// runProbe runs the probe once and returns its gauges. A failed check is reported as probe_success 0,
+// the error is returned for the collector telemetry. A probe interrupted by the agent shutdown reports nothing.
+func runProbe(parent context.Context, p probe) ([]models.Metric, error) {
+	ctx, cancel := context.WithTimeout(parent, time.Duration(p.Timeout))
+	defer cancel()
+
+	var result probeResult
+	var err error
+	start := time.Now()
+	switch p.Type {
+	case ProbeHTTP:
+		result, err = probeHTTP(ctx, p)
+	case ProbeTCP:
+		err = probeTCP(ctx, p)
+	case ProbeDNS:
+		err = probeDNS(ctx, p)
+	}
+	result.duration = time.Since(start)
+	if parent.Err() != nil {
+		return nil, parent.Err()
+	}
+
+	success := 1.0
+	if err != nil {
+		success = 0
+		err = fmt.Errorf("%w: %s: %v", ErrProbeFailed, p.Name, err)
+	}
+
+	metrics := []models.Metric{
+		probeGauge("probe_success_"+p.Name, success),
+		probeGauge("probe_duration_seconds_"+p.Name, result.duration.Seconds()),
+	}
+	if p.Type == ProbeHTTP {
+		metrics = append(metrics, probeGauge("probe_status_code_"+p.Name, float64(result.statusCode)))
+	}
+	if result.tlsExpiryDays != nil {
+		metrics = append(metrics, probeGauge("probe_tls_expiry_days_"+p.Name, *result.tlsExpiryDays))
+	}
+	return metrics, err
+}
+
+func probeHTTP(ctx context.Context, p probe) (probeResult, error) {
+	var result probeResult
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: p.Insecure} //nolint:gosec // asked for by the probe config
+	transport.DisableKeepAlives = true
+	client := &http.Client{Transport: transport}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Target, nil)
+	if err != nil {
+		return result, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+
+	result.statusCode = response.StatusCode
+	if response.TLS != nil && len(response.TLS.PeerCertificates) > 0 {
+		days := time.Until(response.TLS.PeerCertificates[0].NotAfter).Hours() / 24
+		result.tlsExpiryDays = &days
+	}
+
+	if !acceptedStatus(p.Status, response.StatusCode) {
+		return result, fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+	if p.body != nil {
+		body, err := io.ReadAll(io.LimitReader(response.Body, maxProbeBody))
+		if err != nil {
+			return result, err
+		}
+		if !p.body.Match(body) {
+			return result, fmt.Errorf("the body does not match %q", p.Body)
+		}
+	}
+	return result, nil
+}
+
+func acceptedStatus(accepted []int, code int) bool {
+	if len(accepted) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, c := range accepted {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func probeTCP(ctx context.Context, p probe) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", p.Target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeDNS(ctx context.Context, p probe) error {
+	resolver := net.DefaultResolver
+	if len(p.Resolver) > 0 {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, p.Resolver)
+			},
+		}
+	}
+
+	addresses, err := resolver.LookupHost(ctx, p.Target)
+	if err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		return fmt.Errorf("no addresses for %s", p.Target)
+	}
+	return nil
+}
+
+func probeGauge(id string, value float64) models.Metric {
+	return models.Metric{ID: id, MType: Gauge, Value: &value}
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func probeValue(t *testing.T, metrics []models.Metric, id string) float64 {
+	m := findMetric(metrics, id)
+	require.NotNil(t, m, "metric %s was expected", id)
+	return *m.Value
+}
+
+func TestLoadProbes(t *testing.T) {
+	probes, err := loadProbes("")
+	assert.NoError(t, err)
+	assert.Empty(t, probes)
+
+	path := filepath.Join(t.TempDir(), "probes.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "site", "type": "http", "target": "https://example.com", "interval": "1m", "body": "ok"},
+		{"name": "db", "type": "tcp", "target": "localhost:5432", "interval": "10s", "timeout": "1m"}
+	]`), 0o600))
+	probes, err = loadProbes(path)
+	require.NoError(t, err)
+	require.Len(t, probes, 2)
+	assert.Equal(t, configs.Duration(time.Minute), probes[0].Timeout)
+	assert.NotNil(t, probes[0].body)
+	assert.Equal(t, configs.Duration(10*time.Second), probes[1].Timeout)
+
+	for _, content := range []string{
+		`[{"name": "x", "type": "icmp", "target": "localhost"}]`,
+		`[{"name": "x", "type": "tcp"}]`,
+		`[{"name": "x", "type": "http", "target": "http://x", "body": "("}]`,
+		`[{"name": "x", "type": "tcp", "target": "a:1"}, {"name": "x", "type": "tcp", "target": "b:1"}]`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = loadProbes(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestRunProbe_HTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			_, _ = w.Write([]byte(`{"status":"ok"}`))
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+
+	testCases := []struct {
+		name    string
+		probe   probe
+		success float64
+		status  float64
+	}{
+		{"ok", probe{Target: ts.URL + "/health"}, 1, 200},
+		{"body matches", probe{Target: ts.URL + "/health", Body: `"status":"ok"`}, 1, 200},
+		{"body does not match", probe{Target: ts.URL + "/health", Body: "down"}, 0, 200},
+		{"bad status", probe{Target: ts.URL + "/down"}, 0, 503},
+		{"accepted status", probe{Target: ts.URL + "/down", Status: []int{503}}, 1, 503},
+		{"timeout", probe{Target: ts.URL + "/slow", Timeout: configs.Duration(100 * time.Millisecond)}, 0, 0},
+		{"tls", probe{Target: tlsServer.URL, Insecure: true}, 1, 200},
+		{"untrusted certificate", probe{Target: tlsServer.URL}, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.probe
+			p.Name, p.Type = "web", ProbeHTTP
+			if p.Timeout == 0 {
+				p.Timeout = configs.Duration(time.Second)
+			}
+			if len(p.Body) > 0 {
+				p.body = regexp.MustCompile(p.Body)
+			}
+
+			metrics, err := runProbe(context.Background(), p)
+			if tc.success == 1 {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrProbeFailed)
+			}
+			assert.Equal(t, tc.success, probeValue(t, metrics, "probe_success_web"))
+			assert.Equal(t, tc.status, probeValue(t, metrics, "probe_status_code_web"))
+			assert.Greater(t, probeValue(t, metrics, "probe_duration_seconds_web"), 0.0)
+		})
+	}
+
+	metrics, err := runProbe(context.Background(),
+		probe{Name: "web", Type: ProbeHTTP, Target: tlsServer.URL, Insecure: true, Timeout: configs.Duration(time.Second)})
+	require.NoError(t, err)
+	expiry := time.Until(tlsServer.Certificate().NotAfter).Hours() / 24
+	assert.InDelta(t, expiry, probeValue(t, metrics, "probe_tls_expiry_days_web"), 0.01)
+}
+
+func TestRunProbe_TCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+
+	p := probe{Name: "db", Type: ProbeTCP, Target: address, Timeout: configs.Duration(time.Second)}
+	metrics, err := runProbe(context.Background(), p)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, probeValue(t, metrics, "probe_success_db"))
+	assert.Nil(t, findMetric(metrics, "probe_status_code_db"))
+
+	require.NoError(t, listener.Close())
+	metrics, err = runProbe(context.Background(), p)
+	assert.ErrorIs(t, err, ErrProbeFailed)
+	assert.Equal(t, 0.0, probeValue(t, metrics, "probe_success_db"))
+}
+
+// testResolver answers every A question with 10.0.0.1 except for names under "missing.".
+func testResolver(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var request dnsmessage.Message
+			if err = request.Unpack(buf[:n]); err != nil || len(request.Questions) == 0 {
+				continue
+			}
+
+			question := request.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: request.ID, Response: true, Authoritative: true},
+				Questions: request.Questions,
+			}
+			switch {
+			case strings.HasSuffix(question.Name.String(), "missing."):
+				response.RCode = dnsmessage.RCodeNameError
+			case question.Type == dnsmessage.TypeA:
+				response.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+				}}
+			}
+			packed, err := response.Pack()
+			if err == nil {
+				_, _ = conn.WriteTo(packed, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestRunProbe_DNS(t *testing.T) {
+	resolver := testResolver(t)
+
+	p := probe{Name: "dns", Type: ProbeDNS, Target: "service.example.", Resolver: resolver, Timeout: configs.Duration(2 * time.Second)}
+	metrics, err := runProbe(context.Background(), p)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, probeValue(t, metrics, "probe_success_dns"))
+
+	p.Target = "service.missing."
+	metrics, err = runProbe(context.Background(), p)
+	assert.ErrorIs(t, err, ErrProbeFailed)
+	assert.Equal(t, 0.0, probeValue(t, metrics, "probe_success_dns"))
+}
+
+func TestMetricsService_CollectProbes(t *testing.T) {
+	var running, maxRunning atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	ms, err := NewMetricsService(&configs.AgentCfg{RateLimit: 1, ProbeWorkers: 2})
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		ms.probes = append(ms.probes, probe{
+			Name: name, Type: ProbeHTTP, Target: ts.URL,
+			Interval: configs.Duration(20 * time.Millisecond), Timeout: configs.Duration(time.Second),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	ms.CollectProbes(ctx)
+
+	assert.LessOrEqual(t, maxRunning.Load(), int64(2), "no more probes than workers were expected to run")
+	ms.Lock()
+	metrics := ms.drainCollected()
+	ms.Unlock()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		assert.Equal(t, 1.0, probeValue(t, metrics, "probe_success_"+name))
+	}
+}
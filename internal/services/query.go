@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/query"
+	"github.com/dbulyk/metrics-alerting-service/internal/storages"
+)
+
+// TypeLabel is the label holding the metric type in query results.
+const TypeLabel = "type"
+
+type repositoryStorage struct {
+	repository storages.IRepository
+	history    *History
+}
+
+// NewQueryStorage returns the metrics of the repository as query series. The points of a series are the values
+// recorded by the history followed by the current value at its update time, so rate and increase can be computed
+// over the recent updates. The sums and the quantile estimates of histograms and summaries and the infos have
+// no history and only the current point. The history may be nil.
+func NewQueryStorage(repository storages.IRepository, history *History) query.Storage {
+	return &repositoryStorage{repository: repository, history: history}
+}
+
+func (rs *repositoryStorage) Select(ctx context.Context, matchers []*query.Matcher, start, end time.Time) ([]query.Series, error) {
+	metrics, err := rs.repository.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var series []query.Series
+	for _, m := range metrics {
+		for _, s := range metricSeries(m, rs.recorded(m)) {
+			if !query.MatchLabels(matchers, s.Labels) {
+				continue
+			}
+			s.Points = pointsBetween(s.Points, start, end)
+			if len(s.Points) > 0 {
+				series = append(series, s)
+			}
+		}
+	}
+	return series, nil
+}
+
+// recorded returns the values of the metric recorded by the history.
+func (rs *repositoryStorage) recorded(m *models.Metric) []query.Point {
+	if rs.history == nil {
+		return nil
+	}
+	history := rs.history.Get(m.ID, m.MType)
+	points := make([]query.Point, 0, len(history))
+	for _, p := range history {
+		points = append(points, query.Point{T: p.T, V: p.V})
+	}
+	return points
+}
+
+func pointsBetween(points []query.Point, start, end time.Time) []query.Point {
+	result := make([]query.Point, 0, len(points))
+	for _, p := range points {
+		if !p.T.Before(start) && !p.T.After(end) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// metricSeries returns the series of a metric: its value for gauges and counters, the count, the sum and
+// the quantile estimates like name{quantile="0.5"} for histograms and summaries, the cardinality estimate
+// for sets and 1 with the text and the labels of an info. The recorded values of the metric as returned
+// by MetricValue precede the current one in the series of the value, the count and the cardinality.
+// A metric without an update time is taken as updated now.
+func metricSeries(m *models.Metric, recorded []query.Point) []query.Series {
+	t := time.Now()
+	if m.UpdatedAt != nil {
+		t = *m.UpdatedAt
+	}
+	point := func(name string, v float64, extra query.Labels) query.Series {
+		labels := query.Labels{query.NameLabel: name, TypeLabel: m.MType}
+		for l, lv := range extra {
+			if _, ok := labels[l]; !ok {
+				labels[l] = lv
+			}
+		}
+		return query.Series{Labels: labels, Points: []query.Point{{T: t, V: v}}}
+	}
+	withHistory := func(s query.Series) query.Series {
+		points := make([]query.Point, 0, len(recorded)+1)
+		for _, p := range recorded {
+			if p.T.Before(t) {
+				points = append(points, p)
+			}
+		}
+		s.Points = append(points, s.Points...)
+		return s
+	}
+
+	switch {
+	case m.MType == Gauge && m.Value != nil:
+		return []query.Series{withHistory(point(m.ID, *m.Value, nil))}
+	case m.MType == Counter && m.Delta != nil:
+		return []query.Series{withHistory(point(m.ID, float64(*m.Delta), nil))}
+	case m.MType == Histogram && m.Histogram != nil || m.MType == Summary && m.Summary != nil:
+		var count uint64
+		var sum float64
+		if m.Histogram != nil {
+			count, sum = m.Histogram.Count, m.Histogram.Sum
+		} else {
+			count, sum = m.Summary.Count, m.Summary.Sum
+		}
+		series := []query.Series{withHistory(point(m.ID+"_count", float64(count), nil)), point(m.ID+"_sum", sum, nil)}
+		for _, q := range ReadQuantiles {
+			if v := Quantile(m, q); !math.IsNaN(v) {
+				series = append(series, point(m.ID, v, query.Labels{"quantile": strconv.FormatFloat(q, 'g', -1, 64)}))
+			}
+		}
+		return series
+	case m.MType == Set && m.Set != nil:
+		return []query.Series{withHistory(point(m.ID, float64(SetCardinality(m.Set)), nil))}
+	case m.MType == Info && m.Info != nil:
+		labels := query.Labels{"text": m.Info.Text}
+		for l, lv := range m.Info.Labels {
+			labels[l] = lv
+		}
+		return []query.Series{point(m.ID, 1, labels)}
+	}
+	return nil
+}
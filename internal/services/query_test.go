@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryStorage(t *testing.T) {
+	ctx := context.Background()
+	repo := NewFileRepository("", time.Second, "")
+	value := 0.5
+	_, err := repo.Updates(ctx, []models.Metric{
+		{ID: "Alloc", MType: Gauge, Value: &value},
+		{ID: "users", MType: Set, Set: NewSet("alice", "bob")},
+		{ID: "AgentBuild", MType: Info, Info: &models.Info{Text: "1.4.2", Labels: map[string]string{"type": "ignored"}}},
+		{ID: "latency", MType: Histogram, Histogram: NewHistogram([]float64{1}, 0.5)},
+	})
+	require.NoError(t, err)
+
+	now := time.Now()
+	v, err := query.Query(ctx, NewQueryStorage(repo, nil), `{type=~"set|info"}`, now)
+	require.NoError(t, err)
+	assert.Equal(t, query.Vector{
+		{Labels: query.Labels{query.NameLabel: "AgentBuild", TypeLabel: Info, "text": "1.4.2"}, V: 1},
+		{Labels: query.Labels{query.NameLabel: "users", TypeLabel: Set}, V: 2},
+	}, v)
+
+	v, err = query.Query(ctx, NewQueryStorage(repo, nil), `{__name__=~"latency.*"}`, now)
+	require.NoError(t, err)
+	assert.Len(t, v, 2+len(ReadQuantiles))
+
+	// the repository keeps no history, so there is nothing to compute a rate from
+	v, err = query.Query(ctx, NewQueryStorage(repo, nil), `rate(Alloc[5m])`, now)
+	require.NoError(t, err)
+	assert.Empty(t, v)
+}
+
+func TestQueryStorage_History(t *testing.T) {
+	ctx := context.Background()
+	repo := NewFileRepository("", time.Second, "")
+	delta := int64(70)
+	value := 3.0
+	_, err := repo.Updates(ctx, []models.Metric{
+		{ID: "PollCount", MType: Counter, Delta: &delta},
+		{ID: "Alloc", MType: Gauge, Value: &value},
+	})
+	require.NoError(t, err)
+	current, err := repo.Get(ctx, "PollCount", Counter)
+	require.NoError(t, err)
+	require.NotNil(t, current.UpdatedAt)
+	now := *current.UpdatedAt
+
+	history := NewHistory(HistorySize)
+	for i, v := range []int64{10, 40} {
+		at := now.Add(time.Duration(i-2) * time.Minute)
+		d := v
+		history.Add(&models.Metric{ID: "PollCount", MType: Counter, Delta: &d, UpdatedAt: &at})
+	}
+	past := now.Add(-90 * time.Second)
+	old := 1.0
+	history.Add(&models.Metric{ID: "Alloc", MType: Gauge, Value: &old, UpdatedAt: &past})
+	storage := NewQueryStorage(repo, history)
+
+	v, err := query.Query(ctx, storage, `increase(PollCount[5m])`, now)
+	require.NoError(t, err)
+	require.Len(t, v, 1)
+	assert.InDelta(t, 60, v.(query.Vector)[0].V, 1e-9)
+
+	v, err = query.Query(ctx, storage, `rate(PollCount[5m])`, now)
+	require.NoError(t, err)
+	require.Len(t, v, 1)
+	assert.InDelta(t, 0.5, v.(query.Vector)[0].V, 1e-9)
+
+	v, err = query.Query(ctx, storage, `Alloc`, now.Add(-time.Minute))
+	require.NoError(t, err)
+	require.Len(t, v, 1)
+	assert.Equal(t, 1.0, v.(query.Vector)[0].V, "the value at the evaluation time was expected")
+
+	v, err = query.Query(ctx, storage, `Alloc`, now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, v, "the metric was not expected before it was recorded")
+}
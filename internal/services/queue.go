@@ -0,0 +1,182 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Queue overflow policies.
+const (
+	QueueBlock      = "block"
+	QueueDropOldest = "drop-oldest"
+	QueueDropNewest = "drop-newest"
+	QueueMerge      = "merge"
+)
+
+func validateQueuePolicy(policy string) error {
+	switch policy {
+	case QueueBlock, QueueDropOldest, QueueDropNewest, QueueMerge:
+		return nil
+	}
+	return fmt.Errorf("unknown queue policy %q", policy)
+}
+
+// enqueue pushes the batches to the queue. When the queue is full, the overflow policy decides
+// whether to wait for the senders, drop a batch or merge the queued batches with the new ones.
+func (ms *MetricsService) enqueue(batches [][]models.Metric, key string) {
+	ms.deliveries.add(len(batches))
+	for i, batch := range batches {
+		select {
+		case ms.ch <- batch:
+			ms.telemetry.queueMetrics.Add(int64(len(batch)))
+			continue
+		default:
+		}
+
+		switch ms.queuePolicy {
+		case QueueDropNewest:
+			ms.dropBatch(batch, "newest")
+		case QueueDropOldest:
+			ms.pushDroppingOldest(batch)
+		case QueueMerge:
+			ms.mergeIntoQueue(batches[i:], key)
+			return
+		default:
+			ms.ch <- batch
+			ms.telemetry.queueMetrics.Add(int64(len(batch)))
+		}
+	}
+}
+
+// pushDroppingOldest drops queued batches until the batch fits.
+func (ms *MetricsService) pushDroppingOldest(batch []models.Metric) {
+	for {
+		select {
+		case ms.ch <- batch:
+			ms.telemetry.queueMetrics.Add(int64(len(batch)))
+			return
+		default:
+		}
+
+		select {
+		case oldest := <-ms.ch:
+			ms.telemetry.queueMetrics.Add(-int64(len(oldest)))
+			ms.dropBatch(oldest, "oldest")
+		default:
+		}
+	}
+}
+
+// mergeIntoQueue takes the queued batches out, merges them with the new ones and queues the result again.
+// The merge policy never loses data, if the merged metrics still do not fit, it waits for the senders.
+func (ms *MetricsService) mergeIntoQueue(batches [][]models.Metric, key string) {
+	queued := make([][]models.Metric, 0, cap(ms.ch)+len(batches))
+drain:
+	for len(queued) < cap(ms.ch) {
+		select {
+		case batch := <-ms.ch:
+			ms.telemetry.queueMetrics.Add(-int64(len(batch)))
+			queued = append(queued, batch)
+		default:
+			break drain
+		}
+	}
+
+	merged := mergeBatches(append(queued, batches...))
+	signMetrics(merged, key)
+	result := splitBatch(merged, ms.batchSize, ms.batchBytes)
+	ms.telemetry.add("batches_merged", int64(len(queued)+len(batches)-len(result)))
+	log.Warn().Msgf("the queue is full, %d batches merged into %d", len(queued)+len(batches), len(result))
+
+	ms.deliveries.add(len(result))
+	ms.deliveries.done(len(queued) + len(batches))
+	for _, batch := range result {
+		ms.ch <- batch
+		ms.telemetry.queueMetrics.Add(int64(len(batch)))
+	}
+}
+
+// dropBatch drops a batch that does not fit into the queue. During the final flush the batch
+// is saved to the spool file instead, so that the exit code accounts for it.
+func (ms *MetricsService) dropBatch(batch []models.Metric, which string) {
+	defer ms.deliveries.done(1)
+	if ms.shuttingDown.Load() {
+		log.Warn().Msgf("the queue is full during shutdown, the %s batch of %d metrics goes to the spool", which, len(batch))
+		ms.spoolBatch(batch)
+		return
+	}
+	ms.telemetry.add("batches_dropped", 1)
+	log.Warn().Msgf("the queue is full, the %s batch of %d metrics was dropped", which, len(batch))
+}
+
+// mergeBatches combines batches into one: counter deltas are added up, gauges keep the last value.
+// Metrics keep the order of their first appearance.
+func mergeBatches(batches [][]models.Metric) []models.Metric {
+	index := make(map[string]int)
+	merged := make([]models.Metric, 0)
+
+	for _, batch := range batches {
+		for _, m := range batch {
+			key := m.MType + ":" + m.ID
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(merged)
+				merged = append(merged, m)
+				continue
+			}
+
+			if m.MType == Counter && merged[i].Delta != nil && m.Delta != nil {
+				delta := *merged[i].Delta + *m.Delta
+				m.Delta = &delta
+			}
+			merged[i] = m
+		}
+	}
+	return merged
+}
+
+// deliveries counts the batches that are queued or being sent. A commit waits until all of them are sent,
+// spooled or dropped, so it runs only after every batch reported before it is out of the agent's memory.
+type deliveries struct {
+	sync.Mutex
+	pending int
+	commit  func()
+}
+
+func (d *deliveries) add(n int) {
+	d.Lock()
+	d.pending += n
+	d.Unlock()
+}
+
+// done marks n batches as delivered and runs the waiting commit if no batch is left.
+func (d *deliveries) done(n int) {
+	d.Lock()
+	d.pending -= n
+	var commit func()
+	if d.pending <= 0 {
+		commit, d.commit = d.commit, nil
+	}
+	d.Unlock()
+
+	if commit != nil {
+		commit()
+	}
+}
+
+// onDelivered runs the commit once the batches queued so far are delivered. A newer commit replaces
+// the waiting one, as it covers the same batches and the ones queued after them.
+func (d *deliveries) onDelivered(commit func()) {
+	d.Lock()
+	if d.pending > 0 {
+		d.commit = commit
+		d.Unlock()
+		return
+	}
+	d.Unlock()
+	commit()
+}
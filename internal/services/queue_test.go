@@ -0,0 +1,68 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func counterBatch(id string, delta int64) []models.Metric {
+	return []models.Metric{{ID: id, MType: Counter, Delta: &delta}}
+}
+
+func TestMergeBatches(t *testing.T) {
+	g1, g2 := 1.0, 2.0
+	d1, d2 := int64(3), int64(4)
+	merged := mergeBatches([][]models.Metric{
+		{{ID: "Alloc", MType: Gauge, Value: &g1}, {ID: "PollCount", MType: Counter, Delta: &d1}},
+		{{ID: "PollCount", MType: Counter, Delta: &d2}, {ID: "Alloc", MType: Gauge, Value: &g2}},
+	})
+
+	require.Len(t, merged, 2)
+	assert.Equal(t, 2.0, *merged[0].Value)
+	assert.Equal(t, int64(7), *merged[1].Delta)
+	assert.Equal(t, int64(3), d1, "the merged batches were not expected to change")
+}
+
+func TestMetricService_Enqueue(t *testing.T) {
+	newService := func(policy string) *MetricsService {
+		ms, err := NewMetricsService(&configs.AgentCfg{RateLimit: 1, QueueSize: 2, QueuePolicy: policy})
+		require.NoError(t, err)
+		return ms
+	}
+	drain := func(ms *MetricsService) [][]models.Metric {
+		close(ms.ch)
+		batches := make([][]models.Metric, 0)
+		for batch := range ms.ch {
+			batches = append(batches, batch)
+		}
+		return batches
+	}
+	batches := [][]models.Metric{counterBatch("a", 1), counterBatch("b", 1), counterBatch("c", 1)}
+
+	ms := newService(QueueDropNewest)
+	ms.enqueue(batches, "")
+	assert.Equal(t, batches[:2], drain(ms))
+	assert.Equal(t, int64(1), *findMetric(ms.telemetry.collect(0, false), "agent_batches_dropped").Delta)
+
+	ms = newService(QueueDropOldest)
+	ms.enqueue(batches, "")
+	assert.Equal(t, batches[1:], drain(ms))
+	assert.Equal(t, int64(1), *findMetric(ms.telemetry.collect(0, false), "agent_batches_dropped").Delta)
+
+	ms = newService(QueueMerge)
+	ms.enqueue([][]models.Metric{counterBatch("PollCount", 2), counterBatch("PollCount", 3)}, "key")
+	ms.enqueue([][]models.Metric{counterBatch("PollCount", 4)}, "key")
+	merged := drain(ms)
+	require.Len(t, merged, 1)
+	assert.Equal(t, int64(9), *merged[0][0].Delta, "counter deltas were expected to add up")
+	assert.Equal(t, utils.Hash("PollCount:counter:9", "key"), merged[0][0].Hash, "the merged metric was expected to be signed again")
+
+	_, err := NewMetricsService(&configs.AgentCfg{RateLimit: 1, QueuePolicy: "drop-all"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Relabeling actions.
+const (
+	RelabelDrop   = "drop"
+	RelabelKeep   = "keep"
+	RelabelRename = "rename"
+	RelabelPrefix = "prefix"
+	RelabelType   = "type"
+)
+
+// relabelRule is applied to the metrics whose ID fully matches the regex.
+type relabelRule struct {
+	Action string `json:"action"`
+	Regex  string `json:"regex"`
+	// Replacement is the new ID for rename, it may refer to capture groups as $1 or ${name}.
+	Replacement string `json:"replacement,omitempty"`
+	// Prefix is added to the ID by the prefix action.
+	Prefix string `json:"prefix,omitempty"`
+	// Type is the metric type the type action converts to.
+	Type string `json:"type,omitempty"`
+
+	regexp *regexp.Regexp
+}
+
+// relabeler filters and rewrites metrics before they are sent. Rules are applied in order,
+// every rule sees the result of the previous ones.
+type relabeler struct {
+	rules []relabelRule
+}
+
+// newRelabeler reads the rules from a JSON file. An empty path means no rules.
+func newRelabeler(path string) (*relabeler, error) {
+	r := &relabeler{rules: make([]relabelRule, 0)}
+	if len(path) == 0 {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &r.rules); err != nil {
+		return nil, fmt.Errorf("relabel rules file %s: %w", path, err)
+	}
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+		rule.regexp, err = regexp.Compile("^(?:" + rule.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule #%d: %w", i+1, err)
+		}
+
+		switch rule.Action {
+		case RelabelDrop, RelabelKeep:
+		case RelabelRename:
+			if len(rule.Replacement) == 0 {
+				return nil, fmt.Errorf("relabel rule #%d: rename needs a replacement", i+1)
+			}
+			if isReserved(rule.Replacement) {
+				return nil, fmt.Errorf("relabel rule #%d: the prefix %s is reserved", i+1, TelemetryPrefix)
+			}
+		case RelabelPrefix:
+			if len(rule.Prefix) == 0 {
+				return nil, fmt.Errorf("relabel rule #%d: prefix needs a prefix", i+1)
+			}
+			if isReserved(rule.Prefix) {
+				return nil, fmt.Errorf("relabel rule #%d: the prefix %s is reserved", i+1, TelemetryPrefix)
+			}
+		case RelabelType:
+			if rule.Type != Gauge && rule.Type != Counter {
+				return nil, fmt.Errorf("relabel rule #%d: %w: %q", i+1, ErrInvalidMetricType, rule.Type)
+			}
+		default:
+			return nil, fmt.Errorf("relabel rule #%d: unknown action %q", i+1, rule.Action)
+		}
+	}
+	return r, nil
+}
+
+// apply runs the rules over the metrics and returns the metrics left.
+func (r *relabeler) apply(metrics []models.Metric) []models.Metric {
+	if len(r.rules) == 0 {
+		return metrics
+	}
+
+	result := make([]models.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if r.relabel(&m) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// relabel applies the rules to one metric and reports whether it is kept.
+// A metric renamed into the reserved prefix of the agent telemetry, e.g. by a capture group, is dropped.
+func (r *relabeler) relabel(m *models.Metric) bool {
+	for i := range r.rules {
+		rule := &r.rules[i]
+		match := rule.regexp.FindStringSubmatchIndex(m.ID)
+
+		switch rule.Action {
+		case RelabelDrop:
+			if match != nil {
+				return false
+			}
+		case RelabelKeep:
+			if match == nil {
+				return false
+			}
+		case RelabelRename:
+			if match != nil {
+				m.ID = string(rule.regexp.ExpandString(nil, rule.Replacement, m.ID, match))
+				if isReserved(m.ID) {
+					log.Warn().Msgf("metric %s is dropped, the prefix %s is reserved", m.ID, TelemetryPrefix)
+					return false
+				}
+			}
+		case RelabelPrefix:
+			if match != nil {
+				m.ID = rule.Prefix + m.ID
+			}
+		case RelabelType:
+			if match != nil {
+				convertType(m, rule.Type)
+			}
+		}
+	}
+	return true
+}
+
+// convertType changes the metric type, a gauge value is rounded to the nearest counter delta.
+func convertType(m *models.Metric, mType string) {
+	switch {
+	case m.MType == Gauge && mType == Counter && m.Value != nil:
+		delta := int64(math.Round(*m.Value))
+		m.Delta = &delta
+		m.Value = nil
+	case m.MType == Counter && mType == Gauge && m.Delta != nil:
+		value := float64(*m.Delta)
+		m.Value = &value
+		m.Delta = nil
+	default:
+		return
+	}
+	m.MType = mType
+}
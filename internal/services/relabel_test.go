@@ -0,0 +1,79 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRules(t *testing.T, rules string) string {
+	path := filepath.Join(t.TempDir(), "relabel.json")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0o600))
+	return path
+}
+
+func TestNewRelabeler(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rules string
+	}{
+		{name: "invalid regex", rules: `[{"action": "drop", "regex": "Heap("}]`},
+		{name: "unknown action", rules: `[{"action": "replace", "regex": "Heap"}]`},
+		{name: "rename without replacement", rules: `[{"action": "rename", "regex": "Heap"}]`},
+		{name: "prefix without prefix", rules: `[{"action": "prefix", "regex": "Heap"}]`},
+		{name: "unknown type", rules: `[{"action": "type", "regex": "Heap", "type": "histogram"}]`},
+		{name: "rename into telemetry", rules: `[{"action": "rename", "regex": "Heap", "replacement": "agent_heap"}]`},
+		{name: "prefix of telemetry", rules: `[{"action": "prefix", "regex": "Heap", "prefix": "agent_"}]`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newRelabeler(writeRules(t, tc.rules))
+			assert.Error(t, err)
+		})
+	}
+
+	r, err := newRelabeler("")
+	require.NoError(t, err)
+	assert.Empty(t, r.rules)
+}
+
+func TestRelabeler_Apply(t *testing.T) {
+	r, err := newRelabeler(writeRules(t, `[
+		{"action": "drop", "regex": "(Heap|Stack).*"},
+		{"action": "keep", "regex": "CPUutilization\\d+|Alloc|PollCount|Custom_.*"},
+		{"action": "rename", "regex": "Custom_(.*)", "replacement": "$1"},
+		{"action": "rename", "regex": "CPUutilization(?P<core>\\d+)", "replacement": "cpu_${core}_percent"},
+		{"action": "prefix", "regex": "cpu_.*|Alloc", "prefix": "host1_"},
+		{"action": "type", "regex": "PollCount", "type": "gauge"},
+		{"action": "type", "regex": "host1_Alloc", "type": "counter"}
+	]`))
+	require.NoError(t, err)
+
+	gauge := func(id string, v float64) models.Metric {
+		return models.Metric{ID: id, MType: Gauge, Value: &v}
+	}
+	delta := int64(5)
+	metrics := r.apply([]models.Metric{
+		gauge("HeapAlloc", 1),
+		gauge("StackSys", 2),
+		gauge("CPUutilization2", 30),
+		gauge("Alloc", 10.6),
+		gauge("RandomValue", 0.5),
+		gauge("Custom_agent_queue_depth", 1),
+		{ID: "PollCount", MType: Counter, Delta: &delta},
+	})
+
+	require.Len(t, metrics, 3)
+	assert.Equal(t, gauge("host1_cpu_2_percent", 30), metrics[0])
+	assert.Equal(t, "host1_Alloc", metrics[1].ID)
+	assert.Equal(t, Counter, metrics[1].MType)
+	assert.Equal(t, int64(11), *metrics[1].Delta)
+	assert.Nil(t, metrics[1].Value)
+	assert.Equal(t, gauge("PollCount", 5), metrics[2])
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// remoteConfig fetches the agent config from the server and keeps the last one in a local cache,
+// so that the agent starts with it when the server is unavailable.
+type remoteConfig struct {
+	sync.Mutex
+	client    *http.Client
+	addresses []string
+	agentID   string
+	labels    string
+	interval  time.Duration
+	cachePath string
+	version   string
+	changed   chan struct{}
+}
+
+func newRemoteConfig(cfg *configs.AgentCfg) (*remoteConfig, error) {
+	if cfg.RemoteConfigInterval <= 0 {
+		return nil, nil
+	}
+	if _, err := ParseLabels(cfg.AgentLabels); err != nil {
+		return nil, err
+	}
+
+	agentID := cfg.AgentID
+	if len(agentID) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("the agent ID is not set and the hostname is unknown: %w", err)
+		}
+		agentID = hostname
+	}
+
+	addresses := make([]string, 0)
+	for _, address := range strings.Split(cfg.Address, ",") {
+		if address = strings.TrimSpace(address); len(address) > 0 {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return &remoteConfig{
+		client:    &http.Client{Timeout: 5 * time.Second},
+		addresses: addresses,
+		agentID:   agentID,
+		labels:    cfg.AgentLabels,
+		interval:  cfg.RemoteConfigInterval,
+		cachePath: cfg.RemoteConfigCache,
+		changed:   make(chan struct{}, 1),
+	}, nil
+}
+
+// fetch asks the servers for the config one by one. It returns nil config if the server has no config for the agent.
+func (rc *remoteConfig) fetch(ctx context.Context) (*models.AgentConfig, error) {
+	var lastErr error
+	for _, address := range rc.addresses {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+"/agent/config", nil)
+		if err != nil {
+			return nil, err
+		}
+		rc.setIdentity(request.Header)
+
+		response, err := rc.client.Do(request)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var config models.AgentConfig
+		switch response.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(response.Body).Decode(&config)
+		case http.StatusNotFound:
+			response.Body.Close()
+			return nil, nil
+		default:
+			err = fmt.Errorf("unexpected status code %d", response.StatusCode)
+		}
+		response.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return &config, nil
+	}
+	return nil, lastErr
+}
+
+func (rc *remoteConfig) setIdentity(header http.Header) {
+	header.Set(models.AgentIDHeader, rc.agentID)
+	if len(rc.labels) > 0 {
+		header.Set(models.AgentLabelsHeader, rc.labels)
+	}
+}
+
+func (rc *remoteConfig) saveCache(config *models.AgentConfig) error {
+	if len(rc.cachePath) == 0 {
+		return nil
+	}
+	if config == nil {
+		err := os.Remove(rc.cachePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(rc.cachePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(rc.cachePath, data, 0644)
+}
+
+func (rc *remoteConfig) loadCache() (*models.AgentConfig, error) {
+	if len(rc.cachePath) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(rc.cachePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config models.AgentConfig
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// LoadConfig applies the config assigned to the agent by the server.
+// If the server cannot be reached, the cached config is applied.
+func (ms *MetricsService) LoadConfig(ctx context.Context) {
+	rc := ms.remote
+	if rc == nil {
+		return
+	}
+
+	config, err := rc.fetch(ctx)
+	if err == nil {
+		ms.updateConfig(config)
+		return
+	}
+
+	log.Warn().Err(err).Msg("error fetching the agent config, the cached config is used")
+	config, err = rc.loadCache()
+	if err != nil {
+		log.Error().Err(err).Msg("error reading the cached agent config")
+		return
+	}
+	ms.applyConfig(config)
+}
+
+// WatchConfig fetches the agent config every remote config interval and when a response of the server
+// announces another config version, until the context is done.
+func (ms *MetricsService) WatchConfig(ctx context.Context) {
+	rc := ms.remote
+	if rc == nil {
+		return
+	}
+
+	schedule := newSchedule(ms.clock, rc.interval, 0, false)
+	tick := schedule.next()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			tick = schedule.next()
+		case <-rc.changed:
+		}
+
+		config, err := rc.fetch(ctx)
+		if err != nil {
+			log.Warn().Err(err).Msg("error fetching the agent config")
+			continue
+		}
+		ms.updateConfig(config)
+	}
+}
+
+// updateConfig applies the fetched config and caches it.
+func (ms *MetricsService) updateConfig(config *models.AgentConfig) {
+	if err := ms.remote.saveCache(config); err != nil {
+		log.Error().Err(err).Msg("error caching the agent config")
+	}
+	ms.applyConfig(config)
+}
+
+// applyConfig changes the intervals and the enabled collectors of the running agent.
+// A nil config brings back the local settings.
+func (ms *MetricsService) applyConfig(config *models.AgentConfig) {
+	version := ""
+	pollInterval, reportInterval := ms.localPollInterval, ms.localReportInterval
+	var collectors map[string]bool
+	var names []string
+	if config != nil {
+		version = config.Version()
+		if d, err := time.ParseDuration(config.PollInterval); err == nil && d > 0 {
+			pollInterval = d
+		}
+		if d, err := time.ParseDuration(config.ReportInterval); err == nil && d > 0 {
+			reportInterval = d
+		}
+		names = config.Collectors
+		if len(config.Collectors) > 0 {
+			collectors = make(map[string]bool, len(config.Collectors))
+			for _, name := range config.Collectors {
+				collectors[name] = true
+			}
+		}
+	}
+
+	ms.remote.Lock()
+	unchanged := ms.remote.version == version
+	ms.remote.version = version
+	ms.remote.Unlock()
+	if unchanged {
+		return
+	}
+
+	ms.pollInterval.Store(int64(pollInterval))
+	ms.reportInterval.Store(int64(reportInterval))
+	ms.Lock()
+	ms.collectors = collectors
+	ms.Unlock()
+	log.Info().Msgf("agent config %q applied: poll interval %s, report interval %s, collectors %v",
+		version, pollInterval, reportInterval, names)
+}
+
+// RemoteConfigTransport adds the agent identity to the requests and watches the config version
+// announced by the server. Without remote config it returns the transport as is.
+func (ms *MetricsService) RemoteConfigTransport(next http.RoundTripper) http.RoundTripper {
+	if ms.remote == nil {
+		return next
+	}
+	return &configTransport{next: next, ms: ms}
+}
+
+type configTransport struct {
+	next http.RoundTripper
+	ms   *MetricsService
+}
+
+func (t *configTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	t.ms.remote.setIdentity(request.Header)
+
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	response, err := next.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if version := response.Header.Get(models.AgentConfigVersionHeader); len(version) > 0 {
+		t.ms.remote.Lock()
+		changed := t.ms.remote.version != version
+		t.ms.remote.Unlock()
+		if changed {
+			select {
+			case t.ms.remote.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return response, nil
+}
+
+// collectorEnabled reports whether the server config allows the collector, all collectors run by default.
+func (ms *MetricsService) collectorEnabled(name string) bool {
+	ms.Lock()
+	defer ms.Unlock()
+	return ms.collectors == nil || ms.collectors[name]
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfigServer serves the config stored in the pointer and counts the config requests.
+func testConfigServer(t *testing.T, config *atomic.Pointer[models.AgentConfig], fetches *atomic.Int64) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "web-01", r.Header.Get(models.AgentIDHeader))
+		assert.Equal(t, "role=web", r.Header.Get(models.AgentLabelsHeader))
+
+		c := config.Load()
+		switch r.URL.Path {
+		case "/agent/config":
+			fetches.Add(1)
+			if c == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			assert.NoError(t, json.NewEncoder(w).Encode(c))
+		case "/updates/":
+			if c != nil {
+				w.Header().Set(models.AgentConfigVersionHeader, c.Version())
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func testRemoteConfigService(t *testing.T, address string, cache string) *MetricsService {
+	ms, err := NewMetricsService(&configs.AgentCfg{
+		Address:              address,
+		PollInterval:         2 * time.Second,
+		ReportInterval:       10 * time.Second,
+		RateLimit:            1,
+		AgentID:              "web-01",
+		AgentLabels:          "role=web",
+		RemoteConfigInterval: time.Hour,
+		RemoteConfigCache:    cache,
+	})
+	require.NoError(t, err)
+	return ms
+}
+
+func TestMetricsService_LoadConfig(t *testing.T) {
+	config := &atomic.Pointer[models.AgentConfig]{}
+	config.Store(&models.AgentConfig{PollInterval: "500ms", ReportInterval: "3s", Collectors: []string{"runtime"}})
+	fetches := &atomic.Int64{}
+	ts := testConfigServer(t, config, fetches)
+	cache := filepath.Join(t.TempDir(), "config.json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ms := testRemoteConfigService(t, strings.TrimPrefix(ts.URL, "http://"), cache)
+	ms.LoadConfig(ctx)
+	assert.Equal(t, 500*time.Millisecond, ms.getPollInterval())
+	assert.Equal(t, 3*time.Second, ms.getReportInterval())
+	assert.True(t, ms.collectorEnabled("runtime"))
+	assert.False(t, ms.collectorEnabled("advanced"))
+	assert.FileExists(t, cache)
+
+	// the server is gone, the agent starts with the cached config
+	ts.Close()
+	ms = testRemoteConfigService(t, strings.TrimPrefix(ts.URL, "http://"), cache)
+	ms.LoadConfig(ctx)
+	assert.Equal(t, 500*time.Millisecond, ms.getPollInterval())
+	assert.False(t, ms.collectorEnabled("advanced"))
+}
+
+func TestMetricsService_LoadConfigNotFound(t *testing.T) {
+	config := &atomic.Pointer[models.AgentConfig]{}
+	ts := testConfigServer(t, config, &atomic.Int64{})
+	cache := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(cache, []byte(`{"poll_interval":"1s"}`), 0644))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ms := testRemoteConfigService(t, strings.TrimPrefix(ts.URL, "http://"), cache)
+	ms.LoadConfig(ctx)
+	assert.Equal(t, 2*time.Second, ms.getPollInterval(), "the local config was expected")
+	assert.True(t, ms.collectorEnabled("advanced"))
+	assert.NoFileExists(t, cache, "the stale cache was expected to be removed")
+}
+
+func TestMetricsService_WatchConfig(t *testing.T) {
+	config := &atomic.Pointer[models.AgentConfig]{}
+	config.Store(&models.AgentConfig{PollInterval: "1s"})
+	fetches := &atomic.Int64{}
+	ts := testConfigServer(t, config, fetches)
+	address := strings.TrimPrefix(ts.URL, "http://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ms := testRemoteConfigService(t, address, "")
+	ms.LoadConfig(ctx)
+	go ms.WatchConfig(ctx)
+	assert.Equal(t, time.Second, ms.getPollInterval())
+
+	client := &http.Client{Transport: ms.RemoteConfigTransport(http.DefaultTransport)}
+	sink := newHTTPSink(client, address)
+
+	// the same version does not cause a fetch
+	require.NoError(t, sink.Write(ctx, testMetrics(1)))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int64(1), fetches.Load())
+
+	config.Store(&models.AgentConfig{PollInterval: "300ms", Collectors: []string{"advanced"}})
+	require.NoError(t, sink.Write(ctx, testMetrics(1)))
+	assert.Eventually(t, func() bool {
+		return ms.getPollInterval() == 300*time.Millisecond
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.False(t, ms.collectorEnabled("runtime"))
+	assert.Equal(t, int64(2), fetches.Load())
+}
+
+func TestMetricsService_DisabledCollector(t *testing.T) {
+	ms, err := NewMetricsService(&configs.AgentCfg{PollInterval: 50 * time.Millisecond, RateLimit: 1})
+	require.NoError(t, err)
+	ms.collectors = map[string]bool{"runtime": true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	go ms.CollectRuntime(ctx)
+	ms.runCollector(ctx, "logtail", ms.getPollInterval, func(ctx context.Context) ([]models.Metric, error) {
+		return testMetrics(1), nil
+	})
+
+	ms.Lock()
+	defer ms.Unlock()
+	assert.NotEmpty(t, ms.runtimeMetrics)
+	assert.Empty(t, ms.collected["logtail"])
+}
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Clock is the source of time for the report, poll and config schedules, tests replace it with a fake one.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// schedule fires every interval. If align is set, the ticks fall on multiples of the interval
+// of the wall clock, e.g. every full 10 seconds. Every tick is delayed by a random jitter below
+// the given maximum, the delay does not accumulate because it is added to the planned time.
+type schedule struct {
+	clock    Clock
+	interval time.Duration
+	jitter   time.Duration
+	align    bool
+	planned  time.Time
+	random   *rand.Rand
+}
+
+func newSchedule(clock Clock, interval time.Duration, jitter time.Duration, align bool) *schedule {
+	return &schedule{
+		clock:    clock,
+		interval: interval,
+		jitter:   jitter,
+		align:    align,
+		random:   rand.New(rand.NewSource(clock.Now().UnixNano())),
+	}
+}
+
+// next returns a channel that receives the time of the next tick.
+func (s *schedule) next() <-chan time.Time {
+	now := s.clock.Now()
+	switch {
+	case s.align:
+		s.planned = now.Truncate(s.interval).Add(s.interval)
+	case s.planned.IsZero():
+		s.planned = now.Add(s.interval)
+	default:
+		s.planned = s.planned.Add(s.interval)
+		if s.planned.Before(now) {
+			// the previous report took longer than the interval, skip the missed ticks
+			s.planned = now.Add(s.interval - now.Sub(s.planned)%s.interval)
+		}
+	}
+
+	fire := s.planned
+	if s.jitter > 0 {
+		fire = fire.Add(time.Duration(s.random.Int63n(int64(s.jitter))))
+	}
+	return s.clock.After(fire.Sub(now))
+}
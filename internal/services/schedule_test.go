@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// fakeClock only moves when Advance is called.
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+	added   chan struct{}
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, added: make(chan struct{}, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	c.added <- struct{}{}
+	return ch
+}
+
+// Advance moves the clock and fires the waiters that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiting
+}
+
+// waitForWaiter blocks until somebody calls After.
+func (c *fakeClock) waitForWaiter(t *testing.T) {
+	select {
+	case <-c.added:
+	case <-time.After(time.Second):
+		t.Fatal("the clock was expected to be waited on")
+	}
+}
+
+// fireTime plans the next tick of the schedule and returns the time it fires at.
+func fireTime(t *testing.T, clock *fakeClock, s *schedule) time.Time {
+	s.next()
+	clock.waitForWaiter(t)
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.waiters[len(clock.waiters)-1].at
+}
+
+func TestSchedule(t *testing.T) {
+	start := time.Date(2023, 11, 20, 12, 0, 3, 0, time.UTC)
+
+	clock := newFakeClock(start)
+	s := newSchedule(clock, 10*time.Second, 0, false)
+	assert.Equal(t, start.Add(10*time.Second), fireTime(t, clock, s))
+	clock.Advance(12 * time.Second)
+	assert.Equal(t, start.Add(20*time.Second), fireTime(t, clock, s), "late reports were not expected to shift the phase")
+	clock.Advance(25 * time.Second)
+	assert.Equal(t, start.Add(40*time.Second), fireTime(t, clock, s), "missed ticks were expected to be skipped")
+
+	clock = newFakeClock(start)
+	s = newSchedule(clock, 10*time.Second, 0, true)
+	assert.Equal(t, start.Truncate(time.Minute).Add(10*time.Second), fireTime(t, clock, s))
+
+	clock = newFakeClock(start)
+	s = newSchedule(clock, 10*time.Second, 2*time.Second, true)
+	for i := 0; i < 20; i++ {
+		at := fireTime(t, clock, s)
+		assert.False(t, at.Before(start.Truncate(10*time.Second).Add(10*time.Second)))
+		assert.True(t, at.Before(start.Truncate(10*time.Second).Add(12*time.Second)))
+	}
+}
+
+func TestMetricService_MergeAndPushToQueueSchedule(t *testing.T) {
+	ms, err := NewMetricsService(&configs.AgentCfg{ReportInterval: 10 * time.Second, RateLimit: 5, ReportAlign: true})
+	require.NoError(t, err)
+	clock := newFakeClock(time.Date(2023, 11, 20, 12, 0, 7, 0, time.UTC))
+	ms.clock = clock
+
+	value := 1.0
+	ms.runtimeMetrics = []models.Metric{{ID: "Alloc", MType: Gauge, Value: &value}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ms.MergeAndPushToQueue(ctx, "")
+		close(done)
+	}()
+
+	clock.waitForWaiter(t)
+	clock.Advance(2 * time.Second)
+	select {
+	case <-ms.ch:
+		t.Fatal("no report was expected before the aligned tick")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	batch := <-ms.ch
+	assert.NotNil(t, findMetric(batch, "Alloc"))
+
+	clock.waitForWaiter(t)
+	cancel()
+	<-done
+}
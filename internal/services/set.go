@@ -0,0 +1,121 @@
+package services
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strings"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+// SetPrecision is the number of hash bits choosing the HyperLogLog register, the standard error
+// of the estimate is 1.04 / sqrt(2^SetPrecision), about 1.6%.
+const SetPrecision = 12
+
+// SetRegisters is the number of registers of a set.
+const SetRegisters = 1 << SetPrecision
+
+var ErrInvalidSet = errors.New("invalid set")
+
+// NewSet returns the registers counting the items.
+func NewSet(items ...string) *models.Set {
+	s := &models.Set{Registers: make([]byte, SetRegisters)}
+	for _, item := range items {
+		addToSet(s.Registers, item)
+	}
+	return s
+}
+
+func addToSet(registers []byte, item string) {
+	h := hashItem(item)
+	index := h >> (64 - SetPrecision)
+	rank := byte(bits.LeadingZeros64(h<<SetPrecision|1<<(SetPrecision-1)) + 1)
+	if rank > registers[index] {
+		registers[index] = rank
+	}
+}
+
+// hashItem is FNV-1a followed by the splitmix64 finalizer, agents and the server must hash items the same way.
+func hashItem(item string) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(item))
+	h := f.Sum64()
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// prepareSet checks the incoming set and folds its raw items into the registers, so that only
+// the registers are stored.
+func prepareSet(s *models.Set) (*models.Set, error) {
+	if s == nil || len(s.Items) == 0 && len(s.Registers) == 0 {
+		return nil, fmt.Errorf("%w: no items or registers", ErrInvalidSet)
+	}
+	if len(s.Registers) != 0 && len(s.Registers) != SetRegisters {
+		return nil, fmt.Errorf("%w: %d registers are expected, got %d", ErrInvalidSet, SetRegisters, len(s.Registers))
+	}
+
+	prepared := &models.Set{Registers: make([]byte, SetRegisters)}
+	for i, r := range s.Registers {
+		if int(r) > 64-SetPrecision+1 {
+			return nil, fmt.Errorf("%w: register %d is out of range", ErrInvalidSet, i)
+		}
+		prepared.Registers[i] = r
+	}
+	for _, item := range s.Items {
+		addToSet(prepared.Registers, item)
+	}
+	return prepared, nil
+}
+
+// mergeSets keeps the maximum of every register. The result is a new set, the arguments are not changed.
+func mergeSets(stored, incoming *models.Set) *models.Set {
+	merged := &models.Set{Registers: make([]byte, SetRegisters)}
+	copy(merged.Registers, stored.Registers)
+	for i, r := range incoming.Registers {
+		if r > merged.Registers[i] {
+			merged.Registers[i] = r
+		}
+	}
+	return merged
+}
+
+// SetCardinality estimates the number of distinct items counted by the registers.
+// Small cardinalities are estimated by linear counting of the empty registers.
+func SetCardinality(s *models.Set) uint64 {
+	if s == nil || len(s.Registers) == 0 {
+		return 0
+	}
+
+	m := float64(len(s.Registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// setHashSource is the part of the signed string describing the set: the raw items and the digest of the registers.
+func setHashSource(s *models.Set) string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%x", strings.Join(s.Items, ","), sha256.Sum256(s.Registers))
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testItems(prefix string, n int) []string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = fmt.Sprintf("%s-%d", prefix, i)
+	}
+	return items
+}
+
+func TestSetCardinality(t *testing.T) {
+	assert.Equal(t, uint64(0), SetCardinality(NewSet()))
+	assert.Equal(t, uint64(3), SetCardinality(NewSet("a", "b", "c", "a", "b")))
+
+	for _, n := range []int{100, 1000, 100000} {
+		s := NewSet(testItems("user", n)...)
+		assert.InEpsilon(t, n, SetCardinality(s), 0.05, "cardinality of %d items", n)
+	}
+}
+
+func TestMergeSets(t *testing.T) {
+	a := NewSet(testItems("a", 5000)...)
+	b := NewSet(testItems("b", 5000)...)
+	b2 := NewSet(testItems("a", 2500)...)
+
+	merged := mergeSets(a, b)
+	assert.InEpsilon(t, 10000, SetCardinality(merged), 0.05)
+	assert.Equal(t, SetCardinality(a), SetCardinality(mergeSets(a, b2)), "the items seen before were not expected to count")
+	assert.Equal(t, NewSet(append(testItems("a", 5000), testItems("b", 5000)...)...), merged)
+}
+
+func TestPrepareSet(t *testing.T) {
+	s, err := prepareSet(&models.Set{Items: []string{"a", "b"}, Registers: NewSet("c").Registers})
+	require.NoError(t, err)
+	assert.Empty(t, s.Items)
+	assert.Equal(t, NewSet("a", "b", "c"), s)
+
+	for _, set := range []*models.Set{nil, {}, {Registers: []byte{1, 2, 3}}, {Registers: make([]byte, SetRegisters)}} {
+		if set != nil && len(set.Registers) == SetRegisters {
+			set.Registers[0] = 100
+		}
+		_, err = prepareSet(set)
+		assert.ErrorIs(t, err, ErrInvalidSet)
+	}
+}
+
+func TestFileRepository_Set(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	repo := NewFileRepository("", time.Second, "test")
+
+	// one agent sends raw items, another one its registers
+	m := models.Metric{ID: "users", MType: Set, Set: &models.Set{Items: []string{"alice", "bob"}}}
+	m.Hash = utils.Hash(hashSource(m), "test")
+	_, err := repo.Set(ctx, m)
+	require.NoError(t, err)
+
+	m = models.Metric{ID: "users", MType: Set, Set: NewSet("bob", "carol")}
+	m.Hash = utils.Hash(hashSource(m), "test")
+	_, err = repo.Set(ctx, m)
+	require.NoError(t, err)
+
+	stored, err := repo.Get(ctx, "users", Set)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), SetCardinality(stored.Set))
+	assert.Equal(t, utils.Hash(hashSource(*stored), "test"), stored.Hash)
+
+	m.Set = &models.Set{Items: []string{"dave"}}
+	_, err = repo.Set(ctx, m)
+	assert.ErrorIs(t, err, ErrInvalidHash, "the hash was expected to cover the raw items")
+}
+
+func TestDBRepository_Set(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	repo := &dbRepository{db: db}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mock.ExpectQuery("select histogram, summary, registers from metrics (.+)").WithArgs("users", Set).
+		WillReturnRows(sqlmock.NewRows([]string{"histogram", "summary", "registers"}).
+			AddRow(nil, nil, NewSet("alice", "bob").Registers))
+	mock.ExpectExec("insert into metrics(.+)").
+		WithArgs("users", Set, nil, nil, "", nil, nil, NewSet("alice", "bob", "carol").Registers, nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	m, err := repo.Set(ctx, models.Metric{ID: "users", MType: Set, Set: &models.Set{Items: []string{"bob", "carol"}}})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), SetCardinality(m.Set))
+
+	mock.ExpectQuery("^select (.+) from metrics where (.+)").WithArgs("users", Set).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "mtype", "delta", "value", "hash", "histogram", "summary", "registers", "info", "updated_at"}).
+			AddRow("users", Set, nil, nil, "", nil, nil, NewSet("alice").Registers, nil, nil))
+	m, err = repo.Get(ctx, "users", Set)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), SetCardinality(m.Set))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Exit codes of the agent.
+const (
+	ExitOK = 0
+	// ExitLost means some metrics were neither sent nor saved.
+	ExitLost = 1
+	// ExitSpooled means some metrics were saved to the spool file and will be sent on the next start.
+	ExitSpooled = 2
+)
+
+// ErrSpooled is returned by Close of a sink that saved its undelivered batches to spool files.
+var ErrSpooled = errors.New("undelivered batches were saved to the spool")
+
+// spool keeps the batches that could not be delivered before shutdown, one JSON array per line.
+type spool struct {
+	sync.Mutex
+	path string
+}
+
+// save appends the batch to the spool file.
+func (s *spool) save(batch []models.Metric) error {
+	if len(s.path) == 0 {
+		return errors.New("the spool file is not set")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(file).Encode(batch); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// load reads the saved batches and removes the spool file.
+func (s *spool) load() ([][]models.Metric, error) {
+	if len(s.path) == 0 {
+		return nil, nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	batches := make([][]models.Metric, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var batch []models.Metric
+		if err = json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+			log.Error().Err(err).Msgf("broken line in the spool file %s is skipped", s.path)
+			continue
+		}
+		batches = append(batches, batch)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return batches, os.Remove(s.path)
+}
+
+// spoolBatch saves an undelivered batch, if it cannot be saved, it is counted as lost.
+func (ms *MetricsService) spoolBatch(batch []models.Metric) {
+	if err := ms.spool.save(batch); err != nil {
+		ms.lost.Add(1)
+		log.Error().Err(err).Msgf("batch of %d metrics is lost", len(batch))
+		return
+	}
+	ms.spooled.Add(1)
+	ms.telemetry.add("batches_spooled", 1)
+	log.Warn().Msgf("batch of %d metrics saved to %s", len(batch), ms.spool.path)
+}
+
+// RestoreSpool queues the batches saved during the previous shutdown.
+// It must be called after the senders are started and before MergeAndPushToQueue.
+func (ms *MetricsService) RestoreSpool() {
+	batches, err := ms.spool.load()
+	if err != nil {
+		log.Error().Err(err).Msgf("error reading the spool file %s", ms.spool.path)
+		return
+	}
+	if len(batches) == 0 {
+		return
+	}
+
+	log.Info().Msgf("%d batches restored from %s", len(batches), ms.spool.path)
+	ms.deliveries.add(len(batches))
+	for _, batch := range batches {
+		ms.ch <- batch
+		ms.telemetry.queueMetrics.Add(int64(len(batch)))
+	}
+}
+
+// CloseSink closes the sink and counts the batches it could not deliver in the exit code.
+// It must be called after all senders have returned and before ExitCode.
+func (ms *MetricsService) CloseSink(sink Sink) {
+	err := sink.Close()
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrSpooled):
+		ms.spooled.Add(1)
+		log.Warn().Err(err).Msg("the output saved its backlog")
+	default:
+		ms.lost.Add(1)
+		log.Error().Err(err).Msg("output closing error")
+	}
+}
+
+// ExitCode reports whether metrics were lost or spooled during shutdown.
+// It must be called after all senders have returned.
+func (ms *MetricsService) ExitCode() int {
+	switch {
+	case ms.lost.Load() > 0:
+		return ExitLost
+	case ms.spooled.Load() > 0:
+		return ExitSpooled
+	}
+	return ExitOK
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingSink fails every write with its error.
+type failingSink struct {
+	err error
+}
+
+func (s failingSink) Write(_ context.Context, _ []models.Metric) error {
+	return s.err
+}
+
+func (failingSink) Close() error {
+	return nil
+}
+
+func TestMetricService_FinalFlush(t *testing.T) {
+	ms, err := NewMetricsService(&configs.AgentCfg{ReportInterval: time.Hour, RateLimit: 5})
+	require.NoError(t, err)
+
+	value := 1.0
+	delta := int64(3)
+	ms.runtimeMetrics = []models.Metric{
+		{ID: "Alloc", MType: Gauge, Value: &value},
+		{ID: "PollCount", MType: Counter, Delta: &delta},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ms.MergeAndPushToQueue(ctx, "")
+
+	batches := make([][]models.Metric, 0)
+	for batch := range ms.ch {
+		batches = append(batches, batch)
+	}
+	require.Len(t, batches, 1, "the final flush was expected to push the collected metrics")
+	require.NotNil(t, findMetric(batches[0], "PollCount"))
+	assert.Equal(t, int64(3), *findMetric(batches[0], "PollCount").Delta)
+	assert.Nil(t, findMetric(ms.runtimeMetrics, "PollCount"), "the sent counter was expected to be forgotten")
+}
+
+func TestMetricService_SpoolOnShutdown(t *testing.T) {
+	defer func(delays []time.Duration) { retryDelays = delays }(retryDelays)
+	retryDelays = nil
+	unavailable := failingSink{err: fmt.Errorf("%w: server is down", ErrRetriable)}
+
+	spoolFile := filepath.Join(t.TempDir(), "spool.ndjson")
+	cfg := &configs.AgentCfg{RateLimit: 5, SpoolFile: spoolFile}
+	ms, err := NewMetricsService(cfg)
+	require.NoError(t, err)
+
+	ms.shuttingDown.Store(true)
+	ms.ch <- testMetrics(2)
+	ms.ch <- testMetrics(3)
+	close(ms.ch)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	ms.Send(context.Background(), wg, unavailable)
+	assert.Equal(t, ExitSpooled, ms.ExitCode())
+
+	restored, err := NewMetricsService(cfg)
+	require.NoError(t, err)
+	restored.RestoreSpool()
+	require.Len(t, restored.ch, 2)
+	assert.Equal(t, testMetrics(2), <-restored.ch)
+	assert.Equal(t, testMetrics(3), <-restored.ch)
+	assert.Equal(t, ExitOK, restored.ExitCode())
+
+	again, err := NewMetricsService(cfg)
+	require.NoError(t, err)
+	again.RestoreSpool()
+	assert.Empty(t, again.ch, "the spool was expected to be removed after restoring")
+
+	lost, err := NewMetricsService(&configs.AgentCfg{RateLimit: 1})
+	require.NoError(t, err)
+	lost.shuttingDown.Store(true)
+	lost.ch <- testMetrics(1)
+	close(lost.ch)
+	wg.Add(1)
+	lost.Send(context.Background(), wg, unavailable)
+	assert.Equal(t, ExitLost, lost.ExitCode())
+
+	rejected, err := NewMetricsService(cfg)
+	require.NoError(t, err)
+	rejected.shuttingDown.Store(true)
+	rejected.ch <- testMetrics(1)
+	close(rejected.ch)
+	wg.Add(1)
+	rejected.Send(context.Background(), wg, failingSink{err: errors.New("server responded with 400 Bad Request")})
+	assert.Equal(t, ExitLost, rejected.ExitCode(), "a rejected batch was expected to be lost")
+	assert.NoFileExists(t, spoolFile, "a rejected batch was not expected to be spooled")
+}
+
+func TestMetricService_OverflowOnShutdown(t *testing.T) {
+	spoolFile := filepath.Join(t.TempDir(), "spool.ndjson")
+	ms, err := NewMetricsService(&configs.AgentCfg{RateLimit: 1, QueueSize: 1, QueuePolicy: QueueDropNewest,
+		SpoolFile: spoolFile})
+	require.NoError(t, err)
+
+	ms.shuttingDown.Store(true)
+	ms.enqueue([][]models.Metric{testMetrics(1), testMetrics(2)}, "")
+	assert.Equal(t, ExitSpooled, ms.ExitCode(), "the batch dropped during the final flush was expected to be spooled")
+	batches, err := ms.spool.load()
+	require.NoError(t, err)
+	assert.Equal(t, [][]models.Metric{testMetrics(2)}, batches)
+}
+
+// closingSink returns its error from Close.
+type closingSink struct {
+	failingSink
+	err error
+}
+
+func (s closingSink) Close() error {
+	return s.err
+}
+
+func TestMetricService_CloseSink(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		code int
+	}{
+		{nil, ExitOK},
+		{fmt.Errorf("%w: 2 batches", ErrSpooled), ExitSpooled},
+		{errors.New("1 batches were neither sent nor saved"), ExitLost},
+	} {
+		ms, err := NewMetricsService(&configs.AgentCfg{RateLimit: 1})
+		require.NoError(t, err)
+		ms.CloseSink(closingSink{err: tt.err})
+		assert.Equal(t, tt.code, ms.ExitCode(), "close error %v", tt.err)
+	}
+}
@@ -0,0 +1,258 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Output sinks and formats.
+const (
+	OutputHTTP   = "http"
+	OutputStdout = "stdout"
+	OutputFile   = "file"
+
+	FormatNDJSON = "ndjson"
+	FormatPretty = "pretty"
+
+	// maxOutputBackups is the number of rotated output files kept next to the current one.
+	maxOutputBackups = 3
+)
+
+// Sink delivers batches of metrics. Write may be called from several goroutines.
+// A Write error wrapping ErrRetriable means the batch can be written again later.
+type Sink interface {
+	Write(ctx context.Context, metrics []models.Metric) error
+	Close() error
+}
+
+// rejectionCounter is implemented by the sinks that deliver the batches in the background, so that Write
+// cannot report the batches the server rejects. takeRejected returns their number since the previous call.
+type rejectionCounter interface {
+	takeRejected() int64
+}
+
+// NewSink creates the sink selected in the agent config.
+func NewSink(cfg *configs.AgentCfg, client *http.Client) (Sink, error) {
+	switch cfg.Output {
+	case OutputHTTP, "":
+		return newHTTPSinks(client, cfg)
+	case OutputStdout:
+		if cfg.OutputFormat != FormatNDJSON && cfg.OutputFormat != FormatPretty {
+			return nil, fmt.Errorf("unknown output format %q", cfg.OutputFormat)
+		}
+		return &writerSink{w: os.Stdout, pretty: cfg.OutputFormat == FormatPretty}, nil
+	case OutputFile:
+		return newFileSink(cfg.OutputFile, cfg.OutputFileMaxBytes)
+	}
+	return nil, fmt.Errorf("unknown output %q", cfg.Output)
+}
+
+// httpSink posts batches to the /updates/ handler of the server.
+type httpSink struct {
+	client  *http.Client
+	address string
+	realIP  net.IP
+}
+
+func newHTTPSink(client *http.Client, address string) *httpSink {
+	realIP, err := utils.OutboundIP(address)
+	if err != nil {
+		log.Warn().Err(err).Msg("error determining the outbound address, X-Real-IP will not be set")
+	}
+	return &httpSink{client: client, address: address, realIP: realIP}
+}
+
+// Write sends metrics as one JSON request. Network errors and 5xx responses are retriable.
+func (s *httpSink) Write(ctx context.Context, metrics []models.Metric) error {
+	jsonData, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx,
+		http.MethodPost,
+		"http://"+s.address+"/updates/",
+		bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if s.realIP != nil {
+		request.Header.Set("X-Real-IP", s.realIP.String())
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRetriable, err)
+	}
+
+	_, err = io.ReadAll(response.Body)
+	if err != nil {
+		log.Error().Err(err).Msg("error reading response")
+	}
+
+	err = response.Body.Close()
+	if err != nil {
+		log.Error().Err(err).Msg("error closing response body")
+	}
+
+	switch {
+	case response.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%w: server responded with %s", ErrRetriable, response.Status)
+	case response.StatusCode >= http.StatusBadRequest:
+		return fmt.Errorf("server responded with %s", response.Status)
+	}
+	return nil
+}
+
+// Ping checks that the server responds to /ping.
+func (s *httpSink) Ping(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+s.address+"/ping", nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	if err = response.Body.Close(); err != nil {
+		log.Error().Err(err).Msg("error closing response body")
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded with %s", response.Status)
+	}
+	return nil
+}
+
+// Close does nothing, the client is owned by the caller.
+func (s *httpSink) Close() error {
+	return nil
+}
+
+// writerSink writes batches to a writer as an indented JSON array or as one JSON metric per line.
+type writerSink struct {
+	sync.Mutex
+	w      io.Writer
+	pretty bool
+}
+
+func (s *writerSink) Write(_ context.Context, metrics []models.Metric) error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := s.w.Write(encodeBatch(metrics, s.pretty))
+	return err
+}
+
+// Close does nothing, stdout stays open.
+func (s *writerSink) Close() error {
+	return nil
+}
+
+func encodeBatch(metrics []models.Metric, pretty bool) []byte {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	if pretty {
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(metrics)
+		return buf.Bytes()
+	}
+	for i := range metrics {
+		_ = encoder.Encode(&metrics[i])
+	}
+	return buf.Bytes()
+}
+
+// fileSink appends NDJSON to a file. When the file grows over maxBytes, it is renamed to path.1,
+// the older backups are shifted and the oldest one is removed.
+type fileSink struct {
+	sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+}
+
+func newFileSink(path string, maxBytes int) (*fileSink, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("the output file is not set")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s := &fileSink{path: path, maxBytes: int64(maxBytes)}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileSink) Write(_ context.Context, metrics []models.Metric) error {
+	s.Lock()
+	defer s.Unlock()
+
+	data := encodeBatch(metrics, false)
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(data)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	for i := maxOutputBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.file.Close()
+}
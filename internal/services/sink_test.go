@@ -0,0 +1,107 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSink(t *testing.T) {
+	testCases := []struct {
+		name    string
+		cfg     configs.AgentCfg
+		wantErr bool
+	}{
+		{name: "http", cfg: configs.AgentCfg{Output: OutputHTTP, Address: "localhost:8080"}},
+		{name: "stdout", cfg: configs.AgentCfg{Output: OutputStdout, OutputFormat: FormatPretty}},
+		{name: "file", cfg: configs.AgentCfg{Output: OutputFile, OutputFile: filepath.Join(t.TempDir(), "out.ndjson")}},
+		{name: "unknown output", cfg: configs.AgentCfg{Output: "kafka"}, wantErr: true},
+		{name: "unknown format", cfg: configs.AgentCfg{Output: OutputStdout, OutputFormat: "xml"}, wantErr: true},
+		{name: "file without path", cfg: configs.AgentCfg{Output: OutputFile}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sink, err := NewSink(&tc.cfg, &http.Client{})
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.NoError(t, sink.Close())
+		})
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	metrics := testMetrics(3)
+
+	buf := &bytes.Buffer{}
+	sink := &writerSink{w: buf}
+	require.NoError(t, sink.Write(context.Background(), metrics))
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 3)
+	var m models.Metric
+	require.NoError(t, json.Unmarshal(lines[1], &m))
+	assert.Equal(t, metrics[1], m)
+
+	buf.Reset()
+	sink = &writerSink{w: buf, pretty: true}
+	require.NoError(t, sink.Write(context.Background(), metrics))
+	var batch []models.Metric
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &batch))
+	assert.Equal(t, metrics, batch)
+	assert.Contains(t, buf.String(), "\n  {")
+}
+
+func TestFileSink_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out", "metrics.ndjson")
+	sink, err := newFileSink(path, 200)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sink.Write(context.Background(), testMetrics(2)))
+	}
+	require.NoError(t, sink.Close())
+
+	lines := 0
+	for _, name := range []string{path, path + ".1", path + ".2", path + ".3"} {
+		info, err := os.Stat(name)
+		require.NoErrorf(t, err, "%s was expected to exist", name)
+		assert.LessOrEqual(t, info.Size(), int64(200))
+
+		file, err := os.Open(name)
+		require.NoError(t, err)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var m models.Metric
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &m))
+			lines++
+		}
+		require.NoError(t, file.Close())
+	}
+	_, err = os.Stat(path + ".4")
+	assert.True(t, os.IsNotExist(err), "only three backups were expected to be kept")
+	assert.Less(t, lines, 20)
+
+	sink, err = newFileSink(path, 0)
+	require.NoError(t, err)
+	defer sink.Close()
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), testMetrics(1)))
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Greater(t, after.Size(), before.Size(), "the file was expected to be appended")
+}
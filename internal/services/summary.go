@@ -0,0 +1,196 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+)
+
+// DefaultSummaryAccuracy is the relative accuracy of the summaries created from single observations.
+const DefaultSummaryAccuracy = 0.01
+
+var (
+	ErrInvalidSummary  = errors.New("invalid summary")
+	ErrSummaryAccuracy = errors.New("summary accuracy does not match the stored one")
+)
+
+// The summary is a DDSketch: a positive value v is counted in the bin ceil(log(v) / log(gamma)),
+// gamma = (1 + accuracy) / (1 - accuracy), so every bin covers values that differ by the accuracy at most.
+// Negative values are counted the same way by their absolute value, zeros are counted apart.
+// Sketches with the same accuracy are merged exactly by adding the bins.
+
+// NewSummary returns a summary with the given relative accuracy holding one observation.
+func NewSummary(accuracy float64, value float64) *models.Summary {
+	s := &models.Summary{Accuracy: accuracy, Min: value, Max: value}
+	addToSummary(s, value)
+	return s
+}
+
+func addToSummary(s *models.Summary, value float64) {
+	switch {
+	case value > 0:
+		if s.Positive == nil {
+			s.Positive = make(map[int32]uint64)
+		}
+		s.Positive[summaryKey(s.Accuracy, value)]++
+	case value < 0:
+		if s.Negative == nil {
+			s.Negative = make(map[int32]uint64)
+		}
+		s.Negative[summaryKey(s.Accuracy, -value)]++
+	default:
+		s.Zero++
+	}
+	if s.Count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.Count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Count++
+	s.Sum += value
+}
+
+func summaryGamma(accuracy float64) float64 {
+	return (1 + accuracy) / (1 - accuracy)
+}
+
+func summaryKey(accuracy float64, value float64) int32 {
+	return int32(math.Ceil(math.Log(value) / math.Log(summaryGamma(accuracy))))
+}
+
+// summaryValue returns the value representing the bin, its relative error is below the accuracy.
+func summaryValue(accuracy float64, key int32) float64 {
+	gamma := summaryGamma(accuracy)
+	return 2 * math.Pow(gamma, float64(key)) / (gamma + 1)
+}
+
+// validateSummary checks the accuracy and that the count agrees with the bins.
+func validateSummary(s *models.Summary) error {
+	if s == nil {
+		return fmt.Errorf("%w: no sketch", ErrInvalidSummary)
+	}
+	if !(s.Accuracy > 0 && s.Accuracy < 1) {
+		return fmt.Errorf("%w: accuracy must be between 0 and 1", ErrInvalidSummary)
+	}
+	count := s.Zero
+	for _, c := range s.Positive {
+		count += c
+	}
+	for _, c := range s.Negative {
+		count += c
+	}
+	if count != s.Count {
+		return fmt.Errorf("%w: count %d differs from the sum of the bins %d", ErrInvalidSummary, s.Count, count)
+	}
+	if s.Count > 0 && s.Min > s.Max {
+		return fmt.Errorf("%w: min is greater than max", ErrInvalidSummary)
+	}
+	return nil
+}
+
+// mergeSummaries adds up two summaries with the same accuracy. The result is a new summary,
+// the arguments are not changed.
+func mergeSummaries(stored, incoming *models.Summary) (*models.Summary, error) {
+	if stored.Accuracy != incoming.Accuracy {
+		return nil, ErrSummaryAccuracy
+	}
+
+	merged := &models.Summary{
+		Accuracy: stored.Accuracy,
+		Positive: mergeBins(stored.Positive, incoming.Positive),
+		Negative: mergeBins(stored.Negative, incoming.Negative),
+		Zero:     stored.Zero + incoming.Zero,
+		Count:    stored.Count + incoming.Count,
+		Sum:      stored.Sum + incoming.Sum,
+		Min:      math.Min(stored.Min, incoming.Min),
+		Max:      math.Max(stored.Max, incoming.Max),
+	}
+	switch {
+	case stored.Count == 0:
+		merged.Min, merged.Max = incoming.Min, incoming.Max
+	case incoming.Count == 0:
+		merged.Min, merged.Max = stored.Min, stored.Max
+	}
+	return merged, nil
+}
+
+func mergeBins(a, b map[int32]uint64) map[int32]uint64 {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	merged := make(map[int32]uint64, len(a)+len(b))
+	for k, c := range a {
+		merged[k] += c
+	}
+	for k, c := range b {
+		merged[k] += c
+	}
+	return merged
+}
+
+// SummaryQuantile estimates the quantile with the relative accuracy of the summary.
+func SummaryQuantile(s *models.Summary, q float64) float64 {
+	if s == nil || s.Count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+
+	rank := uint64(q * float64(s.Count-1))
+	var cumulative uint64
+	clamp := func(v float64) float64 {
+		return math.Max(s.Min, math.Min(s.Max, v))
+	}
+
+	// the negative bins go from the largest absolute value, that is from the smallest value
+	for _, k := range sortedKeys(s.Negative, true) {
+		cumulative += s.Negative[k]
+		if cumulative > rank {
+			return clamp(-summaryValue(s.Accuracy, k))
+		}
+	}
+	cumulative += s.Zero
+	if cumulative > rank {
+		return 0
+	}
+	for _, k := range sortedKeys(s.Positive, false) {
+		cumulative += s.Positive[k]
+		if cumulative > rank {
+			return clamp(summaryValue(s.Accuracy, k))
+		}
+	}
+	return s.Max
+}
+
+func sortedKeys(bins map[int32]uint64, descending bool) []int32 {
+	keys := make([]int32, 0, len(bins))
+	for k := range bins {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if descending {
+			return keys[i] > keys[j]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// summaryHashSource is the part of the signed string describing the summary.
+func summaryHashSource(s *models.Summary) string {
+	if s == nil {
+		return ""
+	}
+	bins := func(bins map[int32]uint64) string {
+		parts := make([]string, 0, len(bins))
+		for _, k := range sortedKeys(bins, false) {
+			parts = append(parts, strconv.FormatInt(int64(k), 10)+"="+strconv.FormatUint(bins[k], 10))
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprintf("%f:%s:%s:%d:%d:%f", s.Accuracy, bins(s.Negative), bins(s.Positive), s.Zero, s.Count, s.Sum)
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dbulyk/metrics-alerting-service/internal/fileio"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSummary(values []float64) *models.Summary {
+	s := NewSummary(DefaultSummaryAccuracy, values[0])
+	for _, v := range values[1:] {
+		addToSummary(s, v)
+	}
+	return s
+}
+
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestSummaryQuantile(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = random.ExpFloat64() * 100
+	}
+	s := testSummary(values)
+	require.NoError(t, validateSummary(s))
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+		exact := exactQuantile(sorted, q)
+		assert.InEpsilon(t, exact, SummaryQuantile(s, q), DefaultSummaryAccuracy, "quantile %v", q)
+	}
+
+	s = testSummary([]float64{-5, -1, 0, 0, 2, 10})
+	assert.InEpsilon(t, -5, SummaryQuantile(s, 0), DefaultSummaryAccuracy)
+	assert.Equal(t, 0.0, SummaryQuantile(s, 0.5))
+	assert.InEpsilon(t, 10, SummaryQuantile(s, 1), DefaultSummaryAccuracy)
+	assert.True(t, math.IsNaN(SummaryQuantile(&models.Summary{Accuracy: 0.01}, 0.5)))
+}
+
+func TestMergeSummaries(t *testing.T) {
+	a := testSummary([]float64{1, 2, 3, 4})
+	b := testSummary([]float64{-1, 0, 100})
+	merged, err := mergeSummaries(a, b)
+	require.NoError(t, err)
+	assert.Equal(t, testSummary([]float64{1, 2, 3, 4, -1, 0, 100}), merged)
+	assert.Equal(t, testSummary([]float64{1, 2, 3, 4}), a, "the stored summary was not expected to change")
+
+	b.Accuracy = 0.05
+	_, err = mergeSummaries(a, b)
+	assert.ErrorIs(t, err, ErrSummaryAccuracy)
+}
+
+func TestValidateSummary(t *testing.T) {
+	assert.NoError(t, validateSummary(testSummary([]float64{1, 2})))
+	assert.ErrorIs(t, validateSummary(nil), ErrInvalidSummary)
+	assert.ErrorIs(t, validateSummary(&models.Summary{Accuracy: 1}), ErrInvalidSummary)
+
+	s := testSummary([]float64{1, 2})
+	s.Count = 3
+	assert.ErrorIs(t, validateSummary(s), ErrInvalidSummary)
+}
+
+func TestFileRepository_Summary(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	storeFile := filepath.Join(t.TempDir(), "metrics.json")
+	repo := NewFileRepository(storeFile, time.Second, "test")
+
+	// two agents send their sketches
+	for _, values := range [][]float64{{0.1, 0.2, 0.3}, {0.4, 0.5}} {
+		m := models.Metric{ID: "latency", MType: Summary, Summary: testSummary(values)}
+		m.Hash = utils.Hash(hashSource(m), "test")
+		_, err := repo.Set(ctx, m)
+		require.NoError(t, err)
+	}
+
+	producer, err := fileio.NewProducer(storeFile)
+	require.NoError(t, err)
+	require.NoError(t, producer.Save(ctx, repo, storeFile))
+
+	restored := NewFileRepository(storeFile, time.Second, "test")
+	consumer, err := fileio.NewConsumer(storeFile)
+	require.NoError(t, err)
+	require.NoError(t, consumer.Restore(ctx, restored))
+
+	m, err := restored.Get(ctx, "latency", Summary)
+	require.NoError(t, err)
+	assert.Equal(t, testSummary([]float64{0.1, 0.2, 0.3, 0.4, 0.5}), m.Summary)
+	assert.InEpsilon(t, 0.3, SummaryQuantile(m.Summary, 0.5), DefaultSummaryAccuracy)
+}
+
+func TestDBRepository_Summary(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	repo := &dbRepository{db: db}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mock.ExpectQuery("select histogram, summary, registers from metrics (.+)").WithArgs("latency", Summary).
+		WillReturnRows(sqlmock.NewRows([]string{"histogram", "summary", "registers"}).
+			AddRow(nil, `{"accuracy":0.01,"positive":{"0":1},"count":1,"sum":1,"min":1,"max":1}`, nil))
+	mock.ExpectExec("insert into metrics(.+)").
+		WithArgs("latency", Summary, nil, nil, "", nil,
+			`{"accuracy":0.01,"positive":{"0":2},"count":2,"sum":2,"min":1,"max":1}`, nil, nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	m, err := repo.Set(ctx, models.Metric{ID: "latency", MType: Summary, Summary: testSummary([]float64{1})})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), m.Summary.Count)
+
+	mock.ExpectQuery("select histogram, summary, registers from metrics (.+)").WithArgs("latency", Summary).
+		WillReturnRows(sqlmock.NewRows([]string{"histogram", "summary", "registers"}).
+			AddRow(nil, `{"accuracy":0.05,"positive":{"0":1},"count":1,"sum":1,"min":1,"max":1}`, nil))
+	_, err = repo.Set(ctx, models.Metric{ID: "latency", MType: Summary, Summary: testSummary([]float64{1})})
+	assert.ErrorIs(t, err, ErrSummaryAccuracy)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
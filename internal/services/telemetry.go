@@ -0,0 +1,141 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// TelemetryPrefix is reserved for the metrics the agent reports about itself.
+// Plugins and relabel rules may not make metrics with this prefix.
+const TelemetryPrefix = "agent_"
+
+// isReserved reports whether the metric name has the prefix of the agent telemetry.
+func isReserved(id string) bool {
+	return strings.HasPrefix(id, TelemetryPrefix)
+}
+
+// telemetry counts what the agent itself is doing. Counters are kept as totals since the start,
+// the report sends only the increase since the previous report, the status page shows the totals.
+type telemetry struct {
+	sync.Mutex
+	counters     map[string]*atomic.Int64
+	reported     map[string]int64
+	latencySum   time.Duration
+	latencyCount int64
+	gauges       map[string]float64
+	queueMetrics atomic.Int64
+}
+
+func newTelemetry() *telemetry {
+	return &telemetry{
+		counters: make(map[string]*atomic.Int64),
+		reported: make(map[string]int64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+// add increases the counter with the given name, the prefix is added automatically.
+func (t *telemetry) add(name string, delta int64) {
+	t.Lock()
+	c, ok := t.counters[name]
+	if !ok {
+		c = &atomic.Int64{}
+		t.counters[name] = c
+	}
+	t.Unlock()
+	c.Add(delta)
+}
+
+// set sets the gauge with the given name, the prefix is added automatically.
+func (t *telemetry) set(name string, value float64) {
+	t.Lock()
+	t.gauges[name] = value
+	t.Unlock()
+}
+
+// observeSend records the duration of one request to the server.
+func (t *telemetry) observeSend(latency time.Duration) {
+	t.Lock()
+	t.latencySum += latency
+	t.latencyCount++
+	t.Unlock()
+}
+
+// observeCollector records the duration of one collector run and counts its errors.
+func (t *telemetry) observeCollector(name string, duration time.Duration, err error) {
+	t.set("collector_duration_seconds_"+name, duration.Seconds())
+	t.add("collector_runs_"+name, 1)
+	if err != nil {
+		t.add("collector_errors_"+name, 1)
+	}
+}
+
+// collect returns the telemetry metrics. If report is true, the counters are returned as the increase
+// since the previous report and the send latency window is reset.
+func (t *telemetry) collect(queueDepth int, report bool) []models.Metric {
+	t.Lock()
+	defer t.Unlock()
+
+	metrics := make([]models.Metric, 0, len(t.counters)+len(t.gauges)+3)
+	gauge := func(name string, v float64) {
+		metrics = append(metrics, models.Metric{ID: TelemetryPrefix + name, MType: Gauge, Value: &v})
+	}
+
+	names := make([]string, 0, len(t.counters))
+	for name := range t.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		total := t.counters[name].Load()
+		delta := total
+		if report {
+			delta -= t.reported[name]
+			t.reported[name] = total
+		}
+		metrics = append(metrics, models.Metric{ID: TelemetryPrefix + name, MType: Counter, Delta: &delta})
+	}
+
+	gauge("queue_depth", float64(queueDepth))
+	gauge("queue_metrics", float64(t.queueMetrics.Load()))
+
+	latency := 0.0
+	if t.latencyCount > 0 {
+		latency = t.latencySum.Seconds() / float64(t.latencyCount)
+	}
+	gauge("send_latency_seconds", latency)
+	if report {
+		t.latencySum = 0
+		t.latencyCount = 0
+	}
+
+	names = names[:0]
+	for name := range t.gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		gauge(name, t.gauges[name])
+	}
+
+	return metrics
+}
+
+// StatusHandler returns a handler that shows the agent telemetry as JSON.
+func (ms *MetricsService) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ms.telemetry.collect(len(ms.ch), false)); err != nil {
+			log.Error().Err(err).Msg("JSON encoding error")
+		}
+	})
+}
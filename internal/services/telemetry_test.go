@@ -0,0 +1,77 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/configs"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func findMetric(metrics []models.Metric, id string) *models.Metric {
+	for i := range metrics {
+		if metrics[i].ID == id {
+			return &metrics[i]
+		}
+	}
+	return nil
+}
+
+func TestTelemetry_Collect(t *testing.T) {
+	tm := newTelemetry()
+	tm.add("batches_sent", 2)
+	tm.observeSend(100 * time.Millisecond)
+	tm.observeSend(300 * time.Millisecond)
+	tm.observeCollector("runtime", 50*time.Millisecond, errors.New("collector error"))
+
+	metrics := tm.collect(3, true)
+	assert.Equal(t, int64(2), *findMetric(metrics, "agent_batches_sent").Delta)
+	assert.Equal(t, int64(1), *findMetric(metrics, "agent_collector_errors_runtime").Delta)
+	assert.Equal(t, 3.0, *findMetric(metrics, "agent_queue_depth").Value)
+	assert.InDelta(t, 0.2, *findMetric(metrics, "agent_send_latency_seconds").Value, 1e-9)
+	assert.InDelta(t, 0.05, *findMetric(metrics, "agent_collector_duration_seconds_runtime").Value, 1e-9)
+
+	tm.add("batches_sent", 1)
+	metrics = tm.collect(0, true)
+	assert.Equal(t, int64(1), *findMetric(metrics, "agent_batches_sent").Delta, "only the increase was expected")
+	assert.Equal(t, 0.0, *findMetric(metrics, "agent_send_latency_seconds").Value)
+
+	metrics = tm.collect(0, false)
+	assert.Equal(t, int64(3), *findMetric(metrics, "agent_batches_sent").Delta, "the status was expected to show totals")
+}
+
+func TestMetricService_StatusHandler(t *testing.T) {
+	ms, err := NewMetricsService(&configs.AgentCfg{RateLimit: 5})
+	require.NoError(t, err)
+	ms.telemetry.add("batches_failed", 1)
+
+	rec := httptest.NewRecorder()
+	ms.StatusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var metrics []models.Metric
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&metrics))
+	require.NotNil(t, findMetric(metrics, "agent_batches_failed"))
+	assert.Equal(t, int64(1), *findMetric(metrics, "agent_batches_failed").Delta)
+}
+
+func TestMetricService_ReportTelemetryNotRelabeled(t *testing.T) {
+	ms, err := NewMetricsService(&configs.AgentCfg{RateLimit: 5,
+		RelabelRules: writeRules(t, `[{"action": "drop", "regex": ".*"}]`)})
+	require.NoError(t, err)
+	ms.telemetry.add("batches_sent", 1)
+
+	ms.report("")
+	batch := <-ms.ch
+	require.NotNil(t, findMetric(batch, "agent_batches_sent"), "the relabel rules were not expected to drop the telemetry")
+	for _, m := range batch {
+		assert.True(t, isReserved(m.ID), "metric %s was expected to be dropped", m.ID)
+	}
+}
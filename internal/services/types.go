@@ -0,0 +1,161 @@
+package services
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/dbulyk/metrics-alerting-service/internal/hub"
+	"github.com/dbulyk/metrics-alerting-service/internal/models"
+	"github.com/dbulyk/metrics-alerting-service/internal/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// prepareMetric checks the type, the hash and the content of an incoming metric. The hash is checked
+// before the metric is changed: the sketches are copied without the estimates, which are only made on read,
+// the raw items of a set are turned into registers. The update time is set unless the metric already has it,
+// which only metrics restored from the store file do, the handlers drop the time sent by clients.
+func prepareMetric(metric *models.Metric, key string) error {
+	switch metric.MType {
+	case Counter, Gauge, Histogram, Summary, Set, Info:
+	default:
+		return ErrInvalidMetricType
+	}
+
+	if len(key) > 0 {
+		mHash := utils.Hash(hashSource(*metric), key)
+		if !hmac.Equal([]byte(mHash), []byte(metric.Hash)) {
+			log.Error().Msgf("the incoming hash does not match the calculated hash. Metric %s will not be added",
+				metric.ID)
+			return ErrInvalidHash
+		}
+	}
+
+	switch metric.MType {
+	case Histogram:
+		if err := validateHistogram(metric.Histogram); err != nil {
+			return err
+		}
+		h := *metric.Histogram
+		h.Quantiles = nil
+		metric.Histogram = &h
+	case Summary:
+		if err := validateSummary(metric.Summary); err != nil {
+			return err
+		}
+		s := *metric.Summary
+		s.Quantiles = nil
+		metric.Summary = &s
+	case Set:
+		s, err := prepareSet(metric.Set)
+		if err != nil {
+			return err
+		}
+		metric.Set = s
+	case Info:
+		if err := validateInfo(metric.Info); err != nil {
+			return err
+		}
+		metric.Info = copyInfo(metric.Info)
+	}
+
+	if metric.UpdatedAt == nil {
+		// databases keep microseconds, so both repositories page through the same update times
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		metric.UpdatedAt = &now
+	}
+	return nil
+}
+
+// mergeMetric applies the incoming metric to the stored one of the same type: counter deltas,
+// histogram buckets and summary bins are added, set registers keep the maximum, gauges and info are replaced.
+// A rejected metric leaves the stored one unchanged, including its update time.
+func mergeMetric(stored *models.Metric, incoming models.Metric) error {
+	switch stored.MType {
+	case Counter:
+		d := *stored.Delta + *incoming.Delta
+		stored.Delta = &d
+	case Histogram:
+		merged, err := mergeHistograms(stored.Histogram, incoming.Histogram)
+		if err != nil {
+			return err
+		}
+		stored.Histogram = merged
+	case Summary:
+		merged, err := mergeSummaries(stored.Summary, incoming.Summary)
+		if err != nil {
+			return err
+		}
+		stored.Summary = merged
+	case Set:
+		stored.Set = mergeSets(stored.Set, incoming.Set)
+	case Info:
+		stored.Info = incoming.Info
+	default:
+		stored.Value = incoming.Value
+	}
+	stored.UpdatedAt = incoming.UpdatedAt
+	return nil
+}
+
+// WithEstimates returns a copy of the metric with the quantile estimates of a histogram or a summary
+// and the cardinality estimate of a set. The stored metric is not changed.
+func WithEstimates(m *models.Metric) *models.Metric {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	switch {
+	case c.MType == Histogram && c.Histogram != nil:
+		h := *c.Histogram
+		h.Quantiles = quantiles(func(q float64) float64 { return HistogramQuantile(&h, q) })
+		c.Histogram = &h
+	case c.MType == Summary && c.Summary != nil:
+		s := *c.Summary
+		s.Quantiles = quantiles(func(q float64) float64 { return SummaryQuantile(&s, q) })
+		c.Summary = &s
+	case c.MType == Set && c.Set != nil:
+		s := *c.Set
+		cardinality := SetCardinality(&s)
+		s.Cardinality = &cardinality
+		c.Set = &s
+	}
+	return &c
+}
+
+func quantiles(quantile func(q float64) float64) map[string]float64 {
+	estimates := make(map[string]float64, len(ReadQuantiles))
+	for _, q := range ReadQuantiles {
+		if v := quantile(q); !math.IsNaN(v) {
+			estimates[QuantileName(q)] = v
+		}
+	}
+	return estimates
+}
+
+// Quantile estimates the quantile of a histogram or a summary metric.
+func Quantile(m *models.Metric, q float64) float64 {
+	switch m.MType {
+	case Histogram:
+		return HistogramQuantile(m.Histogram, q)
+	case Summary:
+		return SummaryQuantile(m.Summary, q)
+	}
+	return math.NaN()
+}
+
+// publishMetric sends the stored metric with its estimates to the live consumers of the hub.
+// The metric is encoded right away, so the caller may change it afterwards.
+func publishMetric(h *hub.Hub, m *models.Metric) {
+	if h == nil || !h.Active() {
+		return
+	}
+	data, err := json.Marshal(WithEstimates(m))
+	if err != nil {
+		log.Error().Err(err).Msgf("metric %s encoding error", m.ID)
+		return
+	}
+	h.Publish(hub.Update{ID: m.ID, MType: m.MType, Data: data})
+}
@@ -3,6 +3,7 @@ package storages
 import (
 	"context"
 
+	"github.com/dbulyk/metrics-alerting-service/internal/hub"
 	"github.com/dbulyk/metrics-alerting-service/internal/models"
 )
 
@@ -11,6 +12,13 @@ type IRepository interface {
 	Set(ctx context.Context, metric models.Metric) (*models.Metric, error)
 	Get(ctx context.Context, mName string, mType string) (*models.Metric, error)
 	GetAll(ctx context.Context) ([]*models.Metric, error)
+	List(ctx context.Context, filter models.MetricFilter) ([]*models.Metric, error)
 	Updates(ctx context.Context, metric []models.Metric) ([]models.Metric, error)
+	Delete(ctx context.Context, mName string, mType string) error
+	DeleteMatching(ctx context.Context, filter models.MetricFilter) (int, error)
 	Ping() error
+	// Hub returns the hub publishing the metrics accepted by Set and Updates.
+	Hub() *hub.Hub
+	SetAgentConfig(ctx context.Context, rule models.AgentConfigRule) error
+	GetAgentConfig(ctx context.Context, agentID string, labels map[string]string) (*models.AgentConfig, error)
 }
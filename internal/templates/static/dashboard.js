@@ -0,0 +1,138 @@
+"use strict";
+
+// The dashboard filters and sorts the rows rendered by the server and replaces them on refresh,
+// the search, the type filter and the sort order survive the refresh.
+(function () {
+    const table = document.getElementById("metrics");
+    const search = document.getElementById("search");
+    const type = document.getElementById("type");
+    const refresh = document.getElementById("refresh");
+    const interval = document.getElementById("interval");
+    const status = document.getElementById("status");
+
+    let sortKey = "name";
+    let sortDesc = false;
+    let timer = null;
+
+    function rows() {
+        return Array.from(table.tBodies[0].rows).filter((row) => !row.classList.contains("empty"));
+    }
+
+    function filter() {
+        const text = search.value.trim().toLowerCase();
+        for (const row of rows()) {
+            const visible = (!text || row.dataset.name.toLowerCase().includes(text)) &&
+                (!type.value || row.dataset.type === type.value);
+            row.hidden = !visible;
+        }
+    }
+
+    // compare puts the rows without a value last in both orders.
+    function compare(a, b) {
+        let c = 0;
+        if (sortKey === "value" || sortKey === "updated") {
+            const x = a.dataset[sortKey], y = b.dataset[sortKey];
+            if (!x || !y) {
+                return !x && !y ? a.dataset.name.localeCompare(b.dataset.name) : !x ? 1 : -1;
+            }
+            c = Number(x) - Number(y);
+        } else {
+            c = a.dataset[sortKey].localeCompare(b.dataset[sortKey]);
+        }
+        if (c === 0) {
+            c = a.dataset.name.localeCompare(b.dataset.name) || a.dataset.type.localeCompare(b.dataset.type);
+        }
+        return sortDesc ? -c : c;
+    }
+
+    function sort() {
+        const body = table.tBodies[0];
+        for (const row of rows().sort(compare)) {
+            body.appendChild(row);
+        }
+        for (const th of table.tHead.querySelectorAll("th[data-sort]")) {
+            if (th.dataset.sort === sortKey) {
+                th.setAttribute("aria-sort", sortDesc ? "descending" : "ascending");
+            } else {
+                th.removeAttribute("aria-sort");
+            }
+        }
+    }
+
+    function ago(ms) {
+        const s = Math.max(0, Math.round((Date.now() - ms) / 1000));
+        if (s < 60) {
+            return s + " s ago";
+        }
+        if (s < 3600) {
+            return Math.floor(s / 60) + " min ago";
+        }
+        if (s < 86400) {
+            return Math.floor(s / 3600) + " h ago";
+        }
+        return Math.floor(s / 86400) + " d ago";
+    }
+
+    function updateTimes() {
+        for (const row of rows()) {
+            const time = row.querySelector("time");
+            if (time && row.dataset.updated) {
+                time.title = time.getAttribute("datetime");
+                time.textContent = ago(Number(row.dataset.updated));
+            }
+        }
+    }
+
+    async function load() {
+        try {
+            const resp = await fetch(window.location.pathname, {headers: {"Accept": "text/html"}});
+            if (!resp.ok) {
+                throw new Error(resp.status + " " + resp.statusText);
+            }
+            const page = new DOMParser().parseFromString(await resp.text(), "text/html");
+            table.replaceChild(document.importNode(page.querySelector("#metrics tbody"), true), table.tBodies[0]);
+            sort();
+            filter();
+            updateTimes();
+            status.className = "";
+            status.textContent = "Updated at " + new Date().toLocaleTimeString();
+        } catch (e) {
+            status.className = "error";
+            status.textContent = "Refresh failed: " + e.message;
+        }
+    }
+
+    function schedule() {
+        clearInterval(timer);
+        timer = null;
+        if (refresh.checked && !document.hidden) {
+            timer = setInterval(load, Number(interval.value) * 1000);
+        }
+    }
+
+    table.tHead.addEventListener("click", (e) => {
+        const th = e.target.closest("th[data-sort]");
+        if (!th) {
+            return;
+        }
+        sortDesc = th.dataset.sort === sortKey ? !sortDesc : false;
+        sortKey = th.dataset.sort;
+        sort();
+    });
+    search.addEventListener("input", filter);
+    type.addEventListener("change", filter);
+    refresh.addEventListener("change", schedule);
+    interval.addEventListener("change", schedule);
+    document.addEventListener("visibilitychange", () => {
+        if (!document.hidden && refresh.checked) {
+            load();
+        }
+        schedule();
+    });
+
+    sort();
+    filter();
+    updateTimes();
+    setInterval(updateTimes, 1000);
+    schedule();
+})();
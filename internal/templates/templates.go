@@ -0,0 +1,10 @@
+// Package templates embeds the pages and the static assets of the server, so that the binary
+// does not depend on the working directory.
+package templates
+
+import "embed"
+
+// FS holds index.gohtml and the files of the static directory.
+//
+//go:embed index.gohtml static
+var FS embed.FS
@@ -0,0 +1,15 @@
+package utils
+
+import "net"
+
+// OutboundIP returns the address of the network interface used to reach the given host:port.
+// No packets are sent, the UDP socket is only used to let the kernel pick the route.
+func OutboundIP(address string) (net.IP, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}